@@ -0,0 +1,33 @@
+package main
+
+// portfall-relay runs in the relay pod of a reverse tunnel and relays inbound connections to Portfall
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"portfall/pkg/relay"
+)
+
+func main() {
+	publicPort := flag.Int("public-port", relay.DefaultPublicPort, "port inbound connections are accepted on")
+	controlPort := flag.Int("control-port", relay.DefaultControlPort, "port Portfall opens control connections to")
+	poolSize := flag.Int("pool-size", 16, "maximum number of idle control connections")
+	flag.Parse()
+
+	public, err := net.Listen("tcp", fmt.Sprintf(":%d", *publicPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	control, err := relay.ListenControl(*controlPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := relay.NewServer(*poolSize)
+	go func() {
+		log.Fatal(s.ServeControl(control))
+	}()
+	log.Printf("relaying port %d through control port %d", *publicPort, *controlPort)
+	log.Fatal(s.ServePublic(public))
+}
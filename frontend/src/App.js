@@ -7,7 +7,7 @@ import Typography from "@material-ui/core/Typography";
 import Autocomplete from '@material-ui/lab/Autocomplete';
 import TextField from "@material-ui/core/TextField";
 import Grid from "@material-ui/core/Grid";
-import {BugReport, Close, Folder, Launch, MoodBadTwoTone, Settings} from "@material-ui/icons";
+import {BugReport, Close, Folder, Launch, MoodBadTwoTone, Settings, Warning} from "@material-ui/icons";
 import Alert from "@material-ui/lab/Alert";
 import {Card, CircularProgress} from "@material-ui/core";
 import Avatar from "@material-ui/core/Avatar";
@@ -24,6 +24,7 @@ import InputLabel from "@material-ui/core/InputLabel";
 import whiteIcon from './whiteicon.png';
 import blueIcon from './blueicon.png';
 import Console from "./components/Console";
+import ScanDialog from "./components/ScanDialog";
 
 const useStyles = makeStyles(theme => ({
     formControl: {
@@ -98,6 +99,8 @@ function App() {
     const [currentContext, setCurrentContext] = useState(null);
     const [version, setVersion] = useState(null);
     const [showConsole, setShowConsole] = useState(false);
+    const [kubectlBypassed, setKubectlBypassed] = useState(false);
+    const [scan, setScan] = useState(null);
     // const prevContext = usePrevious(currentContext);
 
 
@@ -123,6 +126,16 @@ function App() {
 
     }, []);
 
+    useEffect(() => {
+        if (!currentContext) {
+            return;
+        }
+        // kubectl port-forward can't reach the cluster through a bastion
+        Promise.all([window.backend.Client.GetContextBackend(currentContext), window.backend.Client.GetContextBastion(currentContext)]).then(([backend, bastion]) => {
+            setKubectlBypassed(backend === 'kubectl' && !!JSON.parse(bastion || 'null'));
+        });
+    }, [currentContext]);
+
     const refreshContext = () => {
         setWebsites([]);
         setLoading(true);
@@ -250,23 +263,62 @@ function App() {
                                 <Typography>No websites found to port-forward in the selected namespace(s)</Typography>
                             </Alert>
                         </Grid>) : null}
+                        {websites.some(w => w.sharedUrl) ? (<Grid item xs={12}>
+                            <Alert icon={<Warning/>} severity="error" variant="filled" action={
+                                <Button color="inherit" size="small" onClick={() => {
+                                    window.backend.Client.RevokeAllShares().then(() => {
+                                        setWebsites(websites.map(w => ({...w, sharedUrl: ""})));
+                                    });
+                                }}>
+                                    Revoke all
+                                </Button>}>
+                                <Typography>
+                                    {websites.filter(w => w.sharedUrl).length} website(s) are shared on your network
+                                    and reachable by anyone with the access token or in the allowlist
+                                </Typography>
+                            </Alert>
+                        </Grid>) : null}
                         {(configFilePath && !namespaces.length) ? (<Grid item xs={12}>
                             <Alert icon={<MoodBadTwoTone/>} severity="warning">
                                 <Typography>Invalid context, try updating your config or switching context</Typography>
                             </Alert>
                         </Grid>) : null}
-                        {websites.map(({localPort, podPort, title, iconRemoteUrl}) => (
-                            <Grid item xs={4} key={localPort}>
+                        {websites.map(({kind, localPort, localAddress, podPort, title, iconRemoteUrl, httpsUrl, proxyUrl, externalUrl, route, directUrl, reachable, source, portSource, namespace, podName, protocol}) => (
+                            <Grid item xs={4} key={directUrl || `${localAddress}:${localPort}`}>
                                 <Card>
                                     <CardHeader classes={{content: classes.cardHeaderTitle}}
                                                 avatar={<Avatar src={iconRemoteUrl}/>}
-                                                title={<Typography noWrap>{title}</Typography>}
-                                                subheader={<span><b>{localPort}</b>:{podPort}</span>} action={
-                                        <Button endIcon={<Launch/>} size="small" color="primary"
-                                                onClick={() =>
-                                                    window.backend.PortfallOS.OpenInBrowser(`http://localhost:${localPort}`)}>
-                                            Open
-                                        </Button>}/>
+                                                title={<Typography noWrap title={source}>{title}</Typography>}
+                                                subheader={kind === 'direct'
+                                                    ? <span title={directUrl}><b>direct</b>:{podPort}{reachable ? '' : ' (unreachable)'}</span>
+                                                    : <span title={portSource && `port from ${portSource}`}><b>{localAddress ? `${localAddress}:${localPort}` : localPort}</b>:{podPort}{protocol && protocol !== 'http' ? ` ${protocol}` : ''}</span>} action={
+                                        <span>
+                                            {!protocol || protocol === 'http' ? (
+                                                <Button endIcon={<Launch/>} size="small" color="primary"
+                                                        onClick={() =>
+                                                            window.backend.PortfallOS.OpenInBrowser(directUrl || proxyUrl || httpsUrl || `http://${localAddress || 'localhost'}:${localPort}`)}>
+                                                    Open
+                                                </Button>) : null}
+                                            {['postgres', 'mysql', 'redis', 'mongodb'].includes(protocol) ? (
+                                                <Button size="small" color="primary" title="Copy the command to connect, alt-click to include the password"
+                                                        onClick={(e) => window.backend.Client.GetConnectionInfo(localAddress, localPort, e.altKey).then(r => {
+                                                            if (r) navigator.clipboard.writeText(JSON.parse(r).command);
+                                                        })}>
+                                                    Connect
+                                                </Button>) : null}
+                                            {kind !== 'direct' ? (
+                                                <Button size="small" title="List the ports the pod listens on to forward undeclared ones"
+                                                        onClick={() => window.backend.Client.ScanPod(namespace, podName, '').then(r => {
+                                                            setScan({namespace, podName, ports: r ? JSON.parse(r) : null});
+                                                        })}>
+                                                    Scan
+                                                </Button>) : null}
+                                            {externalUrl ? (
+                                                <Button endIcon={<Launch/>} size="small" title={route}
+                                                        onClick={() => window.backend.PortfallOS.OpenInBrowser(externalUrl)}>
+                                                    Direct
+                                                </Button>) : null}
+                                        </span>}/>
 
                                 </Card>
                             </Grid>
@@ -274,6 +326,8 @@ function App() {
                         {loading ? <Grid item xs={12} style={{textAlign: 'center'}}><CircularProgress/></Grid> : null}
                     </Grid>
                 </div>
+                <ScanDialog scan={scan} onClose={() => setScan(null)}
+                            onForwarded={w => setWebsites(ws => [...ws, w])}/>
                 <IconButton variant="contained" color="primary" style={{position: 'fixed', bottom: 10, right: 50}}
                             size="medium"
                             onClick={(e) => {
@@ -358,6 +412,13 @@ function App() {
                                             </Select>
                                         </FormControl>
                                     </Grid> : null}
+                                {kubectlBypassed ? (
+                                    <Grid item xs={12}>
+                                        <Alert severity="warning">
+                                            kubectl port-forward can't use the bastion of context {currentContext}, its
+                                            websites are forwarded in-process instead
+                                        </Alert>
+                                    </Grid>) : null}
                                 {configMessage ? (
                                     <Grid item xs={12}>
                                         <Alert severity={configMessage.severity} onClose={() => {
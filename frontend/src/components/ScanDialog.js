@@ -0,0 +1,71 @@
+import React, {useEffect, useState} from 'react';
+import Button from "@material-ui/core/Button";
+import Checkbox from "@material-ui/core/Checkbox";
+import Dialog from "@material-ui/core/Dialog";
+import DialogActions from "@material-ui/core/DialogActions";
+import DialogContent from "@material-ui/core/DialogContent";
+import DialogTitle from "@material-ui/core/DialogTitle";
+import List from "@material-ui/core/List";
+import ListItem from "@material-ui/core/ListItem";
+import ListItemIcon from "@material-ui/core/ListItemIcon";
+import ListItemText from "@material-ui/core/ListItemText";
+import Typography from "@material-ui/core/Typography";
+
+// ScanDialog lists the ports a scan found the pod listening on and forwards the ones picked by the user. ports is
+// null if the pod couldn't be scanned.
+function ScanDialog({scan, onClose, onForwarded}) {
+    const [selected, setSelected] = useState([]);
+    const [forwarding, setForwarding] = useState(false);
+
+    useEffect(() => {
+        setSelected([]);
+        setForwarding(false);
+    }, [scan]);
+
+    if (!scan) {
+        return null;
+    }
+    const toggle = port => setSelected(selected.includes(port) ? selected.filter(p => p !== port) : [...selected, port]);
+    const forward = () => {
+        setForwarding(true);
+        Promise.all(selected.map(port =>
+            window.backend.Client.ForwardScannedPort(scan.namespace, scan.podName, '', port).then(w => {
+                if (w) onForwarded(JSON.parse(w));
+            })
+        )).then(onClose);
+    };
+
+    return (
+        <Dialog open onClose={onClose} fullWidth maxWidth="xs">
+            <DialogTitle>Ports of {scan.podName}</DialogTitle>
+            <DialogContent dividers>
+                {!scan.ports ? (
+                    <Typography>The pod couldn't be scanned, see the console for the reason</Typography>
+                ) : !scan.ports.length ? (
+                    <Typography>The pod doesn't listen on any tcp ports</Typography>
+                ) : (
+                    <List dense>
+                        {scan.ports.map(({port, addresses, forwarded}) => (
+                            <ListItem key={port} button disabled={forwarded || forwarding} onClick={() => toggle(port)}>
+                                <ListItemIcon>
+                                    <Checkbox edge="start" color="primary" disableRipple
+                                              checked={forwarded || selected.includes(port)}/>
+                                </ListItemIcon>
+                                <ListItemText primary={forwarded ? `${port} (forwarded)` : port}
+                                              secondary={(addresses || []).join(', ')}/>
+                            </ListItem>
+                        ))}
+                    </List>
+                )}
+            </DialogContent>
+            <DialogActions>
+                <Button onClick={onClose}>Cancel</Button>
+                <Button color="primary" disabled={!selected.length || forwarding} onClick={forward}>
+                    Forward {selected.length ? selected.length : ''}
+                </Button>
+            </DialogActions>
+        </Dialog>
+    );
+}
+
+export default ScanDialog;
@@ -0,0 +1,372 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backendService serves a website from all ready endpoints of its service
+const backendService = "service"
+
+// Policies for balancing connections across the endpoints of a service
+const (
+	balanceRoundRobin       = "round-robin"
+	balanceLeastConnections = "least-connections"
+)
+
+const (
+	// stickyCookie pins the requests of a browser to the endpoint it was first sent to
+	stickyCookie = "portfall-backend"
+	// endpointsRefreshInterval is how often the endpoints of a balanced service are fetched again
+	endpointsRefreshInterval = 10 * time.Second
+	// unhealthyCooldown is how long an endpoint which failed a connection is skipped
+	unhealthyCooldown = 30 * time.Second
+)
+
+// balancerBackend is a ready endpoint of a balanced service
+type balancerBackend struct {
+	pod    v1.Pod
+	port   int32
+	tunnel *podTunnel
+	// transport sends http requests to the endpoint in sticky mode, created on first use
+	transport *http.Transport
+	// active is the number of connections currently open to the endpoint, accessed atomically
+	active int64
+	// unhealthyUntil is guarded by the balancer's mutex
+	unhealthyUntil time.Time
+}
+
+func (b *balancerBackend) key() string {
+	return b.pod.Name + ":" + strconv.Itoa(int(b.port))
+}
+
+// serviceBalancer spreads local connections across the ready endpoints of a service port, following the service's
+// endpoints as pods come and go
+type serviceBalancer struct {
+	conf      *rest.Config
+	transport string
+	namespace string
+	service   string
+	// portName selects the endpoint port matching the service port
+	portName  string
+	policy    string
+	sticky    bool
+	endpoints func() (*v1.Endpoints, error)
+	mu        sync.Mutex
+	backends  []*balancerBackend
+	next      int
+	// backendStats absorbs the traffic of the connections to the endpoints in sticky mode, which is already counted
+	// on the local connections
+	backendStats *trafficStats
+}
+
+// newServiceBalancer balances the service port across the service's ready endpoints using policy
+func (c *Client) newServiceBalancer(namespace string, service string, port int32, policy string, sticky bool) (*serviceBalancer, error) {
+	svc, err := c.s.CoreV1().Services(namespace).Get(service, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	lb := &serviceBalancer{
+		conf:      c.forwardConf,
+		transport: c.settings.forContext(c.currentContext).Transport,
+		namespace: namespace,
+		service:   service,
+		policy:    policy,
+		sticky:    sticky,
+		endpoints: func() (*v1.Endpoints, error) {
+			return c.s.CoreV1().Endpoints(namespace).Get(service, metav1.GetOptions{})
+		},
+		backendStats: &trafficStats{},
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.Port == port {
+			lb.portName = p.Name
+		}
+	}
+	if err := lb.refresh(); err != nil {
+		return nil, err
+	}
+	return lb, nil
+}
+
+// refresh fetches the endpoints of the service and replaces the backends with its ready addresses, keeping the
+// tunnels of endpoints which are still ready
+func (lb *serviceBalancer) refresh() error {
+	ep, err := lb.endpoints()
+	if err != nil {
+		return err
+	}
+	lb.update(ep)
+	if lb.size() == 0 {
+		return fmt.Errorf("service %s has no ready endpoints", lb.service)
+	}
+	return nil
+}
+
+func (lb *serviceBalancer) update(ep *v1.Endpoints) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	existing := map[string]*balancerBackend{}
+	for _, b := range lb.backends {
+		existing[b.key()] = b
+	}
+	var backends []*balancerBackend
+	for _, subset := range ep.Subsets {
+		var port int32
+		for _, p := range subset.Ports {
+			if p.Name == lb.portName {
+				port = p.Port
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		// only ready addresses are used, not ready ones are listed separately
+		for _, addr := range subset.Addresses {
+			if addr.TargetRef == nil || addr.TargetRef.Kind != "Pod" {
+				continue
+			}
+			pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: addr.TargetRef.Name, Namespace: lb.namespace}}
+			b := &balancerBackend{pod: pod, port: port}
+			if old, ok := existing[b.key()]; ok {
+				backends = append(backends, old)
+				delete(existing, b.key())
+				continue
+			}
+			b.tunnel = newPodTunnel(lb.conf, pod, lb.transport, 0)
+			backends = append(backends, b)
+		}
+	}
+	for _, b := range existing {
+		b.close()
+	}
+	lb.backends = backends
+}
+
+func (lb *serviceBalancer) size() int {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return len(lb.backends)
+}
+
+// pick chooses the backend for a new connection, preferring the backend with the key prefer if it is healthy
+func (lb *serviceBalancer) pick(prefer string) (*balancerBackend, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	now := time.Now()
+	var healthy []*balancerBackend
+	for _, b := range lb.backends {
+		if now.After(b.unhealthyUntil) {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, fmt.Errorf("service %s has no healthy endpoints", lb.service)
+	}
+	for _, b := range healthy {
+		if prefer != "" && b.key() == prefer {
+			return b, nil
+		}
+	}
+	start := lb.next % len(healthy)
+	lb.next++
+	chosen := healthy[start]
+	if lb.policy == balanceLeastConnections {
+		for i := range healthy {
+			b := healthy[(start+i)%len(healthy)]
+			if atomic.LoadInt64(&b.active) < atomic.LoadInt64(&chosen.active) {
+				chosen = b
+			}
+		}
+	}
+	return chosen, nil
+}
+
+// markUnhealthy skips the backend for new connections until the cooldown passed
+func (lb *serviceBalancer) markUnhealthy(b *balancerBackend, err error) {
+	fmt.Fprintf(os.Stderr, "removing endpoint %s of service %s for %v: %v\n", b.key(), lb.service, unhealthyCooldown, err)
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	b.unhealthyUntil = time.Now().Add(unhealthyCooldown)
+}
+
+// handle forwards a local connection to a healthy backend, trying the next backend if one can't be reached
+func (lb *serviceBalancer) handle(conn net.Conn, stats *trafficStats) {
+	defer conn.Close()
+	stats.connectionOpened()
+	defer stats.connectionClosed()
+	for attempt := 0; attempt < lb.size(); attempt++ {
+		b, err := lb.pick("")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return
+		}
+		if err := lb.forward(b, conn, stats); err != nil {
+			lb.markUnhealthy(b, err)
+			continue
+		}
+		return
+	}
+}
+
+// forward splices conn with a new stream to the backend. An error is only returned if no stream could be opened.
+func (lb *serviceBalancer) forward(b *balancerBackend, conn net.Conn, stats *trafficStats) error {
+	podConn, err := b.tunnel.connection()
+	if err != nil {
+		return err
+	}
+	dataStream, errorChan, err := podConn.openStream(b.port)
+	if err != nil {
+		b.tunnel.close()
+		return err
+	}
+	atomic.AddInt64(&b.active, 1)
+	defer atomic.AddInt64(&b.active, -1)
+	splice(conn, dataStream, stats)
+	if err := <-errorChan; err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	return nil
+}
+
+// httpTransport returns the transport sending requests to the backend in sticky mode
+func (lb *serviceBalancer) httpTransport(b *balancerBackend) *http.Transport {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if b.transport == nil {
+		b.transport = &http.Transport{
+			Dial: func(network string, addr string) (net.Conn, error) {
+				local, remote := net.Pipe()
+				go func() {
+					defer remote.Close()
+					if err := lb.forward(b, remote, lb.backendStats); err != nil {
+						lb.markUnhealthy(b, err)
+					}
+				}()
+				return local, nil
+			},
+			IdleConnTimeout: 90 * time.Second,
+		}
+	}
+	return b.transport
+}
+
+// RoundTrip sends the request to the backend named in its sticky cookie, or a newly picked one which is then
+// remembered in the cookie
+func (lb *serviceBalancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var prefer string
+	if cookie, err := req.Cookie(stickyCookie); err == nil {
+		prefer = cookie.Value
+	}
+	b, err := lb.pick(prefer)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := lb.httpTransport(b).RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if b.key() != prefer {
+		resp.Header.Add("Set-Cookie", (&http.Cookie{Name: stickyCookie, Value: b.key(), Path: "/", HttpOnly: true}).String())
+	}
+	return resp, nil
+}
+
+func (lb *serviceBalancer) close() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, b := range lb.backends {
+		b.close()
+	}
+	lb.backends = nil
+}
+
+func (b *balancerBackend) close() {
+	b.tunnel.close()
+	if b.transport != nil {
+		b.transport.CloseIdleConnections()
+	}
+}
+
+// balanceAService takes a portForwardPodRequest for a service port and serves it locally from all ready endpoints
+// of the service, following the same lifecycle as portForwardAPod. In sticky mode the port is served by a reverse
+// proxy so that browsers can be pinned to an endpoint with a cookie.
+func balanceAService(req portForwardPodRequest) error {
+	lb := req.Balancer
+	if lb == nil {
+		return errors.New("no balancer for service " + req.ServiceName)
+	}
+	defer lb.close()
+	listeners, err := req.listen()
+	if err != nil {
+		return err
+	}
+	if lb.sticky {
+		server := &http.Server{Handler: &httputil.ReverseProxy{
+			Director: func(r *http.Request) {
+				r.URL.Scheme = "http"
+				r.URL.Host = r.Host
+			},
+			Transport: lb,
+		}}
+		for _, l := range listeners {
+			go server.Serve(&countingListener{Listener: l, stats: req.Stats})
+		}
+		defer server.Close()
+	} else {
+		for _, l := range listeners {
+			go serveListener(l, func(conn net.Conn) {
+				lb.handle(conn, req.Stats)
+			})
+		}
+		defer func() {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}()
+	}
+	close(req.ReadyCh)
+
+	ticker := time.NewTicker(endpointsRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.StopCh:
+			return nil
+		case <-ticker.C:
+			if err := lb.refresh(); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}
+	}
+}
+
+// SetServiceMode serves websites of services forwarded from now on from all ready endpoints of the service, balancing
+// new connections with round-robin or least-connections. Sticky pins browsers to an endpoint with a cookie, which
+// requires the service to speak http. An empty balancing forwards to a single pod again. The mode used is returned,
+// which is the previous one if the given balancing is unknown.
+func (c *Client) SetServiceMode(balancing string, sticky bool) string {
+	switch balancing {
+	case "", balanceRoundRobin, balanceLeastConnections:
+	default:
+		c.log.Warnf("unknown balancing %s", balancing)
+		return c.settings.ServiceMode
+	}
+	c.settings.ServiceMode = balancing
+	c.settings.StickySessions = sticky
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	return balancing
+}
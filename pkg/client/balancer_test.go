@@ -0,0 +1,67 @@
+package client
+
+import (
+	"errors"
+	v1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+func testEndpoints(ready []string, notReady []string) *v1.Endpoints {
+	subset := v1.EndpointSubset{Ports: []v1.EndpointPort{{Name: "http", Port: 8080}, {Name: "metrics", Port: 9090}}}
+	for _, name := range ready {
+		subset.Addresses = append(subset.Addresses, v1.EndpointAddress{TargetRef: &v1.ObjectReference{Kind: "Pod", Name: name}})
+	}
+	for _, name := range notReady {
+		subset.NotReadyAddresses = append(subset.NotReadyAddresses, v1.EndpointAddress{TargetRef: &v1.ObjectReference{Kind: "Pod", Name: name}})
+	}
+	return &v1.Endpoints{Subsets: []v1.EndpointSubset{subset}}
+}
+
+func pickKeys(t *testing.T, lb *serviceBalancer, n int) []string {
+	var keys []string
+	for i := 0; i < n; i++ {
+		b, err := lb.pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, b.key())
+	}
+	return keys
+}
+
+func TestServiceBalancerFollowsReadyEndpoints(t *testing.T) {
+	lb := &serviceBalancer{namespace: "default", service: "web", portName: "http", policy: balanceRoundRobin}
+	lb.update(testEndpoints([]string{"web-1", "web-2"}, []string{"web-3"}))
+	keys := pickKeys(t, lb, 3)
+	if keys[0] != "web-1:8080" || keys[1] != "web-2:8080" || keys[2] != "web-1:8080" {
+		t.Errorf("expected round-robin across the ready endpoints got %v", keys)
+	}
+	first := lb.backends[0]
+
+	lb.update(testEndpoints([]string{"web-1", "web-3"}, nil))
+	if lb.size() != 2 || lb.backends[0] != first {
+		t.Errorf("expected web-1 to be kept and web-2 replaced by web-3 got %d backends", lb.size())
+	}
+
+	lb.markUnhealthy(first, errors.New("connection refused"))
+	if keys := pickKeys(t, lb, 2); keys[0] != "web-3:8080" || keys[1] != "web-3:8080" {
+		t.Errorf("expected the unhealthy endpoint to be skipped got %v", keys)
+	}
+	if b, _ := lb.pick("web-1:8080"); b.key() != "web-3:8080" {
+		t.Errorf("expected stickiness to an unhealthy endpoint to be broken got %s", b.key())
+	}
+}
+
+func TestServiceBalancerLeastConnections(t *testing.T) {
+	lb := &serviceBalancer{namespace: "default", service: "web", portName: "http", policy: balanceLeastConnections}
+	lb.update(testEndpoints([]string{"web-1", "web-2", "web-3"}, nil))
+	lb.backends[0].active = 3
+	lb.backends[1].active = 1
+	lb.backends[2].active = 2
+	if keys := pickKeys(t, lb, 3); keys[0] != "web-2:8080" || keys[1] != "web-2:8080" || keys[2] != "web-2:8080" {
+		t.Errorf("expected the endpoint with the fewest connections got %v", keys)
+	}
+	if b, _ := lb.pick("web-3:8080"); b.key() != "web-3:8080" {
+		t.Errorf("expected the sticky endpoint to be preferred got %s", b.key())
+	}
+}
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"k8s.io/client-go/rest"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// bastionSettings configures an SSH jump host through which the API server of a context is reached
+type bastionSettings struct {
+	// Host is the address of the bastion, the port defaults to 22
+	Host string `json:"host"`
+	User string `json:"user"`
+	// KeyPath is a private key used to authenticate, it must not be passphrase protected
+	KeyPath string `json:"keyPath,omitempty"`
+	// UseAgent authenticates with the keys of the running ssh-agent
+	UseAgent bool `json:"useAgent,omitempty"`
+	// KnownHostsPath verifies the bastion's host key, defaulting to ~/.ssh/known_hosts
+	KnownHostsPath string `json:"knownHostsPath,omitempty"`
+}
+
+// sshBastion dials through a single SSH client to the bastion, reconnecting when the client was lost
+type sshBastion struct {
+	addr   string
+	config *ssh.ClientConfig
+	// agentSock is the socket of the ssh-agent authenticating with its keys, if it is used
+	agentSock string
+	mu        sync.Mutex
+	client    *ssh.Client
+	// relays are loopback listeners forwarding to a target through the bastion, keyed by target
+	relays map[string]net.Listener
+}
+
+// newSSHBastion prepares the authentication and host key verification for the bastion without connecting yet
+func newSSHBastion(s bastionSettings) (*sshBastion, error) {
+	if s.Host == "" || s.User == "" {
+		return nil, errors.New("a bastion needs a host and a user")
+	}
+	addr := s.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	var auth []ssh.AuthMethod
+	var agentSock string
+	if s.KeyPath != "" {
+		key, err := ioutil.ReadFile(s.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s, use the ssh-agent for passphrase protected keys: %v", s.KeyPath, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if s.UseAgent {
+		agentSock = os.Getenv("SSH_AUTH_SOCK")
+		if agentSock == "" {
+			return nil, errors.New("no ssh-agent found, SSH_AUTH_SOCK is not set")
+		}
+	}
+	if len(auth) == 0 && agentSock == "" {
+		return nil, errors.New("a bastion needs a key or the ssh-agent to authenticate")
+	}
+
+	knownHostsPath := s.KnownHostsPath
+	if knownHostsPath == "" {
+		knownHostsPath = filepath.Join(homeDir(), ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshBastion{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            s.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+		agentSock: agentSock,
+		relays:    map[string]net.Listener{},
+	}, nil
+}
+
+func (b *sshBastion) sshClient() (*ssh.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client != nil {
+		return b.client, nil
+	}
+	config := b.config
+	if b.agentSock != "" {
+		// the agent only signs during the handshake, its connection is closed once connected
+		agentConn, err := net.Dial("unix", b.agentSock)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to the ssh-agent: %v", err)
+		}
+		defer agentConn.Close()
+		withAgent := *b.config
+		withAgent.Auth = append(append([]ssh.AuthMethod(nil), b.config.Auth...), ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		config = &withAgent
+	}
+	client, err := ssh.Dial("tcp", b.addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to bastion %s: %v", b.addr, err)
+	}
+	b.client = client
+	go func() {
+		client.Wait()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.client == client {
+			b.client = nil
+		}
+	}()
+	return client, nil
+}
+
+// DialContext opens a connection to addr from the bastion and can be used as rest.Config.Dial
+func (b *sshBastion) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	client, err := b.sshClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial(network, addr)
+}
+
+// relay returns a loopback address which forwards every connection to target through the bastion. It is used for
+// clients such as the SPDY round tripper which cannot be given a dial function.
+func (b *sshBastion) relay(target string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if l, ok := b.relays[target]; ok {
+		return l.Addr().String(), nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	b.relays[target] = l
+	go serveListener(l, func(conn net.Conn) {
+		defer conn.Close()
+		remote, err := b.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error relaying to %s: %v\n", target, err)
+			return
+		}
+		defer remote.Close()
+		go io.Copy(remote, conn)
+		io.Copy(conn, remote)
+	})
+	return l.Addr().String(), nil
+}
+
+// Close stops all relays and disconnects from the bastion
+func (b *sshBastion) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for target, l := range b.relays {
+		l.Close()
+		delete(b.relays, target)
+	}
+	if b.client != nil {
+		b.client.Close()
+		b.client = nil
+	}
+}
+
+// routeConfig makes the rest transport of conf dial through the bastion
+func (b *sshBastion) routeConfig(conf *rest.Config) {
+	conf.Dial = b.DialContext
+}
+
+// relayedConfig returns a copy of conf which reaches the API server through a relay on the bastion, keeping the TLS
+// server name of the original host. Port-forwards use it since they can't all be given a dial function.
+func (b *sshBastion) relayedConfig(conf *rest.Config) (*rest.Config, error) {
+	host := conf.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	target := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "http" {
+			target = net.JoinHostPort(u.Hostname(), "80")
+		} else {
+			target = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+	relayAddr, err := b.relay(target)
+	if err != nil {
+		return nil, err
+	}
+	relayed := rest.CopyConfig(conf)
+	relayed.Dial = nil
+	if relayed.ServerName == "" {
+		relayed.ServerName = u.Hostname()
+	}
+	u.Host = relayAddr
+	relayed.Host = u.String()
+	return relayed, nil
+}
@@ -0,0 +1,326 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/wailsapp/wails"
+	"github.com/wailsapp/wails/lib/interfaces"
+	"github.com/wailsapp/wails/lib/messages"
+	"github.com/wailsapp/wails/runtime"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd/api"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"portfall/pkg/logger"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) (ssh.Signer, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// startSSHStub runs a minimal sshd which only accepts the given user key and supports direct-tcpip forwarding
+func startSSHStub(t *testing.T, hostKey ssh.Signer, userKey ssh.PublicKey) net.Listener {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "portfall" && string(key.Marshal()) == string(userKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveListener(l, func(conn net.Conn) {
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for newChannel := range chans {
+			if newChannel.ChannelType() != "direct-tcpip" {
+				newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+				continue
+			}
+			var target struct {
+				Host       string
+				Port       uint32
+				OriginHost string
+				OriginPort uint32
+			}
+			ssh.Unmarshal(newChannel.ExtraData(), &target)
+			remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+			if err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				remote.Close()
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go func() {
+				defer channel.Close()
+				defer remote.Close()
+				go io.Copy(remote, channel)
+				io.Copy(channel, remote)
+			}()
+		}
+	})
+	return l
+}
+
+// newTestBastion starts an sshd stub and returns bastion settings which trust it together with the stub's listener
+func newTestBastion(t *testing.T, dir string) (bastionSettings, net.Listener) {
+	hostKey, _ := newTestSigner(t)
+	userKey, userKeyPEM := newTestSigner(t)
+	sshd := startSSHStub(t, hostKey, userKey.PublicKey())
+
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(keyPath, userKeyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(sshd.Addr().String())}, hostKey.PublicKey())
+	if err := ioutil.WriteFile(knownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return bastionSettings{
+		Host:           sshd.Addr().String(),
+		User:           "portfall",
+		KeyPath:        keyPath,
+		KnownHostsPath: knownHostsPath,
+	}, sshd
+}
+
+func TestBastionRoutesRestAndForwardConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portfall-bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer apiServer.Close()
+
+	settings, sshd := newTestBastion(t, dir)
+	defer sshd.Close()
+	bastion, err := newSSHBastion(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bastion.Close()
+
+	conf := &rest.Config{Host: apiServer.URL + "/prefix"}
+	bastion.routeConfig(conf)
+	transport, err := rest.TransportFor(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(apiServer.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/api" {
+		t.Errorf("expected the rest transport to reach the api server got %s", body)
+	}
+
+	relayed, err := bastion.relayedConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayed.Host == conf.Host || relayed.Dial != nil {
+		t.Fatalf("expected the forward config to use a relay got host %s", relayed.Host)
+	}
+	u, err := podURL(relayed, testPod, "portforward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/prefix/api/v1/namespaces/default/pods/web/portforward" {
+		t.Errorf("expected the relay to reach the api server got %s", body)
+	}
+}
+
+func TestBastionRejectsUnknownHostKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portfall-bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	settings, sshd := newTestBastion(t, dir)
+	defer sshd.Close()
+	otherHostKey, _ := newTestSigner(t)
+	line := knownhosts.Line([]string{knownhosts.Normalize(settings.Host)}, otherHostKey.PublicKey())
+	if err := ioutil.WriteFile(settings.KnownHostsPath, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bastion, err := newSSHBastion(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bastion.Close()
+	if _, err := bastion.DialContext(context.Background(), "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("expected connecting to a bastion with an unknown host key to fail")
+	}
+}
+
+// discardEvents drops the events the logger emits to the frontend
+type discardEvents struct{}
+
+func (discardEvents) PushEvent(*messages.EventData)                      {}
+func (discardEvents) Emit(eventName string, data ...interface{})         {}
+func (discardEvents) On(eventName string, callback func(...interface{})) {}
+func (discardEvents) Start(interfaces.Renderer)                          {}
+func (discardEvents) Shutdown()                                          {}
+
+func testLogger() *logger.CustomLogger {
+	return logger.NewCustomLogger("Client", &wails.Runtime{Events: runtime.NewEvents(discardEvents{})})
+}
+
+func TestChangingTheBastionThenShuttingDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portfall-bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CONFIG_HOME", os.Getenv("XDG_CONFIG_HOME"))
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	hostsPath := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hostsPath, []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rawConf := &api.Config{
+		Clusters:  map[string]*api.Cluster{"prod": {Server: "https://127.0.0.1:6443"}},
+		AuthInfos: map[string]*api.AuthInfo{"prod": {Token: "secret"}},
+		Contexts:  map[string]*api.Context{"prod": {Cluster: "prod", AuthInfo: "prod"}},
+	}
+	c := &Client{
+		log:              testLogger(),
+		settings:         &settings{Contexts: map[string]*contextSettings{}, HostsPath: hostsPath},
+		rawConf:          rawConf,
+		currentContext:   "prod",
+		activeNamespaces: []string{"default"},
+	}
+	for _, port := range []int32{80, 8080} {
+		c.websites = append(c.websites, &Website{PodPort: port, portForwardReq: portForwardPodRequest{StopCh: make(chan struct{})}})
+	}
+	stopChs := []chan struct{}{c.websites[0].portForwardReq.StopCh, c.websites[1].portForwardReq.StopCh}
+
+	if msg := c.RemoveContextBastion("prod"); msg != "" {
+		t.Fatalf("expected the context to be reconnected got %s", msg)
+	}
+	for _, stopCh := range stopChs {
+		select {
+		case <-stopCh:
+		default:
+			t.Error("expected the forwards of the context to be closed")
+		}
+	}
+	if len(c.websites) != 0 || len(c.activeNamespaces) != 0 {
+		t.Errorf("expected the closed websites to be forgotten got %d websites in %v", len(c.websites), c.activeNamespaces)
+	}
+	// closing the forwards again would panic
+	c.RemoveWebsitesInNamespace("default")
+	c.WailsShutdown()
+}
+
+func TestBastionClosesAgentConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portfall-bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	settings, sshd := newTestBastion(t, dir)
+	defer sshd.Close()
+	key, err := ioutil.ReadFile(settings.KeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := ssh.ParseRawPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: rawKey}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var open int32
+	go serveListener(l, func(conn net.Conn) {
+		atomic.AddInt32(&open, 1)
+		defer atomic.AddInt32(&open, -1)
+		defer conn.Close()
+		agent.ServeAgent(keyring, conn)
+	})
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", sock)
+
+	settings.KeyPath = ""
+	settings.UseAgent = true
+	bastion, err := newSSHBastion(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bastion.Close()
+	for i := 0; i < 2; i++ {
+		// the second round reconnects
+		if _, err := bastion.sshClient(); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&open) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the agent connection to be closed after connecting got %d open", atomic.LoadInt32(&open))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		bastion.Close()
+	}
+}
@@ -0,0 +1,281 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetworkConditions are the bad network conditions simulated on the local side of a forward
+type NetworkConditions struct {
+	// LatencyMs delays everything sent back to the local client, varied by up to JitterMs either way
+	LatencyMs int `json:"latencyMs"`
+	JitterMs  int `json:"jitterMs"`
+	// BandwidthKBps limits each direction of every connection, 0 is unlimited
+	BandwidthKBps int `json:"bandwidthKBps"`
+	// DropPercent of new connections are closed right away and ResetPercent of them are reset
+	DropPercent  float64 `json:"dropPercent"`
+	ResetPercent float64 `json:"resetPercent"`
+}
+
+func (nc NetworkConditions) validate() error {
+	if nc.LatencyMs < 0 || nc.JitterMs < 0 || nc.BandwidthKBps < 0 {
+		return errors.New("latency, jitter and bandwidth can't be negative")
+	}
+	if nc.DropPercent < 0 || nc.ResetPercent < 0 || nc.DropPercent+nc.ResetPercent > 100 {
+		return errors.New("the percentages of dropped and reset connections need to be between 0 and 100 in total")
+	}
+	return nil
+}
+
+func (nc NetworkConditions) active() bool {
+	return nc != NetworkConditions{}
+}
+
+// delay returns the latency of the next chunk
+func (nc NetworkConditions) delay() time.Duration {
+	d := time.Duration(nc.LatencyMs) * time.Millisecond
+	if nc.JitterMs > 0 {
+		d += time.Duration(rand.Intn(2*nc.JitterMs+1)-nc.JitterMs) * time.Millisecond
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// burst is the most bytes passed on at once with a bandwidth limit, which keeps the transfer smooth
+func (nc NetworkConditions) burst() int {
+	b := nc.BandwidthKBps * 1024 / 10
+	if b < 1 {
+		return 1
+	}
+	return b
+}
+
+// throttle waits for as long as transferring n bytes takes with the bandwidth limit
+func (nc NetworkConditions) throttle(n int) {
+	if nc.BandwidthKBps > 0 && n > 0 {
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(nc.BandwidthKBps*1024))
+	}
+}
+
+// networkChaos holds the conditions of a forward, which can be changed while connections are open
+type networkChaos struct {
+	mu         sync.RWMutex
+	conditions NetworkConditions
+}
+
+func (nc *networkChaos) get() NetworkConditions {
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
+	return nc.conditions
+}
+
+func (nc *networkChaos) set(conditions NetworkConditions) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.conditions = conditions
+}
+
+// chaosListener drops, resets or slows down the connections it accepts according to the current conditions
+type chaosListener struct {
+	net.Listener
+	chaos *networkChaos
+}
+
+func (l *chaosListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		conditions := l.chaos.get()
+		if !conditions.active() {
+			return &chaosConn{Conn: conn, chaos: l.chaos}, nil
+		}
+		roll := rand.Float64() * 100
+		switch {
+		case roll < conditions.DropPercent:
+			conn.Close()
+		case roll < conditions.DropPercent+conditions.ResetPercent:
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				// without lingering the close sends a reset
+				tcp.SetLinger(0)
+			}
+			conn.Close()
+		default:
+			return &chaosConn{Conn: conn, chaos: l.chaos}, nil
+		}
+	}
+}
+
+// errConnClosed is returned when writing to a closed chaosConn, worded like the error of closed net connections
+var errConnClosed = errors.New("use of closed network connection")
+
+// delayedChunk is data written to a chaosConn which is passed on once it is due
+type delayedChunk struct {
+	data []byte
+	due  time.Time
+}
+
+// chaosConn slows down a local connection. Writes are put on a delay line once there is latency so that the latency
+// doesn't lower the throughput.
+type chaosConn struct {
+	net.Conn
+	chaos *networkChaos
+	// mu serializes writes with closing the connection
+	mu        sync.Mutex
+	closed    bool
+	queue     chan delayedChunk
+	delivered chan struct{}
+	lastDue   time.Time
+	// errMu guards the error of the delay line, which is returned on the next write
+	errMu     sync.Mutex
+	writeErr  error
+	closeOnce sync.Once
+}
+
+func (c *chaosConn) Read(p []byte) (int, error) {
+	conditions := c.chaos.get()
+	if conditions.BandwidthKBps > 0 && len(p) > conditions.burst() {
+		p = p[:conditions.burst()]
+	}
+	n, err := c.Conn.Read(p)
+	conditions.throttle(n)
+	return n, err
+}
+
+func (c *chaosConn) Write(p []byte) (int, error) {
+	conditions := c.chaos.get()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errConnClosed
+	}
+	if err := c.deliveryError(); err != nil {
+		return 0, err
+	}
+	if c.queue == nil && conditions.LatencyMs == 0 && conditions.JitterMs == 0 {
+		return c.writeThrottled(p)
+	}
+	if c.queue == nil {
+		c.queue = make(chan delayedChunk, 64)
+		c.delivered = make(chan struct{})
+		go c.deliver(c.queue)
+	}
+	due := time.Now().Add(conditions.delay())
+	// jitter must not reorder the data
+	if due.Before(c.lastDue) {
+		due = c.lastDue
+	}
+	c.lastDue = due
+	c.queue <- delayedChunk{data: append([]byte(nil), p...), due: due}
+	return len(p), nil
+}
+
+// writeThrottled writes p in bursts the bandwidth limit allows
+func (c *chaosConn) writeThrottled(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		conditions := c.chaos.get()
+		end := len(p)
+		if conditions.BandwidthKBps > 0 && end-written > conditions.burst() {
+			end = written + conditions.burst()
+		}
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		conditions.throttle(n)
+	}
+	return written, nil
+}
+
+// deliver writes the chunks of the delay line once they are due
+func (c *chaosConn) deliver(queue chan delayedChunk) {
+	defer close(c.delivered)
+	for chunk := range queue {
+		time.Sleep(time.Until(chunk.due))
+		if _, err := c.writeThrottled(chunk.data); err != nil {
+			c.errMu.Lock()
+			c.writeErr = err
+			c.errMu.Unlock()
+		}
+	}
+}
+
+func (c *chaosConn) deliveryError() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.writeErr
+}
+
+// Close passes on what is still on the delay line before closing the connection
+func (c *chaosConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		queue, delivered, lastDue := c.queue, c.delivered, c.lastDue
+		c.closed = true
+		c.mu.Unlock()
+		if queue != nil {
+			close(queue)
+			select {
+			case <-delivered:
+			case <-time.After(time.Until(lastDue) + 5*time.Second):
+			}
+		}
+	})
+	return c.Conn.Close()
+}
+
+// listen binds the local port of the request, simulating its network conditions on every accepted connection
+func (req portForwardPodRequest) listen() ([]net.Listener, error) {
+	listeners, err := listenLocal(req.LocalAddress, req.LocalPort)
+	if err != nil || req.Chaos == nil {
+		return listeners, err
+	}
+	for i, l := range listeners {
+		listeners[i] = &chaosListener{Listener: l, chaos: req.Chaos}
+	}
+	return listeners, nil
+}
+
+// SetWebsiteConditions simulates bad network conditions on the local side of the website on localAddress:localPort,
+// see NetworkConditions. They apply to open connections right away, the port-forward itself is left as it is. All
+// zero conditions turn the simulation off. An empty string is returned on success, otherwise the reason the
+// conditions can't be used.
+func (c *Client) SetWebsiteConditions(localAddress string, localPort int, latencyMs int, jitterMs int, bandwidthKBps int, dropPercent float64, resetPercent float64) string {
+	conditions := NetworkConditions{
+		LatencyMs:     latencyMs,
+		JitterMs:      jitterMs,
+		BandwidthKBps: bandwidthKBps,
+		DropPercent:   dropPercent,
+		ResetPercent:  resetPercent,
+	}
+	if err := conditions.validate(); err != nil {
+		return err.Error()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.websites {
+		if w.LocalAddress != localAddress || int(w.LocalPort) != localPort {
+			continue
+		}
+		if w.portForwardReq.Chaos == nil {
+			return fmt.Sprintf("website on port %d doesn't support network conditions", localPort)
+		}
+		w.portForwardReq.Chaos.set(conditions)
+		w.Conditions = nil
+		if conditions.active() {
+			w.Conditions = &conditions
+		}
+		c.log.Infof("network conditions of website on port %d set to %+v", localPort, conditions)
+		return ""
+	}
+	return fmt.Sprintf("no website on port %d", localPort)
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startChaosEcho serves the connections accepted by a chaos listener with an echo
+func startChaosEcho(t *testing.T, chaos *networkChaos) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveListener(&chaosListener{Listener: l, chaos: chaos}, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	return l
+}
+
+func roundTrip(t *testing.T, addr string, payload []byte) time.Duration {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.Write(payload)
+	if _, err := io.ReadFull(conn, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestChaosLatencyIsChangedLive(t *testing.T) {
+	chaos := &networkChaos{}
+	l := startChaosEcho(t, chaos)
+	defer l.Close()
+
+	chaos.set(NetworkConditions{LatencyMs: 150})
+	if d := roundTrip(t, l.Addr().String(), []byte("ping")); d < 150*time.Millisecond {
+		t.Errorf("expected the latency to be added got a round trip of %v", d)
+	}
+	chaos.set(NetworkConditions{})
+	if d := roundTrip(t, l.Addr().String(), []byte("ping")); d > 100*time.Millisecond {
+		t.Errorf("expected no latency once it was turned off got a round trip of %v", d)
+	}
+}
+
+func TestChaosBandwidth(t *testing.T) {
+	chaos := &networkChaos{}
+	chaos.set(NetworkConditions{BandwidthKBps: 10})
+	l := startChaosEcho(t, chaos)
+	defer l.Close()
+	// 4KiB take 400ms at 10KiB/s in each direction
+	if d := roundTrip(t, l.Addr().String(), make([]byte, 4096)); d < 300*time.Millisecond {
+		t.Errorf("expected the transfer to be throttled got %v", d)
+	}
+}
+
+func TestChaosDropsConnections(t *testing.T) {
+	chaos := &networkChaos{}
+	chaos.set(NetworkConditions{DropPercent: 100})
+	l := startChaosEcho(t, chaos)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if b, err := ioutil.ReadAll(conn); err != nil || len(b) != 0 {
+		t.Errorf("expected the connection to be closed right away got %q %v", b, err)
+	}
+}
+
+func TestNetworkConditionsValidate(t *testing.T) {
+	if err := (NetworkConditions{DropPercent: 60, ResetPercent: 50}).validate(); err == nil {
+		t.Error("expected more than 100% of failing connections to be invalid")
+	}
+	if err := (NetworkConditions{LatencyMs: -1}).validate(); err == nil {
+		t.Error("expected a negative latency to be invalid")
+	}
+}
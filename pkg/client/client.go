@@ -7,27 +7,27 @@ import (
 	"github.com/phayes/freeport"
 	"github.com/wailsapp/wails"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
-	"k8s.io/client-go/tools/portforward"
-	"k8s.io/client-go/transport/spdy"
-	"net/http"
-	"net/url"
+	"net"
 	"os"
 	"path/filepath"
+	"portfall/pkg/dns"
 	"portfall/pkg/favicon"
 	"portfall/pkg/logger"
-	"strings"
+	"portfall/pkg/sniff"
 	"sync"
 	"time"
 )
 
 // Client is the core struct of Portfall - references k8s client and config and tracks active websites and namespaces
 type Client struct {
-	s                *kubernetes.Clientset
+	s                kubernetes.Interface
 	conf             *rest.Config
 	rawConf          *api.Config
 	configPath       string
@@ -35,13 +35,45 @@ type Client struct {
 	websites         []*Website
 	activeNamespaces []string
 	log              *logger.CustomLogger
+	// mu guards websites and their fields, which the dns responder and the bindings access concurrently
+	mu sync.RWMutex
+	// lazyForwarding only opens the tunnel to a pod once a website is actually used
+	lazyForwarding bool
+	idleTimeout    time.Duration
+	settings       *settings
+	// bastion is the SSH jump host the current context is reached through, if any
+	bastion *sshBastion
+	// forwardConf is the config used for forwarding, which differs from conf when a bastion is used
+	forwardConf *rest.Config
+	// loopbacks are the loopback addresses of services forwarded on their real ports
+	loopbacks loopbackAllocator
+	// dns answers the names of forwarded services when enabled
+	dns *dns.Server
+	// proxy is the SOCKS5 and HTTP proxy into the cluster when enabled
+	proxy *clusterProxy
+	// reverseTunnels expose local ports in the cluster, keyed by namespace/name of their service
+	reverseTunnels map[string]*reverseTunnel
+	// ca issues the certificates of https front ports, it is loaded on first use
+	ca     *localCA
+	caOnce sync.Once
+	caErr  error
+	// dyn is the client for the Gateway API, built from conf when nil
+	dyn dynamic.Interface
 }
 
+// defaultIdleTimeout is how long a lazy forward stays open without any connections
+const defaultIdleTimeout = 5 * time.Minute
+
+// sniffTimeout is how long each attempt of sniffing the protocol of a port without a website waits for an answer
+const sniffTimeout = time.Second
+
 // Handles ongoing port-forwards for websites
 type portForwardPodRequest struct {
 	RestConfig *rest.Config
 	// Pod is the selected pod for this port forwarding
 	Pod v1.Pod
+	// LocalAddress is the loopback address the LocalPort is bound on, both 127.0.0.1 and ::1 if empty
+	LocalAddress string
 	// LocalPort is the local port that will be selected to expose the PodPort
 	LocalPort int32
 	// PodPort is the target port for the pod
@@ -50,6 +82,28 @@ type portForwardPodRequest struct {
 	StopCh chan struct{}
 	// ReadyCh communicates when the tunnel is ready to receive traffic
 	ReadyCh chan struct{}
+	// Stats counts the traffic going through the local listener
+	Stats *trafficStats
+	// Tunnel is the connection to the pod, shared by all of its forwarded ports
+	Tunnel *podTunnel
+	// ServiceName and ServicePort are set when the port was discovered through a service
+	ServiceName string
+	ServicePort int32
+	// ServiceAliases are the other services of the pod targeting the same port, which are served by this forward
+	ServiceAliases []string
+	// Kubectl is the supervised kubectl process forwarding the pod when using the kubectl backend
+	Kubectl *kubectlForwarder
+	// Balancer spreads the connections across all endpoints of the service in service mode
+	Balancer *serviceBalancer
+	// Chaos simulates bad network conditions on the local connections
+	Chaos *networkChaos
+	// ExternalURL is the url of the Ingress or HTTPRoute publishing the service port, if any
+	ExternalURL string
+	Route       string
+	// Source is the custom resource the port was discovered through, if any
+	Source string
+	// PortSource is where the port came from, see websiteCandidate
+	PortSource string
 }
 
 // Website is the internal representation of a Website
@@ -57,98 +111,238 @@ type Website struct {
 	isForwarded    bool
 	portForwardReq portForwardPodRequest
 	icon           favicon.Icon
+	// share exposes the website beyond loopback
+	share *websiteShare
+	// https serves the website over https in front of its local port
+	https *httpsFront
+	// proxy applies the website's rules in front of its local port
+	proxy *websiteProxy
+	// inspector records the http exchanges going through the proxy once inspection was enabled
+	inspector *httpInspector
 	// public
-	LocalPort     int32  `json:"localPort"`
-	PodPort       int32  `json:"podPort"`
-	Title         string `json:"title"`
-	IconUrl       string `json:"iconUrl"`
-	IconRemoteUrl string `json:"iconRemoteUrl"`
-	Namespace     string `json:"namespace"`
-	PodName       string `json:"podName"`
+	// Kind is forward for websites served on a local port and direct for services reachable without a forward
+	Kind          string   `json:"kind"`
+	LocalPort     int32    `json:"localPort"`
+	LocalAddress  string   `json:"localAddress"`
+	Hostnames     []string `json:"hostnames"`
+	PodPort       int32    `json:"podPort"`
+	Title         string   `json:"title"`
+	IconUrl       string   `json:"iconUrl"`
+	IconRemoteUrl string   `json:"iconRemoteUrl"`
+	Namespace     string   `json:"namespace"`
+	PodName       string   `json:"podName"`
+	State         string   `json:"state"`
+	Backend       string   `json:"backend"`
+	SharedUrl     string   `json:"sharedUrl"`
+	HttpsUrl      string   `json:"httpsUrl"`
+	ProxyUrl      string   `json:"proxyUrl"`
+	Inspecting    bool     `json:"inspecting"`
+	// ExternalUrl is the url the website is published at by its Route, an Ingress or HTTPRoute
+	ExternalUrl string `json:"externalUrl"`
+	Route       string `json:"route"`
+	// Conditions are the simulated network conditions, if any
+	Conditions *NetworkConditions `json:"conditions,omitempty"`
+	// Source is the custom resource the website was discovered through, e.g. Rollout/checkout
+	Source string `json:"source,omitempty"`
+	// PortSource is where the port came from, e.g. service, containerPort, readinessProbe, prometheus or env PORT
+	PortSource string `json:"portSource,omitempty"`
+	// Protocol is what the port speaks, http for websites or one of the protocols of the sniff package
+	Protocol string `json:"protocol"`
+	// DirectUrl is the NodePort, load balancer or external name url of direct websites and Reachable whether it
+	// answered the probe
+	DirectUrl string `json:"directUrl,omitempty"`
+	Reachable bool   `json:"reachable"`
 }
 
-// PortForwardAPdd takes a portForwardPodRequest and creates the port forward to the given pod
-// usage based on https://github.com/gianarb/kube-port-forward
+// PortForwardAPdd takes a portForwardPodRequest and creates the port forward to the given pod. Portfall owns the local
+// listener so that the traffic of every connection can be counted in req.Stats and all ports of a pod can share
+// req.Tunnel
 func portForwardAPod(req portForwardPodRequest) error {
-	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward",
-		req.Pod.Namespace, req.Pod.Name)
-	hostIP := strings.TrimLeft(req.RestConfig.Host, "htps:/")
+	return forwardThroughTunnel(req)
+}
 
-	transport, upgrader, err := spdy.RoundTripperFor(req.RestConfig)
-	if err != nil {
-		return err
+// newForwardRequest prepares the request for forwarding the candidate port of the pod to a free local port. With a
+// loopback address per service, service ports keep their real port on the service's own loopback address instead.
+func (c *Client) newForwardRequest(pod v1.Pod, cand websiteCandidate) (portForwardPodRequest, error) {
+	req := portForwardPodRequest{
+		RestConfig: c.forwardConf,
+		Pod:        pod,
+		PodPort:    cand.port,
+		// stopCh control the port forwarding lifecycle. When it gets closed the
+		// port forward will terminate
+		StopCh: make(chan struct{}, 1),
+		// readyCh communicate when the port forward is ready to get traffic
+		ReadyCh:     make(chan struct{}),
+		Stats:       &trafficStats{},
+		Chaos:       &networkChaos{},
+		ExternalURL: cand.externalURL,
+		Route:       cand.route,
+		Source:      cand.source,
+		PortSource:  cand.portSource,
 	}
-
-	dialer := spdy.NewDialer(
-		upgrader,
-		&http.Client{Transport: transport},
-		http.MethodPost,
-		&url.URL{Scheme: "https", Path: path, Host: hostIP})
-
-	fw, err := portforward.New(
-		dialer,
-		[]string{fmt.Sprintf("%d:%d", req.LocalPort, req.PodPort)},
-		req.StopCh,
-		req.ReadyCh,
-		os.Stdout,
-		os.Stderr)
-
-	if err != nil {
-		return err
+	if cand.resourceType == "service" {
+		req.ServiceName = cand.resourceName
+		req.ServicePort = cand.servicePort
+		req.ServiceAliases = cand.aliases
+		if c.settings.LoopbackPerService {
+			c.useServiceLoopback(&req)
+		}
 	}
-	return fw.ForwardPorts()
+	if req.LocalAddress == "" {
+		localPort, err := freeport.GetFreePort()
+		if err != nil {
+			return portForwardPodRequest{}, err
+		}
+		req.LocalPort = int32(localPort)
+	}
+	return req, nil
 }
 
-func (c *Client) getWebsiteForPort(pod v1.Pod, containerPort int32) (*Website, error) {
-	localPort, err := freeport.GetFreePort()
+// useServiceLoopback binds the request to the service's loopback address and port, keeping a random local port if
+// that port can't be bound, e.g. because it is privileged or the address isn't configured on the loopback interface
+func (c *Client) useServiceLoopback(req *portForwardPodRequest) {
+	addr, err := c.loopbacks.allocate(req.Pod.Namespace, req.ServiceName)
 	if err != nil {
-		return nil, err
+		c.log.Warnf("%v", err)
+		return
 	}
-	// stopCh control the port forwarding lifecycle. When it gets closed the
-	// port forward will terminate
-	stopCh := make(chan struct{}, 1)
-	// readyCh communicate when the port forward is ready to get traffic
-	readyCh := make(chan struct{})
-	portForwardReq := portForwardPodRequest{
-		RestConfig: c.conf,
-		Pod:        pod,
-		LocalPort:  int32(localPort),
-		PodPort:    containerPort,
-		StopCh:     stopCh,
-		ReadyCh:    readyCh,
+	if err := portAvailable(addr, req.ServicePort); err != nil {
+		c.log.Warnf("can't bind port %d of service %s on %s, using a random port instead: %v", req.ServicePort, req.ServiceName, addr, err)
+		return
+	}
+	req.LocalAddress = addr
+	req.LocalPort = req.ServicePort
+}
+
+// localURL returns the url the request's local port is reachable at
+func (req portForwardPodRequest) localURL() string {
+	return fmt.Sprintf("http://%s", req.localHostPort())
+}
+
+// localHostPort returns the host:port the request's local port is reachable at
+func (req portForwardPodRequest) localHostPort() string {
+	host := "localhost"
+	if req.LocalAddress != "" {
+		host = req.LocalAddress
 	}
+	return net.JoinHostPort(host, fmt.Sprint(req.LocalPort))
+}
+
+// startWebsite runs forward for the request in the background using the given backend and returns the resulting
+// Website once it is ready and its favicon could be found, or the protocol it speaks could be sniffed otherwise
+func (c *Client) startWebsite(req portForwardPodRequest, backend string, forward func(portForwardPodRequest) error) (*Website, error) {
+	errCh := make(chan error, 1)
 	go func() {
-		err := portForwardAPod(portForwardReq)
+		err := forward(req)
 		if err != nil {
 			c.log.Debugf("%v", err)
 		}
+		errCh <- err
 	}()
 
 	select {
-	case <-readyCh:
+	case <-req.ReadyCh:
 		break
+	case err := <-errCh:
+		return nil, err
 	case <-time.After(10 * time.Second):
-		close(stopCh)
+		close(req.StopCh)
 		//close(readyCh)
-		return nil, fmt.Errorf("timed out of portforward for pod %s on port %d after 10 seconds", pod.Name, portForwardReq.PodPort)
+		return nil, fmt.Errorf("timed out of %s for pod %s on port %d after 10 seconds", backend, req.Pod.Name, req.PodPort)
 	}
 	website := Website{
 		isForwarded:    true,
-		LocalPort:      int32(localPort),
-		PodPort:        containerPort,
-		portForwardReq: portForwardReq,
+		Kind:           kindForward,
+		LocalPort:      req.LocalPort,
+		LocalAddress:   req.LocalAddress,
+		PodPort:        req.PodPort,
+		portForwardReq: req,
+		Backend:        backend,
+		Source:         req.Source,
+		PortSource:     req.PortSource,
+	}
+	if req.LocalAddress != "" {
+		for _, service := range req.serviceNames() {
+			website.Hostnames = append(website.Hostnames, serviceHostnames(service, req.Pod.Namespace)...)
+		}
+	}
+
+	if req.ExternalURL != "" {
+		website.ExternalUrl = req.ExternalURL
+		website.Route = req.Route
 	}
 
-	// get the favicon
-	bestIcon, err := favicon.GetBest(fmt.Sprintf("http://localhost:%d", localPort))
+	// get the favicon, through the route if the forward doesn't serve the app the way its route does
+	bestIcon, err := favicon.GetBest(req.localURL())
+	if err != nil && req.ExternalURL != "" {
+		bestIcon, err = favicon.GetBest(req.ExternalURL)
+	}
+	website.Protocol = sniff.HTTP
 	if err != nil {
-		close(stopCh)
-		return nil, err
+		// not a website, but maybe a database or another known service
+		protocol, sniffErr := sniff.Sniff(req.localHostPort(), sniffTimeout)
+		if sniffErr != nil {
+			close(req.StopCh)
+			return nil, err
+		}
+		c.log.Infof("port %d of pod %s speaks %s", req.PodPort, req.Pod.Name, protocol)
+		website.Protocol = protocol
+		bestIcon = &favicon.Icon{RemoteUrl: sniff.Icon(protocol)}
 	}
 	website.icon = *bestIcon
+	// the favicon lookup should not count as usage, so its keep-alive connections are closed before the reset
+	favicon.CloseIdleConnections()
+	req.Stats.waitForIdle(time.Second)
+	req.Stats.resetTotals()
 	return &website, nil
 }
 
+func (c *Client) getWebsiteForPort(pod v1.Pod, cand websiteCandidate, tunnel *podTunnel) (*Website, error) {
+	req, err := c.newForwardRequest(pod, cand)
+	if err != nil {
+		return nil, err
+	}
+	req.Tunnel = tunnel
+	return c.startWebsite(req, backendPortForward, portForwardAPod)
+}
+
+func (c *Client) getWebsiteForKubectl(pod v1.Pod, cand websiteCandidate, kubectl *kubectlForwarder) (*Website, error) {
+	req, err := c.newForwardRequest(pod, cand)
+	if err != nil {
+		return nil, err
+	}
+	req.Kubectl = kubectl
+	return c.startWebsite(req, backendKubectl, kubectlForwardAPod)
+}
+
+func (c *Client) getWebsiteForService(pod v1.Pod, cand websiteCandidate) (*Website, error) {
+	req, err := c.newForwardRequest(pod, cand)
+	if err != nil {
+		return nil, err
+	}
+	req.Balancer, err = c.newServiceBalancer(pod.Namespace, cand.resourceName, cand.servicePort, c.settings.ServiceMode, c.settings.StickySessions)
+	if err != nil {
+		return nil, err
+	}
+	return c.startWebsite(req, backendService, balanceAService)
+}
+
+func (c *Client) getWebsiteForServiceProxy(pod v1.Pod, cand websiteCandidate) (*Website, error) {
+	req, err := c.newForwardRequest(pod, cand)
+	if err != nil {
+		return nil, err
+	}
+	return c.startWebsite(req, backendServiceProxy, proxyAService)
+}
+
+// state returns whether the tunnel behind the website is currently open
+func (w *Website) state() string {
+	if w.portForwardReq.Tunnel == nil {
+		return tunnelActive
+	}
+	return w.portForwardReq.Tunnel.state()
+}
+
 // ListNamespaces returns a list of the names of available namespaces in the current cluster
 func (c *Client) ListNamespaces() (nsList []string) {
 	namespaces, err := c.s.CoreV1().Namespaces().List(metav1.ListOptions{})
@@ -169,6 +363,7 @@ func (c *Client) ListNamespaces() (nsList []string) {
 func (c *Client) RemoveWebsitesInNamespace(namespace string) {
 	var newWebsites []*Website
 	var newNamespaces []string
+	c.mu.Lock()
 websiteLoop:
 	for _, website := range c.websites {
 		if website.portForwardReq.Pod.Namespace == namespace {
@@ -192,62 +387,184 @@ websiteLoop:
 			newNamespaces = append(newNamespaces, ns)
 		}
 	}
-	c.activeNamespaces = newNamespaces
 	c.websites = newWebsites
+	c.mu.Unlock()
+	c.activeNamespaces = newNamespaces
+	c.syncHostsFile()
+}
+
+// websiteCandidate is a port of a pod which might be serving a website
+type websiteCandidate struct {
+	port         int32
+	resourceName string
+	resourceType string
+	// servicePort is the port of the service the candidate was discovered through
+	servicePort int32
+	// route and externalURL are set when an Ingress or HTTPRoute publishes the service port
+	route       string
+	externalURL string
+	// source is the custom resource the candidate was discovered through, e.g. Rollout/checkout
+	source string
+	// portSource is where the port came from, e.g. service, containerPort or readinessProbe
+	portSource string
+	// aliases are the other services targeting the same port of the pod, which are served by this candidate
+	aliases []string
+}
+
+// handleWebsitesAddingForPod forwards all candidate ports of the pod over a single shared tunnel and queues the
+// resulting websites once every port has been checked. If port-forwarding is forbidden, ports of services are served
+// through the API server's service proxy instead.
+func (c *Client) handleWebsitesAddingForPod(pod v1.Pod, candidates []websiteCandidate, portForwardAllowed bool, queue chan *Website) {
+	if c.forwardingBackend() == backendKubectl {
+		c.handleWebsitesAddingForPodWithKubectl(pod, candidates, queue)
+		return
+	}
+	var idleTimeout time.Duration
+	if c.lazyForwarding {
+		idleTimeout = c.idleTimeout
+	}
+	tunnel := newPodTunnel(c.forwardConf, pod, c.settings.forContext(c.currentContext).Transport, idleTimeout)
+	websites := make([]*Website, len(candidates))
+	var wg sync.WaitGroup
+	for i, cand := range candidates {
+		wg.Add(1)
+		go func(i int, cand websiteCandidate) {
+			defer wg.Done()
+			var ws *Website
+			var err error
+			if portForwardAllowed && cand.resourceType == "service" && c.settings.ServiceMode != "" {
+				ws, err = c.getWebsiteForService(pod, cand)
+			} else if portForwardAllowed {
+				ws, err = c.getWebsiteForPort(pod, cand, tunnel)
+			}
+			forbidden := !portForwardAllowed || apierrors.IsForbidden(err)
+			if forbidden && cand.resourceType == "service" {
+				c.log.Infof("port-forward to pod %s is forbidden, using the service proxy for %s", pod.Name, cand.resourceName)
+				ws, err = c.getWebsiteForServiceProxy(pod, cand)
+			} else if !portForwardAllowed {
+				err = fmt.Errorf("port-forward to pod %s is forbidden and port %d is not exposed by a service", pod.Name, cand.port)
+			}
+			if err != nil {
+				c.log.Warnf("Failed to get icons for pod %s in %s %s on port %d", pod.Name, cand.resourceName, cand.resourceType, cand.port)
+				c.log.Errorf("%v", err)
+				ws = &Website{}
+			}
+			websites[i] = ws
+		}(i, cand)
+	}
+	wg.Wait()
+	if idleTimeout != 0 {
+		// discovery should not keep lazy tunnels open
+		tunnel.close()
+	}
+	for _, ws := range websites {
+		queue <- ws
+	}
 }
 
-func (c *Client) handleWebsiteAdding(p v1.Pod, tp int32, resourceName string, resourceType string, queue chan *Website) {
-	ws, err := c.getWebsiteForPort(p, tp)
+// handleWebsitesAddingForPodWithKubectl forwards all candidate ports of the pod through a single kubectl port-forward
+// process and queues the resulting websites once every port has been checked
+func (c *Client) handleWebsitesAddingForPodWithKubectl(pod v1.Pod, candidates []websiteCandidate, queue chan *Website) {
+	ports := make([]int32, len(candidates))
+	for i, cand := range candidates {
+		ports[i] = cand.port
+	}
+	kubectl, err := startKubectlForwarder(c.settings.KubectlPath, c.configPath, c.currentContext, pod, ports)
 	if err != nil {
-		c.log.Warnf("Failed to get icons for pod %s in %s %s on port %d", p.Name, resourceName, resourceType, tp)
+		c.log.Warnf("Failed to run kubectl port-forward for pod %s", pod.Name)
 		c.log.Errorf("%v", err)
-		queue <- &Website{}
-	} else {
+		for range candidates {
+			queue <- &Website{}
+		}
+		return
+	}
+	websites := make([]*Website, len(candidates))
+	var wg sync.WaitGroup
+	for i, cand := range candidates {
+		wg.Add(1)
+		go func(i int, cand websiteCandidate) {
+			defer wg.Done()
+			ws, err := c.getWebsiteForKubectl(pod, cand, kubectl)
+			if err != nil {
+				c.log.Warnf("Failed to get icons for pod %s in %s %s on port %d", pod.Name, cand.resourceName, cand.resourceType, cand.port)
+				c.log.Errorf("%v", err)
+				ws = &Website{}
+			}
+			websites[i] = ws
+		}(i, cand)
+	}
+	wg.Wait()
+	for _, ws := range websites {
 		queue <- ws
 	}
 }
 
-func (c *Client) handleServicesInPod(services *v1.ServiceList, pod v1.Pod, wg *sync.WaitGroup, queue chan *Website) (handledPorts []int32) {
+func (c *Client) handleServicesInPod(services *v1.ServiceList, pod v1.Pod) (candidates []websiteCandidate) {
 	for _, svc := range services.Items {
-		matchCount := 0
-		for k, v := range svc.Spec.Selector {
-			if pod.Labels[k] == v {
-				matchCount++
-			}
-		}
-		if matchCount == len(svc.Spec.Selector) {
+		if serviceSelectsPod(svc, pod) {
 		portIter:
 			for _, port := range svc.Spec.Ports {
-				for _, p := range handledPorts {
-					if p == port.TargetPort.IntVal {
-						// this port has already been handled by another service so we are safe to skip it
-						c.log.Infof("skipped port %d for service %s as it has already been handled", p, svc.Name)
-						
+				for i, cand := range candidates {
+					if cand.port == port.TargetPort.IntVal {
+						// this port has already been handled by another service so we are safe to skip it, the
+						// service is still known by its own name
+						c.log.Infof("skipped port %d for service %s as it has already been handled", cand.port, svc.Name)
+						known := cand.resourceName == svc.Name
+						for _, alias := range cand.aliases {
+							known = known || alias == svc.Name
+						}
+						if !known {
+							candidates[i].aliases = append(cand.aliases, svc.Name)
+						}
 						continue portIter
 					}
 				}
-				handledPorts = append(handledPorts, port.TargetPort.IntVal)
-				wg.Add(1)
-				go c.handleWebsiteAdding(pod, port.TargetPort.IntVal, svc.Name, "service", queue)
+				candidates = append(candidates, websiteCandidate{port: port.TargetPort.IntVal, resourceName: svc.Name, resourceType: "service", servicePort: port.Port, portSource: portSourceService})
 			}
 		}
 	}
-	return handledPorts
+	return candidates
 }
 
-func (c *Client) handleContainerPortsInPod(pod v1.Pod, handledPorts []int32, wg *sync.WaitGroup, queue chan *Website) {
+func (c *Client) handleContainerPortsInPod(pod v1.Pod, candidates []websiteCandidate) []websiteCandidate {
 	for _, container := range pod.Spec.Containers {
 	cpLoop:
 		for _, port := range container.Ports {
-			for _, hp := range handledPorts {
-				if port.ContainerPort == hp {
+			for _, cand := range candidates {
+				if port.ContainerPort == cand.port {
 					continue cpLoop
 				}
 			}
-			wg.Add(1)
-			go c.handleWebsiteAdding(pod, port.ContainerPort, container.Name, "container", queue)
+			candidates = append(candidates, websiteCandidate{port: port.ContainerPort, resourceName: container.Name, resourceType: "container", portSource: portSourceContainerPort})
 		}
 	}
+	// ports which aren't declared, the first source a port is inferred from is kept
+ipLoop:
+	for _, port := range inferPorts(pod) {
+		for _, cand := range candidates {
+			if port.port == cand.port {
+				continue ipLoop
+			}
+		}
+		candidates = append(candidates, websiteCandidate{port: port.port, resourceName: port.container, resourceType: "container", portSource: port.source})
+	}
+	return candidates
+}
+
+// skipHandledServices drops the candidates of services which are already in handled and adds the remaining ones
+func skipHandledServices(candidates []websiteCandidate, namespace string, handled map[string]bool) []websiteCandidate {
+	var remaining []websiteCandidate
+	for _, cand := range candidates {
+		if cand.resourceType == "service" {
+			key := fmt.Sprintf("%s/%s:%d", namespace, cand.resourceName, cand.servicePort)
+			if handled[key] {
+				continue
+			}
+			handled[key] = true
+		}
+		remaining = append(remaining, cand)
+	}
+	return remaining
 }
 
 func (c *Client) forwardAndGetIconsForWebsitesInNamespace(namespace string) ([]*Website, error) {
@@ -266,43 +583,39 @@ func (c *Client) forwardAndGetIconsForWebsitesInNamespace(namespace string) ([]*
 		c.log.Warnf("Failed to get services in ns %s", namespace)
 		return nil, err
 	}
+	scope := &discoveryScope{
+		c:          c,
+		namespace:  namespace,
+		internalNS: internalNS,
+		pods:       pods,
+		services:   services,
+		routes:     c.discoverRoutes(internalNS),
+	}
 
-	var handledReplicationControllers []string
+	claims := newCandidateClaims()
+	portForwardAllowed := map[string]bool{}
 	var wg sync.WaitGroup
 	queue := make(chan *Website, 1)
-podLoop:
-	for _, pod := range pods.Items {
-		// skip pods in already active namespaces
-		if namespace == "All Namespaces" {
-			for _, n := range c.activeNamespaces {
-				if n != namespace && n == pod.Namespace {
-					continue podLoop
-				}
-			}
-		}
-		// skip not running pods
-		if pod.Status.Phase != "Running" {
-			continue podLoop
-		}
-		// has been scheduled from deletion
-		if pod.DeletionTimestamp != nil {
-			continue podLoop
+	for _, source := range c.discoverySources() {
+		found, err := source.Discover(scope)
+		if err != nil {
+			c.log.Infof("not discovering websites of source %s: %v", source.Name(), err)
+			continue
 		}
-		// handle replication controllers we only need one pod from each replica
-		for _, owner := range pod.OwnerReferences {
-			if owner.Kind == "StatefulSet" || owner.Kind == "ReplicaSet" || owner.Kind == "DaemonSet" {
-				for _, rc := range handledReplicationControllers {
-					if rc == owner.Name {
-						continue podLoop
-					}
-				}
-				handledReplicationControllers = append(handledReplicationControllers, owner.Name)
+		for _, pc := range found {
+			candidates := claims.claim(pc)
+			if len(candidates) == 0 {
+				continue
+			}
+			wg.Add(len(candidates))
+			allowed, ok := portForwardAllowed[pc.pod.Namespace]
+			if !ok {
+				allowed = c.portForwardAllowed(pc.pod.Namespace)
+				portForwardAllowed[pc.pod.Namespace] = allowed
 			}
+			go c.handleWebsitesAddingForPod(pc.pod, candidates, allowed, queue)
 		}
-		// services
-		handledPorts := c.handleServicesInPod(services, pod, &wg, queue)
-		// container ports
-		c.handleContainerPortsInPod(pod, handledPorts, &wg, queue)
+		claims.sourceDone()
 	}
 	go func() {
 		for w := range queue {
@@ -314,20 +627,36 @@ podLoop:
 		}
 	}()
 
+	var directServices []v1.Service
+	for _, svc := range services.Items {
+		// skip services in already active namespaces
+		if !scope.skipped(svc.Namespace) {
+			directServices = append(directServices, svc)
+		}
+	}
+	directWebsites := c.directWebsitesInServices(directServices)
+
 	c.log.Infof("waiting for all potential websites to be processed")
 	wg.Wait()
+	nsWebsites = append(nsWebsites, directWebsites...)
+	// routes of services which couldn't be forwarded are still reachable on their url
+	nsWebsites = append(nsWebsites, directWebsitesOfRoutes(scope.unclaimedRoutes(nsWebsites))...)
 	c.log.Infof("%d websites processed", len(nsWebsites))
 	return nsWebsites, nil
 }
 
-func (c *Client) addDerivedDetailsToWebsites() {
-	for _, website := range c.websites {
+func addDerivedDetailsToWebsites(websites []*Website) {
+	for _, website := range websites {
 		if website.Title == "" {
 			website.Title = website.icon.PageTitle
 			if website.Title == "" {
 				website.Title = website.portForwardReq.Pod.Name
 			}
 			website.IconUrl = fmt.Sprintf("file://%s", website.icon.FilePath)
+			if website.icon.FilePath == "" {
+				// built-in icons of sniffed protocols aren't downloaded
+				website.IconUrl = website.icon.RemoteUrl
+			}
 			website.IconRemoteUrl = website.icon.RemoteUrl
 			website.PodName = website.portForwardReq.Pod.Name
 			website.Namespace = website.portForwardReq.Pod.Namespace
@@ -335,6 +664,37 @@ func (c *Client) addDerivedDetailsToWebsites() {
 	}
 }
 
+// httpWebsites drops the websites speaking another protocol than http, which the https front, the http share gate
+// and the rules proxy can't serve
+func httpWebsites(websites []*Website) []*Website {
+	var web []*Website
+	for _, w := range websites {
+		if w.Protocol == sniff.HTTP {
+			web = append(web, w)
+		}
+	}
+	return web
+}
+
+// errNotHTTP is the reason an http front can't serve a website speaking another protocol
+func errNotHTTP(w *Website) error {
+	return fmt.Errorf("website on port %d speaks %s, not http", w.LocalPort, w.Protocol)
+}
+
+// addWebsites adds new websites, applying the settings for websites forwarded from now on to them. The websites are
+// only added once they are set up, so nothing else accesses them before.
+func (c *Client) addWebsites(websites []*Website) {
+	addDerivedDetailsToWebsites(websites)
+	forwarded := forwardedWebsites(websites)
+	c.shareNewWebsites(forwarded)
+	c.serveNewWebsitesOverHTTPS(httpWebsites(forwarded))
+	c.proxyNewWebsites(httpWebsites(forwarded))
+	c.mu.Lock()
+	c.websites = append(c.websites, websites...)
+	c.mu.Unlock()
+	c.syncHostsFile()
+}
+
 // GetWebsitesInNamespace takes a namespace's name and ensures that all websites in that namespace are port-forwarded.
 // If the namespaces in the Website are not port-forwarded then forwardAndGetIconsForWebsitesInNamespace is called.
 // Finally a json response of a list of Websites for the namespace specified is returned.
@@ -357,22 +717,113 @@ func (c *Client) GetWebsitesInNamespace(namespace string) string {
 			return ""
 		}
 		c.log.Infof("Got %d websites forwarded in ns %s", len(nsWebsites), namespace)
-		c.websites = append(c.websites, nsWebsites...)
-		c.addDerivedDetailsToWebsites()
+		c.addWebsites(nsWebsites)
 	} else {
 		c.log.Infof("skipping get websites for namespace %s as already in active namespaces %v", namespace, c.activeNamespaces)
+		c.mu.RLock()
 		for _, w := range c.websites {
 			if w.portForwardReq.Pod.Namespace == namespace {
 				nsWebsites = append(nsWebsites, w)
 			}
 		}
+		c.mu.RUnlock()
 	}
 	c.activeNamespaces = append(c.activeNamespaces, namespace)
 
+	c.mu.Lock()
+	for _, w := range nsWebsites {
+		w.State = w.state()
+	}
 	jBytes, _ := json.Marshal(nsWebsites)
+	c.mu.Unlock()
 	return string(jBytes)
 }
 
+// SetLazyForwarding toggles lazy forwarding for websites forwarded from now on. Lazy websites keep their local port
+// but only open the tunnel to the pod when a connection arrives, closing it after idleSeconds without connections.
+// Fetching the favicons when a namespace is loaded still opens each tunnel once, it is closed again right after.
+func (c *Client) SetLazyForwarding(enabled bool, idleSeconds int) {
+	c.lazyForwarding = enabled
+	c.idleTimeout = defaultIdleTimeout
+	if idleSeconds > 0 {
+		c.idleTimeout = time.Duration(idleSeconds) * time.Second
+	}
+	c.log.Infof("lazy forwarding set to %t with an idle timeout of %v", c.lazyForwarding, c.idleTimeout)
+}
+
+// GetContextTransport returns the port-forward transport configured for the given context
+func (c *Client) GetContextTransport(context string) string {
+	if t := c.settings.forContext(context).Transport; t != "" {
+		return t
+	}
+	return transportAuto
+}
+
+// SetContextTransport sets the port-forward transport (spdy, websocket or auto) used for the given context and
+// persists it. The transport used is returned, which is the previous one if the given transport is unknown.
+func (c *Client) SetContextTransport(context string, transport string) string {
+	switch transport {
+	case transportSPDY, transportWebSocket, transportAuto:
+	default:
+		c.log.Warnf("unknown port-forward transport %s", transport)
+		return c.GetContextTransport(context)
+	}
+	c.settings.forContext(context).Transport = transport
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	return transport
+}
+
+// GetContextBackend returns the forwarding backend configured for the given context
+func (c *Client) GetContextBackend(context string) string {
+	if b := c.settings.forContext(context).Backend; b != "" {
+		return b
+	}
+	return backendPortForward
+}
+
+// forwardingBackend returns the backend the current context is forwarded with. kubectl port-forward can't reach the
+// cluster through a bastion, so contexts with a bastion are always forwarded in-process.
+func (c *Client) forwardingBackend() string {
+	backend := c.GetContextBackend(c.currentContext)
+	if backend == backendKubectl && c.bastion != nil {
+		return backendPortForward
+	}
+	return backend
+}
+
+// SetContextBackend chooses between forwarding in-process (portforward) and through kubectl port-forward (kubectl)
+// for the given context and persists it. The backend used is returned, which is the previous one if the given backend
+// is unknown or kubectl is chosen for a context with a bastion.
+func (c *Client) SetContextBackend(context string, backend string) string {
+	switch backend {
+	case backendPortForward:
+		c.settings.forContext(context).Backend = ""
+	case backendKubectl:
+		if c.settings.forContext(context).Bastion != nil {
+			c.log.Warnf("kubectl port-forward can't use the bastion of context %s, forwarding in-process instead", context)
+			return c.GetContextBackend(context)
+		}
+		c.settings.forContext(context).Backend = backend
+	default:
+		c.log.Warnf("unknown forwarding backend %s", backend)
+		return c.GetContextBackend(context)
+	}
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	return backend
+}
+
+// SetKubectlPath sets the kubectl binary used by the kubectl backend
+func (c *Client) SetKubectlPath(kubectlPath string) {
+	c.settings.KubectlPath = kubectlPath
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+}
+
 // getDefaultClientSetAndConfig is an initialization method to get the default kubernetes config and initialize
 // the Clientset
 func getDefaultClientSetAndConfig() (*kubernetes.Clientset, *rest.Config, *api.Config, string, error) {
@@ -448,36 +899,136 @@ func (c *Client) SetConfigPath(configPath string, context string) []string {
 		}
 	}
 
-	clientConf := clientcmd.NewNonInteractiveClientConfig(*rawConfig, useContext, &clientcmd.ConfigOverrides{},
+	if err := c.useConfig(configPath, rawConfig, useContext); err != nil {
+		c.log.Debugf("%v", err)
+		return []string{c.configPath, c.currentContext}
+	}
+	return []string{configPath, useContext}
+}
+
+// useConfig builds the clientset for the context of rawConfig, routing it through the context's bastion if one is
+// configured, and switches the Client over to it closing all forwards of the previous context
+func (c *Client) useConfig(configPath string, rawConfig *api.Config, context string) error {
+	clientConf := clientcmd.NewNonInteractiveClientConfig(*rawConfig, context, &clientcmd.ConfigOverrides{},
 		clientcmd.NewDefaultClientConfigLoadingRules())
 	restConf, err := clientConf.ClientConfig()
 
 	if err != nil {
 		c.log.Infof("error building restConf from path %s", configPath)
-		c.log.Debugf("%v", err)
-		return []string{c.configPath, c.currentContext}
+		return err
+	}
+	bastion, forwardConf, err := c.routeThroughBastion(context, restConf)
+	if err != nil {
+		c.log.Infof("error setting up the bastion for context %s", context)
+		return err
 	}
 	clientSet, err := kubernetes.NewForConfig(restConf)
 	if err != nil {
 		c.log.Infof("error building clientset from restConf at %s", configPath)
-		return []string{c.configPath, c.currentContext}
+		if bastion != nil {
+			bastion.Close()
+		}
+		return err
 	}
 
-	// close forwards in the old context
+	// close forwards and remove reverse tunnels in the old context
 	c.closeAllPortForwards()
+	c.syncHostsFile()
+	c.removeAllReverseTunnels()
+	if c.proxy != nil {
+		c.proxy.closeTunnels()
+	}
+	if c.bastion != nil {
+		c.bastion.Close()
+	}
 	c.rawConf = rawConfig
-	c.currentContext = useContext
+	c.currentContext = context
 	c.s = clientSet
 	c.configPath = configPath
 	c.conf = restConf
-	return []string{configPath, useContext}
+	c.forwardConf = forwardConf
+	c.bastion = bastion
+	return nil
+}
+
+// routeThroughBastion sets up the SSH bastion configured for the context if there is one and routes conf through it.
+// The bastion is returned together with the config port-forwards should use.
+func (c *Client) routeThroughBastion(context string, conf *rest.Config) (*sshBastion, *rest.Config, error) {
+	bs := c.settings.forContext(context).Bastion
+	if bs == nil {
+		return nil, conf, nil
+	}
+	bastion, err := newSSHBastion(*bs)
+	if err != nil {
+		return nil, nil, err
+	}
+	bastion.routeConfig(conf)
+	forwardConf, err := bastion.relayedConfig(conf)
+	if err != nil {
+		bastion.Close()
+		return nil, nil, err
+	}
+	c.log.Infof("routing context %s through bastion %s", context, bastion.addr)
+	if c.settings.forContext(context).Backend == backendKubectl {
+		c.log.Warnf("kubectl port-forward can't use the bastion of context %s, forwarding in-process instead", context)
+	}
+	return bastion, forwardConf, nil
 }
 
+// GetContextBastion returns the json SSH bastion settings of the given context, null if it has none
+func (c *Client) GetContextBastion(context string) string {
+	jBytes, _ := json.Marshal(c.settings.forContext(context).Bastion)
+	return string(jBytes)
+}
+
+// SetContextBastion routes the given context through an SSH bastion and persists it, reconnecting if it is the
+// current context. An empty string is returned on success, otherwise the reason the bastion can't be used.
+func (c *Client) SetContextBastion(context string, host string, user string, keyPath string, useAgent bool, knownHostsPath string) string {
+	bs := &bastionSettings{
+		Host:           host,
+		User:           user,
+		KeyPath:        keyPath,
+		UseAgent:       useAgent,
+		KnownHostsPath: knownHostsPath,
+	}
+	if _, err := newSSHBastion(*bs); err != nil {
+		c.log.Warnf("invalid bastion for context %s: %v", context, err)
+		return err.Error()
+	}
+	return c.updateContextBastion(context, bs)
+}
+
+// RemoveContextBastion connects to the given context directly again
+func (c *Client) RemoveContextBastion(context string) string {
+	return c.updateContextBastion(context, nil)
+}
+
+func (c *Client) updateContextBastion(context string, bs *bastionSettings) string {
+	c.settings.forContext(context).Bastion = bs
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	if context != c.currentContext || c.rawConf == nil {
+		return ""
+	}
+	if err := c.useConfig(c.configPath, c.rawConf, context); err != nil {
+		c.log.Warnf("failed to reconnect to context %s: %v", context, err)
+		return err.Error()
+	}
+	return ""
+}
+
+// closeAllPortForwards closes the forwards of all websites and forgets them together with the active namespaces, so
+// that they aren't closed again
 func (c *Client) closeAllPortForwards() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for _, w := range c.websites {
 		c.log.Infof("closing port forward on port %d of pod %s", w.PodPort, w.portForwardReq.Pod.Name)
 		close(w.portForwardReq.StopCh)
 	}
+	c.websites = nil
+	c.activeNamespaces = nil
 }
 
 // todo: search for all config files and present them in ui - autodetect
@@ -492,11 +1043,37 @@ func homeDir() string {
 // WailsInit takes the wails runtime and does some initialization - sets up the default client if possible
 func (c *Client) WailsInit(runtime *wails.Runtime) error {
 	c.log = logger.NewCustomLogger("Client", runtime)
+	st, err := loadSettings()
+	if err != nil {
+		c.log.Warnf("failed to load settings: %v", err)
+	}
+	c.settings = st
+	if c.settings.DNSEnabled {
+		if err := c.startDNS(); err != nil {
+			c.log.Warnf("failed to start the dns responder: %v", err)
+		}
+	}
+	if c.settings.ProxyEnabled {
+		if err := c.runClusterProxy(); err != nil {
+			c.log.Warnf("failed to start the cluster proxy: %v", err)
+		}
+	}
 	s, conf, rawConf, confPath, err := getDefaultClientSetAndConfig()
 	if err != nil {
 		c.log.Warnf("failed to get default config: %v", err.Error())
 		return nil
 	}
+	c.forwardConf = conf
+	if bastion, forwardConf, err := c.routeThroughBastion(rawConf.CurrentContext, conf); err != nil {
+		c.log.Warnf("failed to set up the bastion for context %s: %v", rawConf.CurrentContext, err)
+	} else if bastion != nil {
+		c.bastion = bastion
+		c.forwardConf = forwardConf
+		if s, err = kubernetes.NewForConfig(conf); err != nil {
+			c.log.Warnf("failed to build clientset through the bastion: %v", err)
+			return nil
+		}
+	}
 	namespaces, err := s.CoreV1().Namespaces().List(metav1.ListOptions{})
 	if err != nil || len(namespaces.Items) == 0 {
 		c.rawConf = rawConf
@@ -516,7 +1093,16 @@ func (c *Client) WailsInit(runtime *wails.Runtime) error {
 	return nil
 }
 
-// WailsShutdown is called on shutdown and cleans up all port-forwards still active
+// WailsShutdown is called on shutdown and cleans up all port-forwards still active and the relays of reverse tunnels
 func (c *Client) WailsShutdown() {
 	c.closeAllPortForwards()
+	c.removeAllReverseTunnels()
+	c.stopDNS()
+	c.stopClusterProxy()
+	if err := writeHostsFile(c.hostsPath(), nil); err != nil {
+		c.log.Warnf("failed to clean up the hosts file %s: %v", c.hostsPath(), err)
+	}
+	if c.bastion != nil {
+		c.bastion.Close()
+	}
 }
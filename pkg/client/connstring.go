@@ -0,0 +1,270 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"net"
+	"net/url"
+	"portfall/pkg/sniff"
+	"strconv"
+	"strings"
+)
+
+// masked stands in for passwords which weren't revealed and for the values of secrets which weren't read
+const masked = "****"
+
+// credentialEnv are the environment variables the official and Bitnami images of a database read their credentials
+// from, in order of preference. defaultUser is the user the images create if none is given.
+type credentialEnv struct {
+	users       []string
+	passwords   []string
+	databases   []string
+	defaultUser string
+	// rootPassword is used with the root user when the pod has no other user
+	rootPassword []string
+}
+
+var credentialEnvs = map[string]credentialEnv{
+	sniff.Postgres: {
+		users:       []string{"POSTGRES_USER", "POSTGRESQL_USERNAME", "PGUSER"},
+		passwords:   []string{"POSTGRES_PASSWORD", "POSTGRESQL_PASSWORD", "PGPASSWORD"},
+		databases:   []string{"POSTGRES_DB", "POSTGRESQL_DATABASE", "PGDATABASE"},
+		defaultUser: "postgres",
+	},
+	sniff.MySQL: {
+		users:        []string{"MYSQL_USER", "MARIADB_USER"},
+		passwords:    []string{"MYSQL_PASSWORD", "MARIADB_PASSWORD"},
+		databases:    []string{"MYSQL_DATABASE", "MARIADB_DATABASE"},
+		defaultUser:  "root",
+		rootPassword: []string{"MYSQL_ROOT_PASSWORD", "MARIADB_ROOT_PASSWORD"},
+	},
+	sniff.Redis: {
+		users:     []string{"REDIS_USERNAME"},
+		passwords: []string{"REDIS_PASSWORD"},
+	},
+	sniff.MongoDB: {
+		users:        []string{"MONGO_INITDB_ROOT_USERNAME", "MONGODB_USERNAME", "MONGODB_ROOT_USER"},
+		passwords:    []string{"MONGO_INITDB_ROOT_PASSWORD", "MONGODB_PASSWORD"},
+		databases:    []string{"MONGO_INITDB_DATABASE", "MONGODB_DATABASE"},
+		defaultUser:  "root",
+		rootPassword: []string{"MONGODB_ROOT_PASSWORD"},
+	},
+}
+
+// ConnectionInfo is how to connect to a forwarded database. Passwords are masked unless they were revealed.
+type ConnectionInfo struct {
+	Protocol string `json:"protocol"`
+	URL      string `json:"url"`
+	// Command runs the protocol's CLI, passing the password in the environment or leaving the CLI to prompt for it
+	Command  string `json:"command"`
+	Username string `json:"username,omitempty"`
+	Database string `json:"database,omitempty"`
+	// HasPassword is whether the pod references a password, Revealed whether it is in URL and in the env of Command
+	HasPassword bool `json:"hasPassword"`
+	Revealed    bool `json:"revealed"`
+	// Sources are where the credentials were read from, e.g. env POSTGRES_PASSWORD of secret db/postgres key password
+	Sources []string `json:"sources,omitempty"`
+	// Problems are the credentials which couldn't be read, e.g. because reading the secret is forbidden
+	Problems []string `json:"problems,omitempty"`
+}
+
+// credentials are the credentials of a database read from its pod
+type credentials struct {
+	username, password, database string
+	hasPassword                  bool
+	sources, problems            []string
+}
+
+// envValue resolves the first of the variables set in the containers of the pod, returning whether one is set. Values
+// of secrets are only read if read is set and masked otherwise, the reference is reported either way.
+func envValue(s kubernetes.Interface, pod v1.Pod, names []string, read bool, creds *credentials) (string, bool) {
+	for _, name := range names {
+		for _, container := range pod.Spec.Containers {
+			for _, env := range container.Env {
+				if env.Name != name {
+					continue
+				}
+				if env.ValueFrom == nil {
+					creds.sources = append(creds.sources, fmt.Sprintf("env %s of container %s", name, container.Name))
+					return env.Value, true
+				}
+				if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+					creds.sources = append(creds.sources, fmt.Sprintf("env %s of secret %s/%s key %s", name, pod.Namespace, ref.Name, ref.Key))
+					if !read {
+						return masked, true
+					}
+					value, err := secretKey(s, pod.Namespace, ref.Name, ref.Key)
+					if err != nil {
+						creds.problems = append(creds.problems, err.Error())
+					}
+					return value, true
+				}
+				if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+					creds.sources = append(creds.sources, fmt.Sprintf("env %s of config map %s/%s key %s", name, pod.Namespace, ref.Name, ref.Key))
+					cm, err := s.CoreV1().ConfigMaps(pod.Namespace).Get(ref.Name, metav1.GetOptions{})
+					if err != nil {
+						creds.problems = append(creds.problems, fmt.Sprintf("can't read config map %s/%s: %v", pod.Namespace, ref.Name, err))
+						return "", true
+					}
+					return cm.Data[ref.Key], true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// secretKey reads the key of the secret. The error never holds the value.
+func secretKey(s kubernetes.Interface, namespace string, name string, key string) (string, error) {
+	secret, err := s.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsForbidden(err) {
+		return "", fmt.Errorf("reading secret %s/%s is forbidden", namespace, name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't read secret %s/%s: %v", namespace, name, err)
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %s", namespace, name, key)
+	}
+	return string(value), nil
+}
+
+// readCredentials reads the credentials of the database from the env of its pod. Secrets are only read if reveal is
+// set, usernames and database names kept in secrets are masked otherwise.
+func readCredentials(s kubernetes.Interface, pod v1.Pod, protocol string, reveal bool) credentials {
+	var creds credentials
+	env := credentialEnvs[protocol]
+	creds.username, _ = envValue(s, pod, env.users, reveal, &creds)
+	creds.database, _ = envValue(s, pod, env.databases, reveal, &creds)
+	passwords := env.passwords
+	if creds.username == "" {
+		creds.username = env.defaultUser
+		passwords = append(append([]string(nil), env.rootPassword...), passwords...)
+	}
+	creds.password, creds.hasPassword = envValue(s, pod, passwords, reveal, &creds)
+	return creds
+}
+
+// shellQuote quotes s for sh unless it only holds safe characters
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:@", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// connectionInfo assembles the url and CLI command of the database on host:port
+func connectionInfo(protocol string, host string, port int32, creds credentials, reveal bool) ConnectionInfo {
+	info := ConnectionInfo{
+		Protocol:    protocol,
+		Username:    creds.username,
+		Database:    creds.database,
+		HasPassword: creds.hasPassword,
+		Revealed:    reveal && creds.hasPassword && creds.password != "",
+		Sources:     creds.sources,
+		Problems:    creds.problems,
+	}
+	password := creds.password
+	if !info.Revealed && creds.hasPassword {
+		password = masked
+	}
+	portStr := strconv.Itoa(int(port))
+	u := url.URL{Host: net.JoinHostPort(host, portStr), Path: "/" + creds.database}
+	if creds.username != "" || password != "" {
+		u.User = url.UserPassword(creds.username, password)
+		if password == "" {
+			u.User = url.User(creds.username)
+		}
+	}
+	var command []string
+	var passwordEnv string
+	switch protocol {
+	case sniff.Postgres:
+		u.Scheme = "postgresql"
+		command = []string{"psql", "-h", host, "-p", portStr, "-U", creds.username}
+		if creds.database != "" {
+			command = append(command, creds.database)
+		}
+		passwordEnv = "PGPASSWORD"
+	case sniff.MySQL:
+		u.Scheme = "mysql"
+		command = []string{"mysql", "-h", host, "-P", portStr, "-u", creds.username}
+		if creds.database != "" {
+			command = append(command, creds.database)
+		}
+		passwordEnv = "MYSQL_PWD"
+	case sniff.Redis:
+		u.Scheme = "redis"
+		u.Path = ""
+		command = []string{"redis-cli", "-h", host, "-p", portStr}
+		if creds.username != "" {
+			command = append(command, "--user", creds.username)
+		}
+		passwordEnv = "REDISCLI_AUTH"
+	case sniff.MongoDB:
+		u.Scheme = "mongodb"
+		if creds.username != "" {
+			u.RawQuery = "authSource=admin"
+		}
+	}
+	format := func(u url.URL) string {
+		return strings.Replace(u.String(), url.QueryEscape(masked), masked, -1)
+	}
+	info.URL = format(u)
+	if protocol == sniff.MongoDB {
+		// mongosh has no password variable, it prompts for the password of the user in the url instead
+		if creds.username != "" {
+			u.User = url.User(creds.username)
+		}
+		command = []string{"mongosh", format(u)}
+	}
+	for i, arg := range command {
+		command[i] = shellQuote(arg)
+	}
+	if passwordEnv != "" && password != "" {
+		command = append([]string{passwordEnv + "=" + shellQuote(password)}, command...)
+	}
+	info.Command = strings.Join(command, " ")
+	return info
+}
+
+// GetConnectionInfo returns how to connect to the database forwarded on localAddress:localPort, see ConnectionInfo.
+// Credentials are read from the env of the database's pod and the secrets it references, as far as RBAC allows.
+// Passwords are masked unless reveal is set. They are never logged. The json info is returned, or an empty string if
+// there is no database on the port.
+func (c *Client) GetConnectionInfo(localAddress string, localPort int, reveal bool) string {
+	c.mu.RLock()
+	var website *Website
+	for _, w := range c.websites {
+		if w.LocalAddress == localAddress && int(w.LocalPort) == localPort {
+			website = w
+		}
+	}
+	c.mu.RUnlock()
+	if website == nil {
+		c.log.Warnf("no website on port %d", localPort)
+		return ""
+	}
+	if _, ok := credentialEnvs[website.Protocol]; !ok {
+		c.log.Warnf("website on port %d isn't a known database", localPort)
+		return ""
+	}
+	host := localAddress
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	creds := readCredentials(c.s, website.portForwardReq.Pod, website.Protocol, reveal)
+	info := connectionInfo(website.Protocol, host, website.LocalPort, creds, reveal)
+	if info.Revealed {
+		c.log.Infof("revealed the password of %s on port %d", website.Protocol, localPort)
+	}
+	jBytes, _ := json.Marshal(info)
+	return string(jBytes)
+}
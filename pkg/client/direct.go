@@ -0,0 +1,275 @@
+package client
+
+import (
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"net/url"
+	"portfall/pkg/favicon"
+	"portfall/pkg/sniff"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of websites
+const (
+	// kindForward websites are served on a local port
+	kindForward = "forward"
+	// kindDirect websites are reached directly on their NodePort, load balancer or external name
+	kindDirect = "direct"
+)
+
+const (
+	// directProbeTimeout is how long the reachability probe of a direct website waits for a connection
+	directProbeTimeout = 2 * time.Second
+	// maxProbedNodes is the number of nodes tried for a NodePort until one is reachable
+	maxProbedNodes = 3
+)
+
+// directTarget is a port of a service which can be reached without a forward on any of its hosts
+type directTarget struct {
+	service v1.Service
+	port    v1.ServicePort
+	// number is the port reached on the hosts, which is the node port for NodePort services
+	number int32
+	hosts  []string
+}
+
+// directURL returns the url of the port on the host, guessing https from the port's name and number
+func directURL(host string, port v1.ServicePort, number int32) string {
+	scheme := "http"
+	if number == 443 || number == 8443 || strings.Contains(strings.ToLower(port.Name), "https") {
+		scheme = "https"
+	}
+	if (scheme == "http" && number == 80) || (scheme == "https" && number == 443) {
+		return scheme + "://" + host + "/"
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(number))) + "/"
+}
+
+// directTargets returns the ports of the service which can be reached directly. Load balancers are preferred over
+// the node ports of LoadBalancer services.
+func directTargets(svc v1.Service, nodeAddresses []string) []directTarget {
+	var targets []directTarget
+	for _, port := range svc.Spec.Ports {
+		if port.Protocol != "" && port.Protocol != v1.ProtocolTCP {
+			continue
+		}
+		target := directTarget{service: svc, port: port, number: port.Port}
+		switch svc.Spec.Type {
+		case v1.ServiceTypeExternalName:
+			target.hosts = []string{svc.Spec.ExternalName}
+		case v1.ServiceTypeLoadBalancer:
+			for _, lb := range svc.Status.LoadBalancer.Ingress {
+				if lb.Hostname != "" {
+					target.hosts = append(target.hosts, lb.Hostname)
+				} else if lb.IP != "" {
+					target.hosts = append(target.hosts, lb.IP)
+				}
+			}
+			if len(target.hosts) == 0 && port.NodePort != 0 {
+				target.number = port.NodePort
+				target.hosts = nodeAddresses
+			}
+		case v1.ServiceTypeNodePort:
+			target.number = port.NodePort
+			target.hosts = nodeAddresses
+		}
+		if len(target.hosts) > 0 && target.number != 0 {
+			targets = append(targets, target)
+		}
+	}
+	if svc.Spec.Type == v1.ServiceTypeExternalName && len(targets) == 0 && svc.Spec.ExternalName != "" {
+		targets = append(targets, directTarget{service: svc, number: 80, hosts: []string{svc.Spec.ExternalName}})
+	}
+	return targets
+}
+
+// probeReachable returns whether a tcp connection to the host port can be opened
+func probeReachable(host string, port int32) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))), directProbeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// nodeAddresses returns the external addresses of ready nodes followed by their internal ones
+func (c *Client) nodeAddresses() []string {
+	nodes, err := c.s.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		c.log.Infof("not listing nodes for node ports: %v", err)
+		return nil
+	}
+	var external, internal []string
+	for _, node := range nodes.Items {
+		ready := false
+		for _, cond := range node.Status.Conditions {
+			if cond.Type == v1.NodeReady && cond.Status == v1.ConditionTrue {
+				ready = true
+			}
+		}
+		if !ready {
+			continue
+		}
+		for _, addr := range node.Status.Addresses {
+			switch addr.Type {
+			case v1.NodeExternalIP:
+				external = append(external, addr.Address)
+			case v1.NodeInternalIP:
+				internal = append(internal, addr.Address)
+			}
+		}
+	}
+	return append(external, internal...)
+}
+
+// directWebsite probes the hosts of the target and returns a website for the first reachable one, or for the first
+// host if none is reachable
+func directWebsite(target directTarget) *Website {
+	svc := target.service
+	w := &Website{
+		Kind:      kindDirect,
+		Title:     svc.Name,
+		Namespace: svc.Namespace,
+		PodPort:   target.port.Port,
+		// the website is reached on the port of the service
+		PortSource: portSourceService,
+		portForwardReq: portForwardPodRequest{
+			Pod:    v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: svc.Namespace}},
+			StopCh: make(chan struct{}),
+		},
+	}
+	hosts := target.hosts
+	if len(hosts) > maxProbedNodes {
+		hosts = hosts[:maxProbedNodes]
+	}
+	w.DirectUrl = directURL(hosts[0], target.port, target.number)
+	var reachableHost string
+	for _, host := range hosts {
+		if probeReachable(host, target.number) {
+			w.Reachable = true
+			w.DirectUrl = directURL(host, target.port, target.number)
+			reachableHost = host
+			break
+		}
+	}
+	if !w.Reachable || w.fetchDirectIcon() {
+		return w
+	}
+	if protocol, err := sniff.Sniff(net.JoinHostPort(reachableHost, strconv.Itoa(int(target.number))), sniffTimeout); err == nil {
+		w.Protocol = protocol
+		w.IconUrl = sniff.Icon(protocol)
+		w.IconRemoteUrl = w.IconUrl
+	}
+	return w
+}
+
+// fetchDirectIcon gets the favicon and title of the direct website, returning whether it answered over http
+func (w *Website) fetchDirectIcon() bool {
+	icon, err := favicon.GetBest(w.DirectUrl)
+	if err != nil {
+		return false
+	}
+	w.Protocol = sniff.HTTP
+	w.icon = *icon
+	if icon.PageTitle != "" {
+		w.Title = icon.PageTitle
+	}
+	w.IconUrl = fmt.Sprintf("file://%s", icon.FilePath)
+	w.IconRemoteUrl = icon.RemoteUrl
+	return true
+}
+
+// directRouteWebsite returns a direct website for the url of the route, probing the host and port it is served on
+func directRouteWebsite(r externalRoute) *Website {
+	w := &Website{
+		Kind:        kindDirect,
+		Title:       r.service,
+		Namespace:   r.namespace,
+		PodPort:     r.port.IntVal,
+		PortSource:  portSourceService,
+		Protocol:    sniff.HTTP,
+		DirectUrl:   r.url,
+		ExternalUrl: r.url,
+		Route:       r.source,
+		portForwardReq: portForwardPodRequest{
+			Pod:    v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: r.namespace}},
+			StopCh: make(chan struct{}),
+		},
+	}
+	u, err := url.Parse(r.url)
+	if err != nil {
+		return w
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	number, _ := strconv.Atoi(port)
+	w.Reachable = probeReachable(u.Hostname(), int32(number))
+	if w.Reachable {
+		w.fetchDirectIcon()
+	}
+	return w
+}
+
+// directWebsitesInServices returns the direct websites of the NodePort, LoadBalancer and ExternalName services,
+// probing them concurrently. Nodes are only listed if there are node ports.
+func (c *Client) directWebsitesInServices(services []v1.Service) []*Website {
+	var nodeAddresses []string
+	for _, svc := range services {
+		if svc.Spec.Type == v1.ServiceTypeNodePort || svc.Spec.Type == v1.ServiceTypeLoadBalancer {
+			nodeAddresses = c.nodeAddresses()
+			break
+		}
+	}
+	var targets []directTarget
+	for _, svc := range services {
+		targets = append(targets, directTargets(svc, nodeAddresses)...)
+	}
+	websites := make([]*Website, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target directTarget) {
+			defer wg.Done()
+			websites[i] = directWebsite(target)
+		}(i, target)
+	}
+	wg.Wait()
+	return websites
+}
+
+// directWebsitesOfRoutes returns the direct websites of the routes, probing them concurrently
+func directWebsitesOfRoutes(routes []externalRoute) []*Website {
+	websites := make([]*Website, len(routes))
+	var wg sync.WaitGroup
+	for i, r := range routes {
+		wg.Add(1)
+		go func(i int, r externalRoute) {
+			defer wg.Done()
+			websites[i] = directRouteWebsite(r)
+		}(i, r)
+	}
+	wg.Wait()
+	return websites
+}
+
+// forwardedWebsites drops the direct websites, which have no local port
+func forwardedWebsites(websites []*Website) []*Website {
+	var forwarded []*Website
+	for _, w := range websites {
+		if w.Kind != kindDirect {
+			forwarded = append(forwarded, w)
+		}
+	}
+	return forwarded
+}
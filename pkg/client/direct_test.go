@@ -0,0 +1,110 @@
+package client
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"portfall/pkg/sniff"
+	"strconv"
+	"testing"
+)
+
+func TestDirectTargets(t *testing.T) {
+	meta := metav1.ObjectMeta{Name: "web", Namespace: "default"}
+	nodes := []string{"198.51.100.1", "10.0.0.1"}
+
+	nodePort := v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Type: v1.ServiceTypeNodePort, Ports: []v1.ServicePort{
+		{Name: "http", Port: 80, NodePort: 30080},
+		{Name: "dns", Port: 53, NodePort: 30053, Protocol: v1.ProtocolUDP},
+	}}}
+	targets := directTargets(nodePort, nodes)
+	if len(targets) != 1 || targets[0].number != 30080 || len(targets[0].hosts) != 2 {
+		t.Fatalf("expected the tcp node port on every node got %+v", targets)
+	}
+	if u := directURL(targets[0].hosts[0], targets[0].port, targets[0].number); u != "http://198.51.100.1:30080/" {
+		t.Errorf("unexpected node port url %s", u)
+	}
+
+	lb := v1.Service{ObjectMeta: meta,
+		Spec:   v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: []v1.ServicePort{{Name: "https", Port: 443, NodePort: 30443}}},
+		Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{Hostname: "lb.example.com"}}}},
+	}
+	targets = directTargets(lb, nodes)
+	if len(targets) != 1 || targets[0].number != 443 {
+		t.Fatalf("expected the load balancer to be preferred over the node port got %+v", targets)
+	}
+	if u := directURL(targets[0].hosts[0], targets[0].port, targets[0].number); u != "https://lb.example.com/" {
+		t.Errorf("unexpected load balancer url %s", u)
+	}
+
+	external := v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "db.example.com"}}
+	targets = directTargets(external, nodes)
+	if len(targets) != 1 || targets[0].hosts[0] != "db.example.com" || targets[0].number != 80 {
+		t.Errorf("expected an external name without ports to be linked on port 80 got %+v", targets)
+	}
+
+	clusterIP := v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}}}
+	if targets := directTargets(clusterIP, nodes); len(targets) != 0 {
+		t.Errorf("expected cluster ip services not to be direct got %+v", targets)
+	}
+}
+
+func TestDirectWebsiteProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><head><title>Dashboard</title></head></html>"))
+	}))
+	defer server.Close()
+	host, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	// a closed port is tried first
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skip("no second loopback address")
+	}
+	closed := l.Addr().(*net.TCPAddr).IP.String()
+	l.Close()
+
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "dashboard", Namespace: "default"},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeNodePort},
+	}
+	w := directWebsite(directTarget{service: svc, port: v1.ServicePort{Port: 80}, number: int32(port), hosts: []string{closed, host}})
+	if !w.Reachable || w.DirectUrl != "http://"+net.JoinHostPort(host, portStr)+"/" {
+		t.Errorf("expected the reachable node to be linked got %s (%t)", w.DirectUrl, w.Reachable)
+	}
+	if w.Kind != kindDirect || w.Namespace != "default" {
+		t.Errorf("unexpected website %+v", w)
+	}
+
+	server.Close()
+	w = directWebsite(directTarget{service: svc, port: v1.ServicePort{Port: 80}, number: int32(port), hosts: []string{host}})
+	if w.Reachable || w.Title != "dashboard" {
+		t.Errorf("expected an unreachable website titled after its service got %+v", w)
+	}
+}
+
+func TestDirectRouteWebsite(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><head><title>Docs</title></head></html>"))
+	}))
+	defer server.Close()
+	r := externalRoute{source: "Ingress/docs", namespace: "web", url: server.URL + "/", service: "docs", port: intstr.FromInt(80)}
+
+	w := directRouteWebsite(r)
+	if !w.Reachable || w.Kind != kindDirect || w.DirectUrl != r.url || w.ExternalUrl != r.url || w.Route != "Ingress/docs" {
+		t.Errorf("expected a reachable website linking the route got %+v", w)
+	}
+	if w.Namespace != "web" || w.portForwardReq.Pod.Namespace != "web" || w.Protocol != sniff.HTTP {
+		t.Errorf("unexpected website %+v", w)
+	}
+
+	server.Close()
+	w = directRouteWebsite(r)
+	if w.Reachable || w.Title != "docs" {
+		t.Errorf("expected an unreachable website titled after its service got %+v", w)
+	}
+}
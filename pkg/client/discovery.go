@@ -0,0 +1,640 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/jsonpath"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DiscoverySource finds the pods of a namespace together with their ports which might be serving websites. The
+// candidates of all sources are forwarded by the same pipeline, see forwardAndGetIconsForWebsitesInNamespace.
+type DiscoverySource interface {
+	// Name identifies the source in logs and in the disabled sources of the discovery file
+	Name() string
+	// Discover returns the candidates in the namespace of the scope
+	Discover(scope *discoveryScope) ([]podCandidates, error)
+}
+
+// podCandidates are the candidate ports of a single pod
+type podCandidates struct {
+	pod        v1.Pod
+	candidates []websiteCandidate
+}
+
+// discoveryScope is what the sources share while discovering the websites of a namespace
+type discoveryScope struct {
+	c *Client
+	// namespace is the namespace of the ui, which may be All Namespaces, and internalNS the one listed
+	namespace  string
+	internalNS string
+	pods       *v1.PodList
+	services   *v1.ServiceList
+	routes     map[string][]externalRoute
+	dyn        dynamic.Interface
+	dynErr     error
+}
+
+// skipped returns whether the websites of the namespace were already discovered for another active namespace
+func (s *discoveryScope) skipped(namespace string) bool {
+	if s.namespace != "All Namespaces" {
+		return false
+	}
+	for _, n := range s.c.activeNamespaces {
+		if n != s.namespace && n == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the objects of the resource in the first of the versions served by the cluster, nil if it serves none
+func (s *discoveryScope) list(group string, versions []string, resource string) ([]unstructured.Unstructured, error) {
+	if s.dyn == nil && s.dynErr == nil {
+		s.dyn, s.dynErr = s.c.dynamicClient()
+	}
+	if s.dynErr != nil {
+		return nil, s.dynErr
+	}
+	for _, version := range versions {
+		gvr := schema.GroupVersionResource{Group: group, Version: version, Resource: resource}
+		list, err := s.dyn.Resource(gvr).Namespace(s.internalNS).List(metav1.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var items []unstructured.Unstructured
+		for _, item := range list.Items {
+			if !s.skipped(item.GetNamespace()) {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	}
+	return nil, nil
+}
+
+// runningPod returns a running pod of the namespace matching the selector
+func (s *discoveryScope) runningPod(namespace string, selector map[string]string) (v1.Pod, bool) {
+	if len(selector) == 0 {
+		return v1.Pod{}, false
+	}
+podLoop:
+	for _, pod := range s.pods.Items {
+		if pod.Namespace != namespace || pod.Status.Phase != "Running" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		for k, v := range selector {
+			if pod.Labels[k] != v {
+				continue podLoop
+			}
+		}
+		return pod, true
+	}
+	return v1.Pod{}, false
+}
+
+// serviceCandidates returns the ports of the service served by one of its running pods, only the port with the
+// given number or name unless it is empty. The source is recorded on the candidates along with the url, if any.
+func (s *discoveryScope) serviceCandidates(namespace string, name string, port string, source string, url string) (podCandidates, bool) {
+	for _, svc := range s.services.Items {
+		if svc.Namespace != namespace || svc.Name != name {
+			continue
+		}
+		pod, ok := s.runningPod(namespace, svc.Spec.Selector)
+		if !ok {
+			return podCandidates{}, false
+		}
+		var candidates []websiteCandidate
+		for _, p := range svc.Spec.Ports {
+			if port != "" && port != p.Name && port != strconv.Itoa(int(p.Port)) {
+				continue
+			}
+			podPort, ok := targetPortInPod(p, pod)
+			if !ok {
+				continue
+			}
+			candidates = append(candidates, websiteCandidate{
+				port:         podPort,
+				resourceName: svc.Name,
+				resourceType: "service",
+				servicePort:  p.Port,
+				source:       source,
+				portSource:   portSourceService,
+			})
+		}
+		candidates = attachRoutes(candidates, namespace, s.services, s.routes)
+		if url != "" {
+			for i := range candidates {
+				candidates[i].route = source
+				candidates[i].externalURL = url
+			}
+		}
+		return podCandidates{pod: pod, candidates: candidates}, len(candidates) > 0
+	}
+	return podCandidates{}, false
+}
+
+// podServiceSource is the default source, the services and container ports of running pods. Only one pod of each
+// ReplicaSet, StatefulSet and DaemonSet is used.
+type podServiceSource struct{}
+
+func (podServiceSource) Name() string {
+	return "pods"
+}
+
+func (podServiceSource) Discover(s *discoveryScope) ([]podCandidates, error) {
+	var found []podCandidates
+	var handledReplicationControllers []string
+	handledServices := map[string]bool{}
+podLoop:
+	for _, pod := range s.pods.Items {
+		// skip pods in already active namespaces
+		if s.skipped(pod.Namespace) {
+			continue podLoop
+		}
+		// skip not running pods
+		if pod.Status.Phase != "Running" {
+			continue podLoop
+		}
+		// has been scheduled from deletion
+		if pod.DeletionTimestamp != nil {
+			continue podLoop
+		}
+		// handle replication controllers we only need one pod from each replica
+		for _, owner := range pod.OwnerReferences {
+			if owner.Kind == "StatefulSet" || owner.Kind == "ReplicaSet" || owner.Kind == "DaemonSet" {
+				for _, rc := range handledReplicationControllers {
+					if rc == owner.Name {
+						continue podLoop
+					}
+				}
+				handledReplicationControllers = append(handledReplicationControllers, owner.Name)
+			}
+		}
+		// services
+		candidates := s.c.handleServicesInPod(s.services, pod)
+		// container ports
+		candidates = s.c.handleContainerPortsInPod(pod, candidates)
+		candidates = attachRoutes(candidates, pod.Namespace, s.services, s.routes)
+		if s.c.settings.ServiceMode != "" {
+			// in service mode a service is served from all of its endpoints so it only needs a single website
+			candidates = skipHandledServices(candidates, pod.Namespace, handledServices)
+		}
+		if len(candidates) > 0 {
+			found = append(found, podCandidates{pod: pod, candidates: candidates})
+		}
+	}
+	return found, nil
+}
+
+// knativeSource finds the running revisions of Knative Services, linked to the url of the Knative Service
+type knativeSource struct{}
+
+func (knativeSource) Name() string {
+	return "knative"
+}
+
+func (knativeSource) Discover(s *discoveryScope) ([]podCandidates, error) {
+	ksvcs, err := s.list("serving.knative.dev", []string{"v1"}, "services")
+	if err != nil {
+		return nil, err
+	}
+	var found []podCandidates
+	for _, ksvc := range ksvcs {
+		pod, ok := s.runningPod(ksvc.GetNamespace(), map[string]string{"serving.knative.dev/service": ksvc.GetName()})
+		if !ok {
+			// scaled to zero
+			continue
+		}
+		source := "Knative Service/" + ksvc.GetName()
+		url, _, _ := unstructured.NestedString(ksvc.Object, "status", "url")
+		var candidates []websiteCandidate
+		for _, container := range pod.Spec.Containers {
+			// the queue-proxy sidecar only fronts the user container
+			if container.Name == "queue-proxy" {
+				continue
+			}
+			for _, port := range container.Ports {
+				candidates = append(candidates, websiteCandidate{
+					port:         port.ContainerPort,
+					resourceName: container.Name,
+					resourceType: "container",
+					source:       source,
+					portSource:   portSourceContainerPort,
+					route:        source,
+					externalURL:  url,
+				})
+			}
+		}
+		if len(candidates) > 0 {
+			found = append(found, podCandidates{pod: pod, candidates: candidates})
+		}
+	}
+	return found, nil
+}
+
+// virtualServiceSource finds the destination services of Istio VirtualServices, linked to the first host of the
+// VirtualService published through a gateway
+type virtualServiceSource struct{}
+
+func (virtualServiceSource) Name() string {
+	return "istio"
+}
+
+func (virtualServiceSource) Discover(s *discoveryScope) ([]podCandidates, error) {
+	virtualServices, err := s.list("networking.istio.io", []string{"v1", "v1beta1", "v1alpha3"}, "virtualservices")
+	if err != nil {
+		return nil, err
+	}
+	var found []podCandidates
+	for i := range virtualServices {
+		vs := &virtualServices[i]
+		source := "VirtualService/" + vs.GetName()
+		url := virtualServiceURL(vs)
+		for _, ref := range virtualServiceDestinations(vs) {
+			if pc, ok := s.serviceCandidates(ref.namespace, ref.name, ref.port, source, url); ok {
+				found = append(found, pc)
+			}
+		}
+	}
+	return found, nil
+}
+
+// serviceRef references a port of a service, all of its ports if port is empty
+type serviceRef struct {
+	namespace string
+	name      string
+	port      string
+}
+
+// virtualServiceDestinations returns the services the http routes of the VirtualService send traffic to. Hosts
+// outside of the cluster are skipped.
+func virtualServiceDestinations(vs *unstructured.Unstructured) []serviceRef {
+	var refs []serviceRef
+	seen := map[serviceRef]bool{}
+	httpRoutes, _, _ := unstructured.NestedSlice(vs.Object, "spec", "http")
+	for _, httpRoute := range httpRoutes {
+		routeMap, ok := httpRoute.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		destinations, _, _ := unstructured.NestedSlice(routeMap, "route")
+		for _, destination := range destinations {
+			destMap, ok := destination.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			host, _, _ := unstructured.NestedString(destMap, "destination", "host")
+			ref, ok := serviceRefOfHost(host, vs.GetNamespace())
+			if !ok {
+				continue
+			}
+			if port, ok, _ := unstructured.NestedInt64(destMap, "destination", "port", "number"); ok {
+				ref.port = strconv.Itoa(int(port))
+			}
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// serviceRefOfHost returns the service of a host of the form name[.namespace[.svc[.cluster.local]]]
+func serviceRefOfHost(host string, namespace string) (serviceRef, bool) {
+	host = strings.TrimSuffix(strings.TrimSuffix(host, ".cluster.local"), ".svc")
+	parts := strings.Split(host, ".")
+	switch {
+	case host == "" || strings.Contains(host, "*") || len(parts) > 2:
+		return serviceRef{}, false
+	case len(parts) == 2:
+		return serviceRef{namespace: parts[1], name: parts[0]}, true
+	default:
+		return serviceRef{namespace: namespace, name: parts[0]}, true
+	}
+}
+
+// virtualServiceURL returns the url of the first host of the VirtualService if it is bound to a gateway other than
+// the mesh
+func virtualServiceURL(vs *unstructured.Unstructured) string {
+	gateways, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "gateways")
+	exposed := false
+	for _, gw := range gateways {
+		if gw != "mesh" {
+			exposed = true
+		}
+	}
+	if !exposed {
+		return ""
+	}
+	hosts, _, _ := unstructured.NestedStringSlice(vs.Object, "spec", "hosts")
+	for _, host := range hosts {
+		if !strings.Contains(host, "*") && strings.Contains(host, ".") && !strings.HasSuffix(host, ".svc.cluster.local") {
+			return routeURL("http", host, "/")
+		}
+	}
+	return ""
+}
+
+// crdSource finds the services referenced by custom resources at a JSONPath. It is configured in the discovery file,
+// Argo Rollouts are discovered by a built-in one.
+type crdSource struct {
+	// SourceName identifies the source, the resource is used if it is empty
+	SourceName string   `json:"name,omitempty"`
+	Group      string   `json:"group"`
+	Versions   []string `json:"versions"`
+	Resource   string   `json:"resource"`
+	// Kind labels the websites found, e.g. Rollout/checkout
+	Kind string `json:"kind,omitempty"`
+	// ServiceName is a JSONPath to the names of the services of an object in its namespace, e.g. {.spec.service}
+	ServiceName string `json:"serviceName"`
+	// ServicePort optionally is a JSONPath to the port numbers or names of the services, all of their ports are used
+	// without it
+	ServicePort string `json:"servicePort,omitempty"`
+	// URL optionally is a JSONPath to the external url of an object
+	URL string `json:"url,omitempty"`
+}
+
+// argoRolloutsSource finds the stable services of canary Rollouts and the active services of blue-green ones
+var argoRolloutsSource = &crdSource{
+	SourceName:  "argo-rollouts",
+	Group:       "argoproj.io",
+	Versions:    []string{"v1alpha1"},
+	Resource:    "rollouts",
+	Kind:        "Rollout",
+	ServiceName: "{.spec.strategy.canary.stableService} {.spec.strategy.blueGreen.activeService}",
+}
+
+func (cs *crdSource) Name() string {
+	if cs.SourceName != "" {
+		return cs.SourceName
+	}
+	return cs.Resource
+}
+
+func (cs *crdSource) validate() error {
+	if cs.Group == "" || len(cs.Versions) == 0 || cs.Resource == "" {
+		return fmt.Errorf("source %s needs a group, versions and a resource", cs.Name())
+	}
+	if cs.ServiceName == "" {
+		return fmt.Errorf("source %s needs the JSONPath of the service name", cs.Name())
+	}
+	for _, path := range []string{cs.ServiceName, cs.ServicePort, cs.URL} {
+		if path == "" {
+			continue
+		}
+		if err := jsonpath.New(cs.Name()).Parse(path); err != nil {
+			return fmt.Errorf("invalid JSONPath %s of source %s: %v", path, cs.Name(), err)
+		}
+	}
+	return nil
+}
+
+// evalJSONPath returns the whitespace separated values the path yields for the object
+func evalJSONPath(obj map[string]interface{}, path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	jp := jsonpath.New("discovery").AllowMissingKeys(true)
+	if err := jp.Parse(path); err != nil {
+		return nil, err
+	}
+	results, err := jp.FindResults(obj)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, result := range results {
+		for _, v := range result {
+			if v.IsValid() && v.CanInterface() && v.Interface() != nil {
+				values = append(values, strings.Fields(fmt.Sprint(v.Interface()))...)
+			}
+		}
+	}
+	return values, nil
+}
+
+// services returns the services the object references. A single port applies to every service, otherwise the ports
+// are paired with the services in order.
+func (cs *crdSource) services(obj *unstructured.Unstructured) ([]serviceRef, string, error) {
+	names, err := evalJSONPath(obj.Object, cs.ServiceName)
+	if err != nil {
+		return nil, "", err
+	}
+	ports, err := evalJSONPath(obj.Object, cs.ServicePort)
+	if err != nil {
+		return nil, "", err
+	}
+	urls, err := evalJSONPath(obj.Object, cs.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	var url string
+	if len(urls) > 0 {
+		url = urls[0]
+	}
+	var refs []serviceRef
+	for i, name := range names {
+		ref := serviceRef{namespace: obj.GetNamespace(), name: name}
+		if len(ports) == 1 {
+			ref.port = ports[0]
+		} else if len(ports) == len(names) {
+			ref.port = ports[i]
+		}
+		refs = append(refs, ref)
+	}
+	return refs, url, nil
+}
+
+func (cs *crdSource) Discover(s *discoveryScope) ([]podCandidates, error) {
+	objects, err := s.list(cs.Group, cs.Versions, cs.Resource)
+	if err != nil {
+		return nil, err
+	}
+	kind := cs.Kind
+	if kind == "" {
+		kind = cs.Resource
+	}
+	var found []podCandidates
+	for i := range objects {
+		refs, url, err := cs.services(&objects[i])
+		if err != nil {
+			s.c.log.Infof("not discovering %s %s: %v", kind, objects[i].GetName(), err)
+			continue
+		}
+		for _, ref := range refs {
+			if pc, ok := s.serviceCandidates(ref.namespace, ref.name, ref.port, kind+"/"+objects[i].GetName(), url); ok {
+				found = append(found, pc)
+			}
+		}
+	}
+	return found, nil
+}
+
+// discoveryConfig is the discovery file
+type discoveryConfig struct {
+	// Disabled are the names of the sources not to use, e.g. istio
+	Disabled []string `json:"disabled,omitempty"`
+	// Sources are additional custom resources referencing services
+	Sources []*crdSource `json:"sources,omitempty"`
+}
+
+func (c *Client) discoveryPath() (string, error) {
+	if c.settings.DiscoveryPath != "" {
+		return c.settings.DiscoveryPath, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "discovery.json"), nil
+}
+
+// loadDiscoveryConfig reads the discovery file, there are no additional sources if it doesn't exist
+func loadDiscoveryConfig(path string) (*discoveryConfig, error) {
+	config := &discoveryConfig{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("invalid discovery file %s: %v", path, err)
+	}
+	for _, source := range config.Sources {
+		if err := source.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// discoverySources returns the sources in the order their candidates are claimed. The sources of custom resources
+// come first so that their websites are labeled after the app rather than the pod behind it.
+func (c *Client) discoverySources() []DiscoverySource {
+	sources := []DiscoverySource{knativeSource{}, argoRolloutsSource, virtualServiceSource{}}
+	config := &discoveryConfig{}
+	if path, err := c.discoveryPath(); err != nil {
+		c.log.Warnf("%v", err)
+	} else if config, err = loadDiscoveryConfig(path); err != nil {
+		c.log.Warnf("ignoring the discovery file: %v", err)
+		config = &discoveryConfig{}
+	}
+	for _, source := range config.Sources {
+		sources = append(sources, source)
+	}
+	sources = append(sources, podServiceSource{})
+
+	disabled := map[string]bool{}
+	for _, name := range config.Disabled {
+		disabled[name] = true
+	}
+	var enabled []DiscoverySource
+	for _, source := range sources {
+		if !disabled[source.Name()] {
+			enabled = append(enabled, source)
+		}
+	}
+	return enabled
+}
+
+// candidateClaims makes sure a port is only forwarded for the first source finding it. A port is identified by the
+// workload of its pod, so a later source picking another replica doesn't forward it again, and services by their
+// port. Services are only claimed across sources as a source may forward a service from several workloads.
+type candidateClaims struct {
+	ports    map[string]bool
+	services map[string]bool
+	// pending are the services claimed by the current source
+	pending map[string]bool
+}
+
+func newCandidateClaims() *candidateClaims {
+	return &candidateClaims{ports: map[string]bool{}, services: map[string]bool{}, pending: map[string]bool{}}
+}
+
+// workloadOf returns the controller of the pod, or the pod itself if it has none. The ReplicaSets of a Deployment
+// are named after their pod template hash, the Deployment is returned for them so that the workload survives rollouts.
+func workloadOf(pod v1.Pod) string {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Controller == nil || !*owner.Controller {
+			continue
+		}
+		hash := pod.Labels["pod-template-hash"]
+		if owner.Kind == "ReplicaSet" && hash != "" && strings.HasSuffix(owner.Name, "-"+hash) {
+			return "Deployment/" + strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+		return owner.Kind + "/" + owner.Name
+	}
+	return "Pod/" + pod.Name
+}
+
+// claim returns the candidates of the pod not claimed yet and claims them
+func (cc *candidateClaims) claim(pc podCandidates) []websiteCandidate {
+	var claimed []websiteCandidate
+	for _, cand := range pc.candidates {
+		portKey := fmt.Sprintf("%s/%s:%d", pc.pod.Namespace, workloadOf(pc.pod), cand.port)
+		var serviceKey string
+		if cand.resourceType == "service" {
+			serviceKey = fmt.Sprintf("%s/%s:%d", pc.pod.Namespace, cand.resourceName, cand.servicePort)
+		}
+		if cc.ports[portKey] || (serviceKey != "" && cc.services[serviceKey]) {
+			continue
+		}
+		cc.ports[portKey] = true
+		if serviceKey != "" {
+			cc.pending[serviceKey] = true
+		}
+		claimed = append(claimed, cand)
+	}
+	return claimed
+}
+
+// sourceDone claims the services of the source which just finished
+func (cc *candidateClaims) sourceDone() {
+	for key := range cc.pending {
+		cc.services[key] = true
+	}
+	cc.pending = map[string]bool{}
+}
+
+// SetDiscoveryPath sets the discovery file configuring additional sources of websites, see discoveryConfig, and
+// persists it. An empty path uses discovery.json in Portfall's config directory. It applies to namespaces selected
+// from now on. An empty string is returned on success, otherwise the reason the file can't be used.
+func (c *Client) SetDiscoveryPath(path string) string {
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return err.Error()
+		}
+	}
+	previous := c.settings.DiscoveryPath
+	c.settings.DiscoveryPath = path
+	p, err := c.discoveryPath()
+	if err == nil {
+		_, err = loadDiscoveryConfig(p)
+	}
+	if err != nil {
+		c.settings.DiscoveryPath = previous
+		return err.Error()
+	}
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	c.log.Infof("discovery file set to %s", p)
+	return ""
+}
@@ -0,0 +1,166 @@
+package client
+
+import (
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCRDSourceServices(t *testing.T) {
+	rollout := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "checkout", "namespace": "shop"},
+		"spec": map[string]interface{}{"strategy": map[string]interface{}{
+			"canary": map[string]interface{}{"stableService": "checkout-stable", "canaryService": "checkout-canary"},
+		}},
+	}}
+	refs, url, err := argoRolloutsSource.services(rollout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0] != (serviceRef{namespace: "shop", name: "checkout-stable"}) || url != "" {
+		t.Errorf("expected the stable service of the canary rollout got %+v %s", refs, url)
+	}
+
+	custom := &crdSource{
+		Group: "example.com", Versions: []string{"v1"}, Resource: "webapps",
+		ServiceName: "{.spec.services[*].name}", ServicePort: "{.spec.services[*].port}", URL: "{.status.url}",
+	}
+	app := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "shop", "namespace": "shop"},
+		"spec": map[string]interface{}{"services": []interface{}{
+			map[string]interface{}{"name": "frontend", "port": int64(8080)},
+			map[string]interface{}{"name": "api", "port": "grpc"},
+		}},
+		"status": map[string]interface{}{"url": "https://shop.example.com"},
+	}}
+	refs, url, err = custom.services(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 || refs[0].port != "8080" || refs[1] != (serviceRef{namespace: "shop", name: "api", port: "grpc"}) {
+		t.Errorf("expected the ports to be paired with the services got %+v", refs)
+	}
+	if url != "https://shop.example.com" {
+		t.Errorf("unexpected url %s", url)
+	}
+}
+
+func TestVirtualServiceDestinations(t *testing.T) {
+	vs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "reviews", "namespace": "bookinfo"},
+		"spec": map[string]interface{}{
+			"hosts":    []interface{}{"reviews", "reviews.example.com"},
+			"gateways": []interface{}{"bookinfo-gateway"},
+			"http": []interface{}{map[string]interface{}{"route": []interface{}{
+				map[string]interface{}{"destination": map[string]interface{}{"host": "reviews", "port": map[string]interface{}{"number": int64(9080)}}},
+				map[string]interface{}{"destination": map[string]interface{}{"host": "ratings.other.svc.cluster.local"}},
+				map[string]interface{}{"destination": map[string]interface{}{"host": "api.example.com"}},
+			}}},
+		},
+	}}
+	refs := virtualServiceDestinations(vs)
+	if len(refs) != 2 {
+		t.Fatalf("expected the hosts outside of the cluster to be skipped got %+v", refs)
+	}
+	if refs[0] != (serviceRef{namespace: "bookinfo", name: "reviews", port: "9080"}) || refs[1] != (serviceRef{namespace: "other", name: "ratings"}) {
+		t.Errorf("unexpected destinations %+v", refs)
+	}
+	if url := virtualServiceURL(vs); url != "http://reviews.example.com/" {
+		t.Errorf("expected the host published through the gateway got %s", url)
+	}
+}
+
+func TestCandidateClaims(t *testing.T) {
+	controller := true
+	owner := []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "checkout-abc", Controller: &controller}}
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "checkout-abc-1", Namespace: "shop", Labels: map[string]string{"app": "checkout"}, OwnerReferences: owner},
+		Status:     v1.PodStatus{Phase: "Running"},
+	}
+	replica := pod
+	replica.Name = "checkout-abc-2"
+	scope := &discoveryScope{
+		namespace: "shop",
+		pods:      &v1.PodList{Items: []v1.Pod{pod}},
+		services: &v1.ServiceList{Items: []v1.Service{{
+			ObjectMeta: metav1.ObjectMeta{Name: "checkout-stable", Namespace: "shop"},
+			Spec: v1.ServiceSpec{Selector: map[string]string{"app": "checkout"}, Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
+				{Name: "metrics", Port: 9090, TargetPort: intstr.FromInt(9090)},
+			}},
+		}}},
+	}
+	fromRollout, ok := scope.serviceCandidates("shop", "checkout-stable", "http", "Rollout/checkout", "")
+	if !ok || len(fromRollout.candidates) != 1 || fromRollout.candidates[0].port != 8080 {
+		t.Fatalf("expected the http port of the service got %+v", fromRollout)
+	}
+
+	claims := newCandidateClaims()
+	if claimed := claims.claim(fromRollout); len(claimed) != 1 {
+		t.Fatalf("expected the first source to claim its candidate got %+v", claimed)
+	}
+	claims.sourceDone()
+	fromPods := podCandidates{pod: replica, candidates: []websiteCandidate{
+		{port: 8080, resourceName: "checkout-stable", resourceType: "service", servicePort: 80},
+		{port: 9090, resourceName: "checkout-stable", resourceType: "service", servicePort: 9090},
+	}}
+	claimed := claims.claim(fromPods)
+	if len(claimed) != 1 || claimed[0].port != 9090 {
+		t.Errorf("expected only the port not claimed by the rollout to remain got %+v", claimed)
+	}
+}
+
+func TestServiceCandidatesResolveNamedTargetPorts(t *testing.T) {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "checkout-abc-1", Namespace: "shop", Labels: map[string]string{"app": "checkout"}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Ports: []v1.ContainerPort{{Name: "web", ContainerPort: 8080}},
+		}}},
+		Status: v1.PodStatus{Phase: "Running"},
+	}
+	scope := &discoveryScope{
+		namespace: "shop",
+		pods:      &v1.PodList{Items: []v1.Pod{pod}},
+		services: &v1.ServiceList{Items: []v1.Service{{
+			ObjectMeta: metav1.ObjectMeta{Name: "checkout", Namespace: "shop"},
+			Spec: v1.ServiceSpec{Selector: map[string]string{"app": "checkout"}, Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromString("web")},
+				{Name: "metrics", Port: 9090, TargetPort: intstr.FromString("metrics")},
+			}},
+		}}},
+	}
+	pc, ok := scope.serviceCandidates("shop", "checkout", "", "Rollout/checkout", "")
+	if !ok || len(pc.candidates) != 1 || pc.candidates[0].port != 8080 || pc.candidates[0].servicePort != 80 {
+		t.Fatalf("expected the named target port to be resolved and the unknown one skipped got %+v", pc)
+	}
+	if _, ok := scope.serviceCandidates("shop", "checkout", "metrics", "Rollout/checkout", ""); ok {
+		t.Error("expected no candidates for a target port the pod doesn't have")
+	}
+}
+
+func TestLoadDiscoveryConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "discovery.json")
+
+	if config, err := loadDiscoveryConfig(path); err != nil || len(config.Sources) != 0 {
+		t.Errorf("expected no sources without a file got %+v %v", config, err)
+	}
+	ioutil.WriteFile(path, []byte(`{"disabled":["istio"],"sources":[{"group":"example.com","versions":["v1"],"resource":"webapps","serviceName":"{.spec.service"}]}`), 0600)
+	if _, err := loadDiscoveryConfig(path); err == nil {
+		t.Error("expected an invalid JSONPath to be rejected")
+	}
+	ioutil.WriteFile(path, []byte(`{"disabled":["istio"],"sources":[{"group":"example.com","versions":["v1"],"resource":"webapps","serviceName":"{.spec.service}"}]}`), 0600)
+	config, err := loadDiscoveryConfig(path)
+	if err != nil || len(config.Sources) != 1 || config.Sources[0].Name() != "webapps" || config.Disabled[0] != "istio" {
+		t.Errorf("unexpected config %+v %v", config, err)
+	}
+}
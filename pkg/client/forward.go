@@ -0,0 +1,332 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenLocal binds the given port on the address, or on both loopback addresses in the same way kubectl
+// port-forward does if the address is empty. An error is only returned if no address could be bound.
+func listenLocal(address string, port int32) ([]net.Listener, error) {
+	hosts := []string{"127.0.0.1", "::1"}
+	if address != "" {
+		hosts = []string{address}
+	}
+	var listeners []net.Listener
+	var lastErr error
+	for _, host := range hosts {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("unable to listen on port %d: %v", port, lastErr)
+	}
+	return listeners, nil
+}
+
+// serveListener accepts connections on l and hands them to handle until the listener is closed
+func serveListener(l net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				fmt.Fprintf(os.Stderr, "error accepting connection on %s: %v\n", l.Addr(), err)
+			}
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// openPodStream creates the error and data stream pair for a single connection to port on the pod.
+// The returned channel receives any error reported by the pod for this connection and is then closed.
+// based on k8s.io/client-go/tools/portforward
+func openPodStream(streamConn httpstream.Connection, port int32, requestID int64) (httpstream.Stream, <-chan error, error) {
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, fmt.Sprintf("%d", port))
+	headers.Set(v1.PortForwardRequestIDHeader, strconv.FormatInt(requestID, 10))
+	errorStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating error stream for port %d: %v", port, err)
+	}
+	// we're not writing to this stream
+	errorStream.Close()
+
+	errorChan := make(chan error, 1)
+	go func() {
+		message, err := ioutil.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errorChan <- fmt.Errorf("error reading from error stream for port %d: %v", port, err)
+		case len(message) > 0:
+			errorChan <- fmt.Errorf("an error occurred forwarding to port %d: %v", port, string(message))
+		}
+		close(errorChan)
+	}()
+
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+	dataStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating forwarding stream for port %d: %v", port, err)
+	}
+	return dataStream, errorChan, nil
+}
+
+// splice copies data between the local connection and the remote stream until the remote side is done or the local
+// side fails, counting the traffic in stats
+func splice(conn net.Conn, remote io.ReadWriteCloser, stats *trafficStats) {
+	localError := make(chan struct{})
+	remoteDone := make(chan struct{})
+
+	go func() {
+		// Copy from the remote side to the local port.
+		_, err := io.Copy(&countingWriter{w: conn, counter: &stats.bytesIn, stats: stats}, remote)
+		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			fmt.Fprintf(os.Stderr, "error copying from remote stream to local connection: %v\n", err)
+		}
+		// inform the select below that the remote copy is done
+		close(remoteDone)
+	}()
+
+	go func() {
+		// inform server we're not sending any more data after copy unblocks
+		defer remote.Close()
+		// Copy from the local port to the remote side.
+		_, err := io.Copy(&countingWriter{w: remote, counter: &stats.bytesOut, stats: stats}, conn)
+		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			fmt.Fprintf(os.Stderr, "error copying from local connection to remote stream: %v\n", err)
+			// break out of the select below without waiting for the other copy to finish
+			close(localError)
+		}
+	}()
+
+	select {
+	case <-remoteDone:
+	case <-localError:
+	}
+}
+
+// Tunnel states reported for a Website
+const (
+	tunnelActive  = "active"
+	tunnelDormant = "dormant"
+)
+
+// podTunnel owns the single connection to a pod which carries the streams of all of the pod's forwarded ports. For
+// lazy forwards the connection is only established when the first local connection arrives and is torn down again
+// once none of the ports have been used for idleTimeout. Discovery still opens the tunnel of a lazy forward once to
+// fetch the favicons of its ports and closes it right after, so loading a namespace briefly dials every pod.
+type podTunnel struct {
+	mu        sync.Mutex
+	conn      podConnection
+	idleTimer *time.Timer
+	dial      func() (podConnection, error)
+	// idleTimeout of 0 keeps the connection open for as long as any port is forwarded
+	idleTimeout time.Duration
+	// ports is the number of local ports currently served through the tunnel
+	ports int
+	// activeConnections is the number of local connections using the tunnel
+	activeConnections int
+	// dormant, if set, is called whenever the connection closed without being replaced by a new one
+	dormant func()
+}
+
+func newPodTunnel(conf *rest.Config, pod v1.Pod, transport string, idleTimeout time.Duration) *podTunnel {
+	return &podTunnel{
+		dial: func() (podConnection, error) {
+			return dialPod(conf, pod, transport)
+		},
+		idleTimeout: idleTimeout,
+	}
+}
+
+// connection returns the current connection to the pod, dialing a new one if the tunnel is dormant
+func (t *podTunnel) connection() (podConnection, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopIdleTimer()
+	if t.conn != nil {
+		return t.conn, nil
+	}
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	go func() {
+		<-conn.CloseChan()
+		t.mu.Lock()
+		if t.conn == conn {
+			t.conn = nil
+		}
+		dormant := t.conn == nil
+		t.mu.Unlock()
+		if dormant && t.dormant != nil {
+			t.dormant()
+		}
+	}()
+	return conn, nil
+}
+
+// opened is called whenever a local connection starts using the tunnel
+func (t *podTunnel) opened() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.activeConnections++
+	t.stopIdleTimer()
+}
+
+// released is called whenever a local connection finishes and schedules the tunnel to be reaped if it is now idle
+func (t *podTunnel) released() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.activeConnections--
+	if t.activeConnections > 0 || t.idleTimeout == 0 {
+		return
+	}
+	t.stopIdleTimer()
+	t.idleTimer = time.AfterFunc(t.idleTimeout, t.reapIfIdle)
+}
+
+// reapIfIdle closes the tunnel unless a connection was opened since the idle timer was started. The check holds the
+// same lock as opened so a connection can't slip in between the check and the close.
+func (t *podTunnel) reapIfIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.activeConnections > 0 {
+		return
+	}
+	t.closeLocked()
+}
+
+// acquire registers a local port being served through the tunnel
+func (t *podTunnel) acquire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ports++
+}
+
+// release unregisters a local port and closes the tunnel once no ports are left
+func (t *podTunnel) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ports--
+	if t.ports == 0 {
+		t.closeLocked()
+	}
+}
+
+// close tears down the connection to the pod, leaving the tunnel dormant
+func (t *podTunnel) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closeLocked()
+}
+
+func (t *podTunnel) closeLocked() {
+	t.stopIdleTimer()
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+func (t *podTunnel) stopIdleTimer() {
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+		t.idleTimer = nil
+	}
+}
+
+func (t *podTunnel) state() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return tunnelDormant
+	}
+	return tunnelActive
+}
+
+// handlePodConnection forwards a single accepted local connection to the pod through the tunnel
+func handlePodConnection(conn net.Conn, req portForwardPodRequest) {
+	defer conn.Close()
+	req.Stats.connectionOpened()
+	req.Tunnel.opened()
+	defer req.Tunnel.released()
+	defer req.Stats.connectionClosed()
+
+	podConn, err := req.Tunnel.connection()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening tunnel to pod %s: %v\n", req.Pod.Name, err)
+		return
+	}
+	dataStream, errorChan, err := podConn.openStream(req.PodPort)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	splice(conn, dataStream, req.Stats)
+
+	// always expect something on errorChan (it may be nil)
+	if err := <-errorChan; err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// forwardThroughTunnel serves the local port of req through req.Tunnel until req.StopCh is closed. Unless the
+// tunnel is lazy it is opened up front and losing it also ends the forward.
+func forwardThroughTunnel(req portForwardPodRequest) error {
+	tunnel := req.Tunnel
+	tunnel.acquire()
+	defer tunnel.release()
+
+	var lostCh <-chan bool
+	if tunnel.idleTimeout == 0 {
+		podConn, err := tunnel.connection()
+		if err != nil {
+			return err
+		}
+		lostCh = podConn.CloseChan()
+	}
+
+	listeners, err := req.listen()
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		go serveListener(l, func(conn net.Conn) {
+			handlePodConnection(conn, req)
+		})
+	}
+	close(req.ReadyCh)
+
+	lost := false
+	select {
+	case <-req.StopCh:
+	case <-lostCh:
+		lost = true
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	if lost {
+		return fmt.Errorf("lost connection to pod %s", req.Pod.Name)
+	}
+	return nil
+}
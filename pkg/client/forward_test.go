@@ -0,0 +1,284 @@
+package client
+
+import (
+	"github.com/phayes/freeport"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePodConnection stands in for the connection to a pod, every stream is a tcp connection to a local echo server
+type fakePodConnection struct {
+	echo      net.Listener
+	closeCh   chan bool
+	closeOnce sync.Once
+}
+
+func newFakePodConnection(t *testing.T) *fakePodConnection {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveListener(l, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	return &fakePodConnection{echo: l, closeCh: make(chan bool)}
+}
+
+func (f *fakePodConnection) openStream(port int32) (io.ReadWriteCloser, <-chan error, error) {
+	conn, err := net.Dial("tcp", f.echo.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	errorChan := make(chan error)
+	close(errorChan)
+	return conn, errorChan, nil
+}
+
+func (f *fakePodConnection) CloseChan() <-chan bool {
+	return f.closeCh
+}
+
+func (f *fakePodConnection) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closeCh)
+		f.echo.Close()
+	})
+	return nil
+}
+
+func (f *fakePodConnection) closed() bool {
+	select {
+	case <-f.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// echoThroughPod sends a message through a local connection handled like an accepted one and waits for the echo
+func echoThroughPod(t *testing.T, req portForwardPodRequest, message string) net.Conn {
+	local, accepted := net.Pipe()
+	go handlePodConnection(accepted, req)
+	if _, err := local.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(local, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != message {
+		t.Errorf("expected %s got %s", message, buf)
+	}
+	return local
+}
+
+func TestHandlePodConnectionCountsTraffic(t *testing.T) {
+	fake := newFakePodConnection(t)
+	defer fake.Close()
+	stats := &trafficStats{}
+	req := portForwardPodRequest{Pod: testPod, PodPort: 8080, Stats: stats, Tunnel: &podTunnel{
+		dial: func() (podConnection, error) {
+			return fake, nil
+		},
+	}}
+
+	local := echoThroughPod(t, req, "hello")
+	if snapshot := stats.snapshot(); snapshot.ActiveConnections != 1 || snapshot.TotalConnections != 1 {
+		t.Errorf("expected one open connection got %+v", snapshot)
+	}
+	local.Close()
+	local = echoThroughPod(t, req, "bye")
+	local.Close()
+	if !stats.waitForIdle(time.Second) {
+		t.Fatal("expected the connections to close")
+	}
+	snapshot := stats.snapshot()
+	if snapshot.TotalConnections != 2 || snapshot.BytesOut != 8 || snapshot.BytesIn != 8 || snapshot.LastActivity == nil {
+		t.Errorf("expected the traffic of both connections to be counted got %+v", snapshot)
+	}
+
+	stats.resetTotals()
+	if snapshot := stats.snapshot(); snapshot.TotalConnections != 0 || snapshot.BytesIn != 0 || snapshot.LastActivity != nil {
+		t.Errorf("expected the totals to be reset got %+v", snapshot)
+	}
+}
+
+func TestWaitForIdleTimesOut(t *testing.T) {
+	stats := &trafficStats{}
+	stats.connectionOpened()
+	if stats.waitForIdle(20 * time.Millisecond) {
+		t.Error("expected an open connection not to be idle")
+	}
+	stats.resetTotals()
+	if snapshot := stats.snapshot(); snapshot.ActiveConnections != 1 {
+		t.Errorf("expected the reset to keep open connections got %+v", snapshot)
+	}
+}
+
+// countingDialer returns a new fake connection to the pod on every dial and counts the dials
+type countingDialer struct {
+	t     *testing.T
+	mu    sync.Mutex
+	conns []*fakePodConnection
+}
+
+func (d *countingDialer) dial() (podConnection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conn := newFakePodConnection(d.t)
+	d.conns = append(d.conns, conn)
+	return conn, nil
+}
+
+func (d *countingDialer) dials() []*fakePodConnection {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*fakePodConnection(nil), d.conns...)
+}
+
+func waitForState(t *testing.T, tunnel *podTunnel, state string) {
+	deadline := time.Now().Add(time.Second)
+	for tunnel.state() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the tunnel to be %s", state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLazyTunnelIsReapedWhenIdle(t *testing.T) {
+	dialer := &countingDialer{t: t}
+	tunnel := &podTunnel{dial: dialer.dial, idleTimeout: 20 * time.Millisecond}
+	req := portForwardPodRequest{Pod: testPod, PodPort: 8080, Stats: &trafficStats{}, Tunnel: tunnel}
+	if tunnel.state() != tunnelDormant {
+		t.Error("expected a lazy tunnel to start dormant")
+	}
+
+	local := echoThroughPod(t, req, "hello")
+	if tunnel.state() != tunnelActive {
+		t.Error("expected the first connection to open the tunnel")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if tunnel.state() != tunnelActive {
+		t.Error("expected an open connection to keep the tunnel")
+	}
+	local.Close()
+	waitForState(t, tunnel, tunnelDormant)
+	if conns := dialer.dials(); len(conns) != 1 || !conns[0].closed() {
+		t.Errorf("expected the idle connection to the pod to be closed got %d dials", len(conns))
+	}
+
+	local = echoThroughPod(t, req, "again")
+	defer local.Close()
+	if conns := dialer.dials(); len(conns) != 2 {
+		t.Errorf("expected a new connection after reaping got %d dials", len(conns))
+	}
+}
+
+func TestReapIfIdleKeepsOpenedTunnel(t *testing.T) {
+	dialer := &countingDialer{t: t}
+	tunnel := &podTunnel{dial: dialer.dial, idleTimeout: time.Hour}
+	if _, err := tunnel.connection(); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.opened()
+	// the idle timer of an earlier connection fires after a new one was accepted
+	tunnel.reapIfIdle()
+	if tunnel.state() != tunnelActive {
+		t.Error("expected a tunnel with an open connection not to be reaped")
+	}
+	tunnel.released()
+	tunnel.reapIfIdle()
+	if tunnel.state() != tunnelDormant {
+		t.Error("expected the idle tunnel to be reaped")
+	}
+}
+
+// startTunnelForward forwards a free local port through the tunnel, returning the request once it is ready
+func startTunnelForward(t *testing.T, tunnel *podTunnel, podPort int32) (portForwardPodRequest, <-chan error) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := portForwardPodRequest{
+		Pod:          testPod,
+		LocalAddress: "127.0.0.1",
+		LocalPort:    int32(port),
+		PodPort:      podPort,
+		StopCh:       make(chan struct{}),
+		ReadyCh:      make(chan struct{}),
+		Stats:        &trafficStats{},
+		Tunnel:       tunnel,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- forwardThroughTunnel(req)
+	}()
+	select {
+	case <-req.ReadyCh:
+	case err := <-errCh:
+		t.Fatal(err)
+	}
+	return req, errCh
+}
+
+func TestTunnelIsSharedByAllPortsOfAPod(t *testing.T) {
+	dialer := &countingDialer{t: t}
+	tunnel := &podTunnel{dial: dialer.dial}
+	web, webErr := startTunnelForward(t, tunnel, 8080)
+	metrics, metricsErr := startTunnelForward(t, tunnel, 9090)
+	for _, req := range []portForwardPodRequest{web, metrics} {
+		conn, err := net.Dial("tcp", req.localHostPort())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("expected an echo on port %d got %s %v", req.PodPort, buf, err)
+		}
+		conn.Close()
+	}
+	conns := dialer.dials()
+	if len(conns) != 1 {
+		t.Fatalf("expected both ports to share a single connection got %d", len(conns))
+	}
+
+	close(web.StopCh)
+	if err := <-webErr; err != nil {
+		t.Errorf("expected a clean stop got %v", err)
+	}
+	if conns[0].closed() || tunnel.state() != tunnelActive {
+		t.Error("expected the tunnel to stay open while a port is still forwarded")
+	}
+	close(metrics.StopCh)
+	if err := <-metricsErr; err != nil {
+		t.Errorf("expected a clean stop got %v", err)
+	}
+	if !conns[0].closed() || tunnel.state() != tunnelDormant {
+		t.Error("expected the tunnel to be closed once its last port was released")
+	}
+}
+
+func TestLosingTheTunnelEndsItsForwards(t *testing.T) {
+	dialer := &countingDialer{t: t}
+	tunnel := &podTunnel{dial: dialer.dial}
+	_, webErr := startTunnelForward(t, tunnel, 8080)
+	_, metricsErr := startTunnelForward(t, tunnel, 9090)
+	dialer.dials()[0].Close()
+	for _, errCh := range []<-chan error{webErr, metricsErr} {
+		select {
+		case err := <-errCh:
+			if err == nil || !strings.Contains(err.Error(), "lost connection to pod web") {
+				t.Errorf("expected the lost connection to be reported got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the forward to end with its tunnel")
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// headerValueTTL is how long values of secrets and the keyring are used before they are read again
+	headerValueTTL = time.Minute
+	// tokenRefreshMargin is how long before they expire tokens of service accounts are requested again
+	tokenRefreshMargin           = time.Minute
+	defaultTokenExpiration int64 = 3600
+)
+
+// headerRule sets a header on every request to a website. Only the reference to the value is persisted, the value
+// itself is read when needed and never logged.
+type headerRule struct {
+	Name string `json:"name"`
+	// Prefix is put in front of the value, e.g. "Bearer "
+	Prefix         string               `json:"prefix,omitempty"`
+	Secret         *secretValue         `json:"secret,omitempty"`
+	ServiceAccount *serviceAccountToken `json:"serviceAccount,omitempty"`
+	Keyring        *keyringEntry        `json:"keyring,omitempty"`
+}
+
+// secretValue references a key of a Secret. With a UsernameKey the value is basic auth credentials of the username
+// and the password in Key instead.
+type secretValue struct {
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Key         string `json:"key"`
+	UsernameKey string `json:"usernameKey,omitempty"`
+}
+
+// serviceAccountToken is a token requested for a ServiceAccount with the TokenRequest API
+type serviceAccountToken struct {
+	Namespace         string   `json:"namespace"`
+	Name              string   `json:"name"`
+	Audiences         []string `json:"audiences,omitempty"`
+	ExpirationSeconds int64    `json:"expirationSeconds,omitempty"`
+}
+
+// keyringEntry references a generic password in the keyring of the OS
+type keyringEntry struct {
+	Service string `json:"service"`
+	Account string `json:"account"`
+}
+
+func (r headerRule) validate() error {
+	if r.Name == "" {
+		return errors.New("header rules need a name")
+	}
+	sources := 0
+	if r.Secret != nil {
+		sources++
+	}
+	if r.ServiceAccount != nil {
+		sources++
+	}
+	if r.Keyring != nil {
+		sources++
+	}
+	if sources != 1 {
+		return fmt.Errorf("the value of header %s needs to come from exactly one of a secret, a service account or the keyring", r.Name)
+	}
+	return nil
+}
+
+// keyringLookup reads an entry of the keyring, it is replaced in tests
+var keyringLookup = lookupKeyring
+
+// lookupKeyring reads a generic password with the keyring tool of the OS
+func lookupKeyring(service string, account string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	default:
+		return "", fmt.Errorf("reading the keyring isn't supported on %s", runtime.GOOS)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("no keyring entry for service %s and account %s: %v", service, account, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+type cachedValue struct {
+	value   string
+	expires time.Time
+}
+
+// headerInjector sets the headers of its rules on requests, caching their values
+type headerInjector struct {
+	rules []headerRule
+	s     kubernetes.Interface
+	mu    sync.Mutex
+	// cache holds the values by the index of their rule
+	cache map[int]cachedValue
+}
+
+func newHeaderInjector(rules []headerRule, s kubernetes.Interface) *headerInjector {
+	return &headerInjector{rules: rules, s: s, cache: map[int]cachedValue{}}
+}
+
+// value returns the value of the rule, reading it again once the cached one expired
+func (h *headerInjector) value(i int) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cached, ok := h.cache[i]; ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+	rule := h.rules[i]
+	var value string
+	var err error
+	expires := time.Now().Add(headerValueTTL)
+	switch {
+	case rule.Secret != nil:
+		value, err = h.secretValue(rule.Secret)
+	case rule.ServiceAccount != nil:
+		value, expires, err = h.serviceAccountToken(rule.ServiceAccount)
+	case rule.Keyring != nil:
+		value, err = keyringLookup(rule.Keyring.Service, rule.Keyring.Account)
+	}
+	if err != nil {
+		return "", err
+	}
+	value = rule.Prefix + value
+	h.cache[i] = cachedValue{value: value, expires: expires}
+	return value, nil
+}
+
+func (h *headerInjector) secretValue(ref *secretValue) (string, error) {
+	if h.s == nil {
+		return "", errors.New("not connected to a cluster")
+	}
+	secret, err := h.s.CoreV1().Secrets(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	password, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %s", ref.Namespace, ref.Name, ref.Key)
+	}
+	if ref.UsernameKey == "" {
+		return string(password), nil
+	}
+	username, ok := secret.Data[ref.UsernameKey]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %s", ref.Namespace, ref.Name, ref.UsernameKey)
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(string(username)+":"+string(password))), nil
+}
+
+func (h *headerInjector) serviceAccountToken(ref *serviceAccountToken) (string, time.Time, error) {
+	if h.s == nil {
+		return "", time.Time{}, errors.New("not connected to a cluster")
+	}
+	expiration := ref.ExpirationSeconds
+	if expiration == 0 {
+		expiration = defaultTokenExpiration
+	}
+	tr, err := h.s.CoreV1().ServiceAccounts(ref.Namespace).CreateToken(ref.Name, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{Audiences: ref.Audiences, ExpirationSeconds: &expiration},
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tr.Status.Token, tr.Status.ExpirationTimestamp.Add(-tokenRefreshMargin), nil
+}
+
+// handler sets the headers on requests before passing them to next. Requests fail if a value can't be read, the error
+// only names the reference and never the value.
+func (h *headerInjector) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, rule := range h.rules {
+			value, err := h.value(i)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("failed to read the value of header %s: %v", rule.Name, err), http.StatusBadGateway)
+				return
+			}
+			r.Header.Set(rule.Name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetWebsiteHeaders serves the website on localAddress:localPort through a proxy setting headers on every request.
+// The headers are a json list of rules, each with a name, an optional prefix and the value's source - a secret
+// reference {namespace, name, key}, a service account {namespace, name, audiences} to request a token for or a keyring
+// entry {service, account}. An empty list removes the headers again. An empty string is returned on success, otherwise
+// the reason they couldn't be set.
+func (c *Client) SetWebsiteHeaders(localAddress string, localPort int, headers string) string {
+	var rules []headerRule
+	if headers != "" {
+		if err := json.Unmarshal([]byte(headers), &rules); err != nil {
+			return fmt.Sprintf("invalid header rules: %v", err)
+		}
+	}
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err.Error()
+		}
+	}
+	return c.updateWebsiteRules(localAddress, localPort, func(wr *websiteRules) error {
+		wr.Headers = rules
+		return nil
+	})
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"encoding/base64"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeaderInjector(t *testing.T) {
+	s := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "prometheus-auth", Namespace: "monitoring"},
+		Data:       map[string][]byte{"user": []byte("admin"), "password": []byte("hunter2")},
+	})
+	tokenRequests := 0
+	s.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		tokenRequests++
+		return true, &authenticationv1.TokenRequest{Status: authenticationv1.TokenRequestStatus{
+			Token:               "sa-token",
+			ExpirationTimestamp: metav1.NewTime(time.Now().Add(time.Hour)),
+		}}, nil
+	})
+	defer func(lookup func(string, string) (string, error)) { keyringLookup = lookup }(keyringLookup)
+	keyringLookup = func(service string, account string) (string, error) {
+		return service + "-" + account, nil
+	}
+
+	injector := newHeaderInjector([]headerRule{
+		{Name: "Authorization", Secret: &secretValue{Namespace: "monitoring", Name: "prometheus-auth", Key: "password", UsernameKey: "user"}},
+		{Name: "X-Token", Prefix: "Bearer ", ServiceAccount: &serviceAccountToken{Namespace: "monitoring", Name: "grafana"}},
+		{Name: "X-Api-Key", Keyring: &keyringEntry{Service: "api", Account: "me"}},
+	}, s)
+	var received http.Header
+	handler := injector.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:hunter2"))
+	for name, expected := range map[string]string{"Authorization": basic, "X-Token": "Bearer sa-token", "X-Api-Key": "api-me"} {
+		if actual := received.Get(name); actual != expected {
+			t.Errorf("expected header %s to be %s got %s", name, expected, actual)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("expected the token to be requested once got %d", tokenRequests)
+	}
+}
+
+func TestHeaderInjectorMissingSecret(t *testing.T) {
+	injector := newHeaderInjector([]headerRule{
+		{Name: "Authorization", Secret: &secretValue{Namespace: "monitoring", Name: "missing", Key: "token"}},
+	}, fake.NewSimpleClientset())
+	rec := httptest.NewRecorder()
+	injector.handler(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected the request to fail got %d", rec.Code)
+	}
+}
+
+func TestHeaderRuleValidate(t *testing.T) {
+	if err := (headerRule{Name: "X-Token"}).validate(); err == nil {
+		t.Error("expected a rule without a source to be invalid")
+	}
+	rule := headerRule{Name: "X-Token", Keyring: &keyringEntry{}, Secret: &secretValue{}}
+	if err := rule.validate(); err == nil {
+		t.Error("expected a rule with two sources to be invalid")
+	}
+}
@@ -0,0 +1,360 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"portfall/pkg/sniff"
+	"sync"
+	"time"
+)
+
+const (
+	// inspectorCapacity is the number of exchanges kept per website, older ones are overwritten
+	inspectorCapacity = 500
+	// defaultBodyLimit is how much of each body is captured when bodies are recorded without a limit
+	defaultBodyLimit = 64 * 1024
+)
+
+// HTTPExchange is the recorded metadata of a request to a website and its response
+type HTTPExchange struct {
+	StartedAt       time.Time   `json:"startedAt"`
+	DurationMs      float64     `json:"durationMs"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	Proto           string      `json:"proto"`
+	Status          int         `json:"status"`
+	RequestHeaders  http.Header `json:"requestHeaders"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+	RequestSize     int64       `json:"requestSize"`
+	ResponseSize    int64       `json:"responseSize"`
+	// RequestBody and ResponseBody are only recorded when capturing bodies, up to the body limit
+	RequestBody  string `json:"requestBody,omitempty"`
+	ResponseBody string `json:"responseBody,omitempty"`
+}
+
+// httpInspector records the exchanges of a website in a ring buffer
+type httpInspector struct {
+	mu        sync.Mutex
+	enabled   bool
+	bodyLimit int
+	exchanges []HTTPExchange
+	// next is the index the next exchange is recorded at once the buffer is full
+	next int
+}
+
+func newHTTPInspector() *httpInspector {
+	return &httpInspector{exchanges: make([]HTTPExchange, 0, inspectorCapacity)}
+}
+
+// configure turns recording on or off, capturing bodies up to bodyLimit bytes if it is positive
+func (in *httpInspector) configure(enabled bool, bodyLimit int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.enabled = enabled
+	in.bodyLimit = bodyLimit
+}
+
+func (in *httpInspector) settings() (bool, int) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.enabled, in.bodyLimit
+}
+
+func (in *httpInspector) record(ex HTTPExchange) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.exchanges) < inspectorCapacity {
+		in.exchanges = append(in.exchanges, ex)
+		return
+	}
+	in.exchanges[in.next] = ex
+	in.next = (in.next + 1) % inspectorCapacity
+}
+
+// recorded returns the recorded exchanges, oldest first
+func (in *httpInspector) recorded() []HTTPExchange {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	exchanges := make([]HTTPExchange, 0, len(in.exchanges))
+	exchanges = append(exchanges, in.exchanges[in.next:]...)
+	return append(exchanges, in.exchanges[:in.next]...)
+}
+
+func (in *httpInspector) clear() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.exchanges = in.exchanges[:0]
+	in.next = 0
+}
+
+// capture keeps up to limit bytes written to it and counts all of them
+type capture struct {
+	buf   []byte
+	limit int
+	n     int64
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	if room := c.limit - len(c.buf); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		c.buf = append(c.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// captureBody tees what is read from the body into the capture
+type captureBody struct {
+	io.ReadCloser
+	capture *capture
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.capture.Write(p[:n])
+	return n, err
+}
+
+// recordingWriter records the status and body of a response while writing it
+type recordingWriter struct {
+	http.ResponseWriter
+	status  int
+	capture *capture
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.capture.Write(p[:n])
+	return n, err
+}
+
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets upgraded connections such as websockets through, their traffic isn't recorded
+func (w *recordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response can't be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// handler records the exchanges passing through to next while enabled. It sees requests before any headers are
+// injected so that injected credentials are never recorded.
+func (in *httpInspector) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enabled, bodyLimit := in.settings()
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ex := HTTPExchange{
+			StartedAt:      time.Now(),
+			Method:         r.Method,
+			URL:            "http://" + r.Host + r.URL.RequestURI(),
+			Proto:          r.Proto,
+			RequestHeaders: r.Header.Clone(),
+		}
+		reqCapture := &capture{limit: bodyLimit}
+		if r.Body != nil {
+			r.Body = &captureBody{ReadCloser: r.Body, capture: reqCapture}
+		}
+		rec := &recordingWriter{ResponseWriter: w, capture: &capture{limit: bodyLimit}}
+		next.ServeHTTP(rec, r)
+
+		ex.DurationMs = float64(time.Since(ex.StartedAt)) / float64(time.Millisecond)
+		ex.Status = rec.status
+		ex.ResponseHeaders = w.Header().Clone()
+		ex.RequestSize = reqCapture.n
+		ex.ResponseSize = rec.capture.n
+		ex.RequestBody = string(reqCapture.buf)
+		ex.ResponseBody = string(rec.capture.buf)
+		in.record(ex)
+	})
+}
+
+// harNameValue is a header or query parameter of a HAR entry
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// har converts the exchanges into an HTTP Archive 1.2 document
+func har(exchanges []HTTPExchange) map[string]interface{} {
+	entries := make([]map[string]interface{}, 0, len(exchanges))
+	for _, ex := range exchanges {
+		request := map[string]interface{}{
+			"method":      ex.Method,
+			"url":         ex.URL,
+			"httpVersion": ex.Proto,
+			"cookies":     []interface{}{},
+			"headers":     harHeaders(ex.RequestHeaders),
+			"queryString": []interface{}{},
+			"headersSize": -1,
+			"bodySize":    ex.RequestSize,
+		}
+		if ex.RequestBody != "" {
+			request["postData"] = map[string]interface{}{
+				"mimeType": ex.RequestHeaders.Get("Content-Type"),
+				"text":     ex.RequestBody,
+			}
+		}
+		content := map[string]interface{}{
+			"size":     ex.ResponseSize,
+			"mimeType": ex.ResponseHeaders.Get("Content-Type"),
+		}
+		if ex.ResponseBody != "" {
+			content["text"] = ex.ResponseBody
+		}
+		entries = append(entries, map[string]interface{}{
+			"startedDateTime": ex.StartedAt.Format(time.RFC3339Nano),
+			"time":            ex.DurationMs,
+			"request":         request,
+			"response": map[string]interface{}{
+				"status":      ex.Status,
+				"statusText":  http.StatusText(ex.Status),
+				"httpVersion": ex.Proto,
+				"cookies":     []interface{}{},
+				"headers":     harHeaders(ex.ResponseHeaders),
+				"content":     content,
+				"redirectURL": ex.ResponseHeaders.Get("Location"),
+				"headersSize": -1,
+				"bodySize":    ex.ResponseSize,
+			},
+			"cache":   map[string]interface{}{},
+			"timings": map[string]interface{}{"send": 0, "wait": ex.DurationMs, "receive": 0},
+		})
+	}
+	return map[string]interface{}{
+		"log": map[string]interface{}{
+			"version": "1.2",
+			"creator": map[string]interface{}{"name": "Portfall", "version": ""},
+			"entries": entries,
+		},
+	}
+}
+
+// inspectedWebsite returns the website on localAddress:localPort, the caller must hold c.mu
+func (c *Client) inspectedWebsite(localAddress string, localPort int) (*Website, error) {
+	for _, w := range c.websites {
+		if w.LocalAddress == localAddress && int(w.LocalPort) == localPort {
+			if w.inspector == nil {
+				return nil, fmt.Errorf("website on port %d was never inspected", localPort)
+			}
+			return w, nil
+		}
+	}
+	return nil, fmt.Errorf("no website on port %d", localPort)
+}
+
+// SetWebsiteInspection records the http exchanges of the website on localAddress:localPort while enabled. The website
+// is served through its proxy url for that, only requests sent there are recorded. With captureBodies the bodies are
+// recorded up to bodyLimit bytes as well. Disabling keeps what was recorded. An empty string is returned on success,
+// otherwise the reason inspection couldn't be set.
+func (c *Client) SetWebsiteInspection(localAddress string, localPort int, enabled bool, captureBodies bool, bodyLimit int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !captureBodies {
+		bodyLimit = 0
+	} else if bodyLimit <= 0 {
+		bodyLimit = defaultBodyLimit
+	}
+	for _, w := range c.websites {
+		if w.LocalAddress != localAddress || int(w.LocalPort) != localPort {
+			continue
+		}
+		if w.Protocol != sniff.HTTP {
+			return errNotHTTP(w).Error()
+		}
+		if w.inspector == nil {
+			w.inspector = newHTTPInspector()
+			w.inspector.configure(enabled, bodyLimit)
+			if err := c.applyWebsiteRules(w); err != nil {
+				c.log.Warnf("failed to serve website on port %d through a proxy: %v", localPort, err)
+				return err.Error()
+			}
+		}
+		w.inspector.configure(enabled, bodyLimit)
+		w.Inspecting = enabled
+		return ""
+	}
+	return fmt.Sprintf("no website on port %d", localPort)
+}
+
+// GetWebsiteExchanges returns a json list of the http exchanges recorded for the website on localAddress:localPort
+func (c *Client) GetWebsiteExchanges(localAddress string, localPort int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	w, err := c.inspectedWebsite(localAddress, localPort)
+	if err != nil {
+		return "[]"
+	}
+	jBytes, _ := json.Marshal(w.inspector.recorded())
+	return string(jBytes)
+}
+
+// ClearWebsiteExchanges drops the http exchanges recorded for the website on localAddress:localPort
+func (c *Client) ClearWebsiteExchanges(localAddress string, localPort int) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if w, err := c.inspectedWebsite(localAddress, localPort); err == nil {
+		w.inspector.clear()
+	}
+}
+
+// ExportWebsiteHAR writes the http exchanges recorded for the website on localAddress:localPort to path as a HAR
+// file. An empty string is returned on success, otherwise the reason it couldn't be exported.
+func (c *Client) ExportWebsiteHAR(localAddress string, localPort int, path string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	w, err := c.inspectedWebsite(localAddress, localPort)
+	if err != nil {
+		return err.Error()
+	}
+	if path == "" {
+		return "no path to export the HAR file to"
+	}
+	jBytes, err := json.MarshalIndent(har(w.inspector.recorded()), "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	if err := ioutil.WriteFile(path, jBytes, 0600); err != nil {
+		return err.Error()
+	}
+	return ""
+}
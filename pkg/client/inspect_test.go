@@ -0,0 +1,103 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPInspectorRingBuffer(t *testing.T) {
+	in := newHTTPInspector()
+	for i := 0; i < inspectorCapacity+3; i++ {
+		in.record(HTTPExchange{Status: i})
+	}
+	recorded := in.recorded()
+	if len(recorded) != inspectorCapacity {
+		t.Fatalf("expected %d exchanges got %d", inspectorCapacity, len(recorded))
+	}
+	if recorded[0].Status != 3 || recorded[len(recorded)-1].Status != inspectorCapacity+2 {
+		t.Errorf("expected the oldest exchanges to be overwritten got %d to %d", recorded[0].Status, recorded[len(recorded)-1].Status)
+	}
+}
+
+func TestWebsiteProxyInspection(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"echo":"` + string(body) + `"}`))
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	localPort, _ := strconv.Atoi(port)
+	defer func(lookup func(string, string) (string, error)) { keyringLookup = lookup }(keyringLookup)
+	keyringLookup = func(string, string) (string, error) {
+		return "secret", nil
+	}
+
+	w := &Website{LocalPort: int32(localPort), inspector: newHTTPInspector()}
+	w.inspector.configure(true, 8)
+	p, err := startWebsiteProxy(w, &websiteRules{
+		Headers: []headerRule{{Name: "X-Api-Key", Keyring: &keyringEntry{Service: "api", Account: "me"}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+
+	resp, err := http.Post(p.url+"/items?page=2", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// the exchange is recorded once the proxy finished the response, which may be after the client read it
+	recorded := w.inspector.recorded()
+	for i := 0; i < 100 && len(recorded) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		recorded = w.inspector.recorded()
+	}
+	if len(recorded) != 1 {
+		t.Fatalf("expected one exchange got %d", len(recorded))
+	}
+	ex := recorded[0]
+	if ex.Method != "POST" || !strings.HasSuffix(ex.URL, "/items?page=2") || ex.Status != http.StatusCreated {
+		t.Errorf("unexpected exchange %s %s %d", ex.Method, ex.URL, ex.Status)
+	}
+	if ex.RequestSize != 5 || ex.RequestBody != "hello" || ex.ResponseSize != 16 || ex.ResponseBody != `{"echo":` {
+		t.Errorf("unexpected bodies %d %q %d %q", ex.RequestSize, ex.RequestBody, ex.ResponseSize, ex.ResponseBody)
+	}
+	if ex.RequestHeaders.Get("X-Api-Key") != "" {
+		t.Error("expected injected headers not to be recorded")
+	}
+
+	var doc struct {
+		Log struct {
+			Version string `json:"version"`
+			Entries []struct {
+				Request struct {
+					Method string `json:"method"`
+				} `json:"request"`
+				Response struct {
+					Status int `json:"status"`
+				} `json:"response"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	jBytes, _ := json.Marshal(har(recorded))
+	if err := json.Unmarshal(jBytes, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Log.Version != "1.2" || len(doc.Log.Entries) != 1 || doc.Log.Entries[0].Response.Status != http.StatusCreated {
+		t.Errorf("unexpected HAR %s", jBytes)
+	}
+}
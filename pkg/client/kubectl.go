@@ -0,0 +1,193 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/phayes/freeport"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const backendKubectl = "kubectl"
+
+// kubectlForwardingLine matches the readiness output of kubectl port-forward, e.g.
+// "Forwarding from 127.0.0.1:34567 -> 8080"
+var kubectlForwardingLine = regexp.MustCompile(`^Forwarding from 127\.0\.0\.1:(\d+) -> (\d+)`)
+
+// parseKubectlForwardingLine returns the local and remote port of a kubectl port-forward readiness line
+func parseKubectlForwardingLine(line string) (local int, remote int, ok bool) {
+	m := kubectlForwardingLine.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return 0, 0, false
+	}
+	local, _ = strconv.Atoi(m[1])
+	remote, _ = strconv.Atoi(m[2])
+	return local, remote, true
+}
+
+// kubectlForwarder supervises a kubectl port-forward process which forwards all ports of a pod to internal local
+// ports. Portfall still owns the website's local listener and relays every connection to the internal port.
+type kubectlForwarder struct {
+	cmd *exec.Cmd
+	// ports maps pod ports to the internal ports kubectl listens on
+	ports map[int32]int
+	// ready is closed once kubectl reported all ports as forwarded
+	ready chan struct{}
+	// exited is closed once the process ended, with err describing why
+	exited chan struct{}
+	err    error
+	stderr bytes.Buffer
+	mu     sync.Mutex
+	// users is the number of websites still relying on the process
+	users int
+}
+
+// startKubectlForwarder runs kubectl port-forward for the given ports of the pod using the kubeconfig and context
+func startKubectlForwarder(kubectl string, kubeconfig string, context string, pod v1.Pod, podPorts []int32) (*kubectlForwarder, error) {
+	if kubectl == "" {
+		kubectl = "kubectl"
+	}
+	f := &kubectlForwarder{
+		ports:  map[int32]int{},
+		ready:  make(chan struct{}),
+		exited: make(chan struct{}),
+		users:  len(podPorts),
+	}
+	args := []string{"port-forward", "--kubeconfig", kubeconfig, "--context", context, "--namespace", pod.Namespace,
+		"--address", "127.0.0.1", "pod/" + pod.Name}
+	for _, p := range podPorts {
+		internal, err := freeport.GetFreePort()
+		if err != nil {
+			return nil, err
+		}
+		f.ports[p] = internal
+		args = append(args, fmt.Sprintf("%d:%d", internal, p))
+	}
+	f.cmd = exec.Command(kubectl, args...)
+	f.cmd.Stderr = &f.stderr
+	stdout, err := f.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go f.watchOutput(stdout)
+	go func() {
+		err := f.cmd.Wait()
+		f.mu.Lock()
+		f.err = fmt.Errorf("kubectl port-forward to pod %s exited: %v %s", pod.Name, err, strings.TrimSpace(f.stderr.String()))
+		f.mu.Unlock()
+		close(f.exited)
+	}()
+	return f, nil
+}
+
+// watchOutput closes f.ready once kubectl has reported every port as forwarded
+func (f *kubectlForwarder) watchOutput(stdout io.Reader) {
+	pending := len(f.ports)
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		local, _, ok := parseKubectlForwardingLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		for _, internal := range f.ports {
+			if internal == local {
+				pending--
+			}
+		}
+		if pending == 0 {
+			close(f.ready)
+			break
+		}
+	}
+	// keep draining so kubectl never blocks on a full pipe
+	io.Copy(ioutil.Discard, stdout)
+}
+
+func (f *kubectlForwarder) exitError() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// release is called once per port when its website stops and kills kubectl once no website needs it anymore
+func (f *kubectlForwarder) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.users--
+	if f.users == 0 {
+		f.cmd.Process.Kill()
+	}
+}
+
+// kubectlForwardAPod takes a portForwardPodRequest and serves the local port through the pod's kubectl port-forward
+// process, following the same lifecycle as portForwardAPod
+func kubectlForwardAPod(req portForwardPodRequest) error {
+	f := req.Kubectl
+	defer f.release()
+
+	select {
+	case <-f.ready:
+	case <-f.exited:
+		return f.exitError()
+	case <-req.StopCh:
+		return nil
+	}
+	internal, ok := f.ports[req.PodPort]
+	if !ok {
+		return errors.New("kubectl is not forwarding port " + strconv.Itoa(int(req.PodPort)))
+	}
+
+	listeners, err := req.listen()
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		go serveListener(l, func(conn net.Conn) {
+			defer conn.Close()
+			req.Stats.connectionOpened()
+			defer req.Stats.connectionClosed()
+			remote, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(internal)))
+			if err != nil {
+				return
+			}
+			defer remote.Close()
+			splice(conn, &halfCloser{remote.(*net.TCPConn)}, req.Stats)
+		})
+	}
+	close(req.ReadyCh)
+
+	lost := false
+	select {
+	case <-req.StopCh:
+	case <-f.exited:
+		lost = true
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	if lost {
+		return f.exitError()
+	}
+	return nil
+}
+
+// halfCloser only closes the writing side of the connection when closed so the response can still be read
+type halfCloser struct {
+	*net.TCPConn
+}
+
+func (h *halfCloser) Close() error {
+	return h.CloseWrite()
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"github.com/phayes/freeport"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKubectlForwardingLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		local  int
+		remote int
+		ok     bool
+	}{
+		{"Forwarding from 127.0.0.1:34567 -> 8080", 34567, 8080, true},
+		{"Forwarding from 127.0.0.1:34567 -> 8080\r\n", 34567, 8080, true},
+		// only the IPv4 listener is used by Portfall
+		{"Forwarding from [::1]:34567 -> 8080", 0, 0, false},
+		{"Handling connection for 34567", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		local, remote, ok := parseKubectlForwardingLine(tt.line)
+		if local != tt.local || remote != tt.remote || ok != tt.ok {
+			t.Errorf("parsing %q: expected %d, %d, %t got %d, %d, %t", tt.line, tt.local, tt.remote, tt.ok, local, remote, ok)
+		}
+	}
+}
+
+// fakeKubectl writes a kubectl which reports every forwarded port as ready and then sleeps, or exits with the given
+// error if it isn't empty
+func fakeKubectl(t *testing.T, dir string, exitError string) string {
+	script := `#!/bin/sh
+for arg in "$@"; do
+	case "$arg" in
+		*:*) echo "Forwarding from 127.0.0.1:${arg%%:*} -> ${arg#*:}" ;;
+	esac
+done
+exec sleep 60
+`
+	if exitError != "" {
+		script = "#!/bin/sh\necho '" + exitError + "' >&2\nexit 1\n"
+	}
+	path := filepath.Join(dir, "kubectl")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func kubectlRequest(f *kubectlForwarder, podPort int32) portForwardPodRequest {
+	return portForwardPodRequest{
+		Pod:          testPod,
+		LocalAddress: "127.0.0.1",
+		PodPort:      podPort,
+		StopCh:       make(chan struct{}),
+		ReadyCh:      make(chan struct{}),
+		Stats:        &trafficStats{},
+		Kubectl:      f,
+	}
+}
+
+func TestKubectlForwarderIsStoppedByItsLastUser(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake kubectl is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "portfall-kubectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := startKubectlForwarder(fakeKubectl(t, dir, ""), "kubeconfig", "test", testPod, []int32{8080, 9090})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errChs []chan error
+	var reqs []portForwardPodRequest
+	for _, podPort := range []int32{8080, 9090} {
+		port, err := freeport.GetFreePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := kubectlRequest(f, podPort)
+		req.LocalPort = int32(port)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- kubectlForwardAPod(req)
+		}()
+		reqs = append(reqs, req)
+		errChs = append(errChs, errCh)
+	}
+	for _, req := range reqs {
+		select {
+		case <-req.ReadyCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the website to become ready once kubectl reported its ports")
+		}
+	}
+
+	close(reqs[0].StopCh)
+	if err := <-errChs[0]; err != nil {
+		t.Errorf("expected a clean stop got %v", err)
+	}
+	select {
+	case <-f.exited:
+		t.Fatal("expected kubectl to keep running while a website uses it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(reqs[1].StopCh)
+	if err := <-errChs[1]; err != nil {
+		t.Errorf("expected a clean stop got %v", err)
+	}
+	select {
+	case <-f.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected kubectl to be killed once its last website stopped")
+	}
+}
+
+func TestKubectlForwarderReportsEarlyExit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake kubectl is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "portfall-kubectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := startKubectlForwarder(fakeKubectl(t, dir, "pods \"web\" not found"), "kubeconfig", "test", testPod, []int32{8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kubectlForwardAPod(kubectlRequest(f, 8080))
+	if err == nil || !strings.Contains(err.Error(), `pods "web" not found`) {
+		t.Errorf("expected the exit of kubectl to be reported got %v", err)
+	}
+}
+
+func TestKubectlBackendIsNotUsedWithABastion(t *testing.T) {
+	c := &Client{settings: &settings{Contexts: map[string]*contextSettings{}}, currentContext: "prod"}
+	c.settings.forContext("prod").Backend = backendKubectl
+	if backend := c.forwardingBackend(); backend != backendKubectl {
+		t.Errorf("expected the kubectl backend got %s", backend)
+	}
+	c.bastion = &sshBastion{}
+	if backend := c.forwardingBackend(); backend != backendPortForward {
+		t.Errorf("expected contexts with a bastion to be forwarded in-process got %s", backend)
+	}
+}
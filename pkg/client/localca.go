@@ -0,0 +1,341 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/phayes/freeport"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"portfall/pkg/sniff"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+	// caValidity is how long the local CA is valid, leaf certificates are issued for a year
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 365 * 24 * time.Hour
+)
+
+// localCA is the certificate authority Portfall issues the certificates of its https front ports with. It is
+// persisted so that users only need to trust it once.
+type localCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	mu      sync.Mutex
+	// leaves caches the issued certificates by their hosts
+	leaves map[string]*tls.Certificate
+}
+
+// loadOrCreateCA loads the CA from dir, generating and persisting a new one if there is none yet
+func loadOrCreateCA(dir string) (*localCA, error) {
+	certPath, keyPath := filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile)
+	certPEM, certErr := ioutil.ReadFile(certPath)
+	keyPEM, keyErr := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return createCA(dir)
+	}
+	if certErr != nil {
+		return nil, certErr
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("the local CA in %s is not PEM encoded", dir)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &localCA{cert: cert, key: key, certPEM: certPEM, leaves: map[string]*tls.Certificate{}}, nil
+}
+
+func createCA(dir string) (*localCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Portfall"}, CommonName: "Portfall Local CA " + host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, caKeyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, caCertFile), certPEM, 0644); err != nil {
+		return nil, err
+	}
+	return &localCA{cert: cert, key: key, certPEM: certPEM, leaves: map[string]*tls.Certificate{}}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// issue returns a certificate for the hosts, which may be names and IPs, issuing a new one if needed
+func (ca *localCA) issue(hosts []string) (*tls.Certificate, error) {
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, ",")
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if leaf, ok := ca.leaves[key]; ok && time.Now().Before(leaf.Leaf.NotAfter) {
+		return leaf, nil
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Portfall"}, CommonName: sorted[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range sorted {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	leaf := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  leafKey,
+		Leaf:        parsed,
+	}
+	ca.leaves[key] = leaf
+	return leaf, nil
+}
+
+// httpsFront serves a website over https, terminating TLS in front of its plain local port
+type httpsFront struct {
+	server    *http.Server
+	url       string
+	closeOnce sync.Once
+}
+
+// websiteHosts are the names and addresses the website is reachable by locally
+func (w *Website) websiteHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if w.LocalAddress != "" {
+		hosts = append(hosts, w.LocalAddress)
+	}
+	return append(hosts, w.Hostnames...)
+}
+
+// startHTTPSFront serves the website over https with a certificate of the CA on a free port of its local address
+func startHTTPSFront(ca *localCA, w *Website) (*httpsFront, error) {
+	cert, err := ca.issue(w.websiteHosts())
+	if err != nil {
+		return nil, err
+	}
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		return nil, err
+	}
+	listeners, err := listenLocal(w.LocalAddress, int32(port))
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: w.localTarget()})
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+	f := &httpsFront{
+		server: &http.Server{
+			Handler:   proxy,
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{*cert}},
+		},
+	}
+	for _, l := range listeners {
+		go f.server.ServeTLS(l, "", "")
+	}
+	host := "localhost"
+	if w.LocalAddress != "" {
+		host = w.LocalAddress
+	}
+	f.url = "https://" + net.JoinHostPort(host, strconv.Itoa(port))
+	return f, nil
+}
+
+func (f *httpsFront) close() {
+	f.closeOnce.Do(func() {
+		f.server.Close()
+	})
+}
+
+// localCA returns the CA of Portfall, loading or creating it on first use
+func (c *Client) localCA() (*localCA, error) {
+	c.caOnce.Do(func() {
+		dir, err := configDir()
+		if err != nil {
+			c.caErr = err
+			return
+		}
+		c.ca, c.caErr = loadOrCreateCA(dir)
+	})
+	return c.ca, c.caErr
+}
+
+// serveHTTPS puts an https front port in front of the website which ends with the website
+func (c *Client) serveHTTPS(w *Website) error {
+	if w.https != nil {
+		return nil
+	}
+	if w.Protocol != sniff.HTTP {
+		return errNotHTTP(w)
+	}
+	ca, err := c.localCA()
+	if err != nil {
+		return err
+	}
+	f, err := startHTTPSFront(ca, w)
+	if err != nil {
+		return err
+	}
+	w.https = f
+	w.HttpsUrl = f.url
+	stopCh := w.portForwardReq.StopCh
+	go func() {
+		<-stopCh
+		f.close()
+	}()
+	return nil
+}
+
+// serveNewWebsitesOverHTTPS serves the given websites over https if enabled
+func (c *Client) serveNewWebsitesOverHTTPS(websites []*Website) {
+	if !c.settings.HTTPSEnabled {
+		return
+	}
+	for _, w := range websites {
+		if err := c.serveHTTPS(w); err != nil {
+			c.log.Warnf("failed to serve website on port %d over https: %v", w.LocalPort, err)
+		}
+	}
+}
+
+// EnableHTTPS serves the website on localAddress:localPort over https on an additional port with a certificate of the
+// local CA. The https url is returned, or an empty string if it couldn't be served.
+func (c *Client) EnableHTTPS(localAddress string, localPort int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.websites {
+		if w.LocalAddress != localAddress || int(w.LocalPort) != localPort {
+			continue
+		}
+		if err := c.serveHTTPS(w); err != nil {
+			c.log.Warnf("failed to serve website on port %d over https: %v", localPort, err)
+			return ""
+		}
+		return w.HttpsUrl
+	}
+	c.log.Warnf("no website on port %d to serve over https", localPort)
+	return ""
+}
+
+// SetHTTPS toggles serving websites forwarded from now on over https as well
+func (c *Client) SetHTTPS(enabled bool) {
+	c.settings.HTTPSEnabled = enabled
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+}
+
+// GetCACert returns the PEM encoded certificate of the local CA which needs to be trusted for the https front ports
+func (c *Client) GetCACert() string {
+	ca, err := c.localCA()
+	if err != nil {
+		c.log.Warnf("failed to load the local CA: %v", err)
+		return ""
+	}
+	return string(ca.certPEM)
+}
+
+// ExportCACert writes the certificate of the local CA to path so that it can be imported into trust stores. An
+// empty string is returned on success, otherwise the reason it couldn't be exported.
+func (c *Client) ExportCACert(path string) string {
+	ca, err := c.localCA()
+	if err != nil {
+		return err.Error()
+	}
+	if path == "" {
+		return "no path to export the CA certificate to"
+	}
+	if err := ioutil.WriteFile(path, ca.certPEM, 0644); err != nil {
+		return err.Error()
+	}
+	return ""
+}
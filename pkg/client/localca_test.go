@@ -0,0 +1,72 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestLocalCAIsPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portfall-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := loadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.cert.Equal(ca.cert) {
+		t.Error("expected the persisted CA to be loaded again")
+	}
+	if info, err := os.Stat(dir + "/" + caKeyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the CA key to only be readable by the user got %v %v", info.Mode(), err)
+	}
+}
+
+func TestHTTPSFront(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portfall-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := loadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	localPort, _ := strconv.Atoi(port)
+
+	front, err := startHTTPSFront(ca, &Website{LocalPort: int32(localPort)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get(front.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "https" {
+		t.Errorf("expected the request to be proxied as https got %q", body)
+	}
+}
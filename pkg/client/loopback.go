@@ -0,0 +1,246 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Markers delimiting the block of the hosts file owned by Portfall. Everything outside of them is left untouched.
+const (
+	hostsBlockStart = "# BEGIN portfall - managed automatically, do not edit"
+	hostsBlockEnd   = "# END portfall"
+)
+
+// loopbackAllocator hands out a distinct loopback address from 127.1.0.0/16 to every service so that services can be
+// forwarded on their real ports. A service keeps its address for as long as Portfall runs.
+type loopbackAllocator struct {
+	mu    sync.Mutex
+	addrs map[string]string
+	next  int
+}
+
+// allocate returns the loopback address of the service in the namespace, allocating a new one if needed
+func (a *loopbackAllocator) allocate(namespace string, service string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.addrs == nil {
+		a.addrs = map[string]string{}
+	}
+	key := service + "." + namespace
+	if addr, ok := a.addrs[key]; ok {
+		return addr, nil
+	}
+	// skip the network and broadcast addresses of every /24
+	if a.next >= 256*254 {
+		return "", errors.New("no loopback addresses left in 127.1.0.0/16")
+	}
+	addr := fmt.Sprintf("127.1.%d.%d", a.next/254, a.next%254+1)
+	a.next++
+	a.addrs[key] = addr
+	return addr, nil
+}
+
+// portAvailable checks whether port can currently be bound on the address
+func portAvailable(address string, port int32) error {
+	l, err := net.Listen("tcp", net.JoinHostPort(address, fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// serviceHostnames returns the names a service is reachable by from within its namespace and the cluster
+func serviceHostnames(service string, namespace string) []string {
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc.cluster.local",
+	}
+}
+
+// serviceNames returns the service of the request followed by the other services served by it
+func (req portForwardPodRequest) serviceNames() []string {
+	if req.ServiceName == "" {
+		return nil
+	}
+	return append([]string{req.ServiceName}, req.ServiceAliases...)
+}
+
+// hostsEntry maps an address to hostnames in the hosts file
+type hostsEntry struct {
+	address string
+	names   []string
+}
+
+// defaultHostsPath returns the location of the system's hosts file
+func defaultHostsPath() string {
+	if runtime.GOOS == "windows" {
+		root := os.Getenv("SystemRoot")
+		if root == "" {
+			root = `C:\Windows`
+		}
+		return filepath.Join(root, "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// renderHostsFile replaces the Portfall block of the hosts file content with the given entries, removing the block
+// entirely if there are none. The line endings of the existing content are kept.
+func renderHostsFile(existing string, entries []hostsEntry) string {
+	eol := "\n"
+	if strings.Contains(existing, "\r\n") {
+		eol = "\r\n"
+	}
+	var b strings.Builder
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(existing))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == hostsBlockStart:
+			inBlock = true
+		case strings.TrimSpace(line) == hostsBlockEnd:
+			inBlock = false
+		case !inBlock:
+			b.WriteString(line + eol)
+		}
+	}
+	if len(entries) == 0 {
+		return b.String()
+	}
+
+	sorted := append([]hostsEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].address < sorted[j].address
+	})
+	b.WriteString(hostsBlockStart + eol)
+	for _, e := range sorted {
+		b.WriteString(e.address + "\t" + strings.Join(e.names, " ") + eol)
+	}
+	b.WriteString(hostsBlockEnd + eol)
+	return b.String()
+}
+
+// writeHostsFile updates the Portfall block of the hosts file at path, only writing to it if the block changed. The
+// new file is written next to it and renamed over it, so the hosts file is never left half written.
+func writeHostsFile(path string, entries []hostsEntry) error {
+	// a symlinked hosts file is updated where it points to
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	existing, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 && !strings.Contains(string(existing), hostsBlockStart) {
+		return nil
+	}
+	updated := renderHostsFile(string(existing), entries)
+	if updated == string(existing) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".portfall")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(updated); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// hostsPath returns the hosts file Portfall maintains the names of forwarded services in
+func (c *Client) hostsPath() string {
+	if c.settings != nil && c.settings.HostsPath != "" {
+		return c.settings.HostsPath
+	}
+	return defaultHostsPath()
+}
+
+// hostsEntries returns the entries of the websites forwarded on their own loopback address. The bare name of a
+// service is only mapped if no service of the same name in another namespace has an address, as it would be ambiguous.
+func hostsEntries(websites []*Website) []hostsEntry {
+	var entries []hostsEntry
+	seen := map[string]bool{}
+	addresses := map[string]map[string]bool{}
+	for _, w := range websites {
+		if w.LocalAddress == "" || seen[w.LocalAddress] {
+			continue
+		}
+		seen[w.LocalAddress] = true
+		entries = append(entries, hostsEntry{address: w.LocalAddress, names: w.Hostnames})
+		for _, name := range w.Hostnames {
+			if addresses[name] == nil {
+				addresses[name] = map[string]bool{}
+			}
+			addresses[name][w.LocalAddress] = true
+		}
+	}
+	for i, e := range entries {
+		var names []string
+		for _, name := range e.names {
+			if strings.Contains(name, ".") || len(addresses[name]) == 1 {
+				names = append(names, name)
+			}
+		}
+		entries[i].names = names
+	}
+	return entries
+}
+
+// syncHostsFile maps the names of all services forwarded on their own loopback address in the hosts file. Failures,
+// usually missing permissions, are only logged as the services stay reachable by address.
+func (c *Client) syncHostsFile() {
+	c.mu.RLock()
+	entries := hostsEntries(c.websites)
+	c.mu.RUnlock()
+	if err := writeHostsFile(c.hostsPath(), entries); err != nil {
+		c.log.Warnf("failed to update the hosts file %s, service names won't resolve locally: %v", c.hostsPath(), err)
+	}
+}
+
+// SetLoopbackPerService toggles forwarding every service on its own loopback address (127.1.x.y) and its real port
+// for websites forwarded from now on. The service names are mapped to these addresses in a Portfall block of the hosts
+// file at hostsPath, or the system's hosts file if hostsPath is empty.
+func (c *Client) SetLoopbackPerService(enabled bool, hostsPath string) {
+	if hostsPath != c.settings.HostsPath {
+		// leave no stale names behind in the previous hosts file
+		if err := writeHostsFile(c.hostsPath(), nil); err != nil {
+			c.log.Debugf("%v", err)
+		}
+	}
+	c.settings.LoopbackPerService = enabled
+	c.settings.HostsPath = hostsPath
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	c.syncHostsFile()
+	c.log.Infof("loopback address per service set to %t using hosts file %s", enabled, c.hostsPath())
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoopbackAllocator(t *testing.T) {
+	var a loopbackAllocator
+	first, _ := a.allocate("default", "postgres")
+	second, _ := a.allocate("default", "redis")
+	again, _ := a.allocate("default", "postgres")
+	if first != "127.1.0.1" || second != "127.1.0.2" {
+		t.Errorf("expected consecutive addresses got %s and %s", first, second)
+	}
+	if again != first {
+		t.Errorf("expected a service to keep its address got %s and %s", first, again)
+	}
+	a.next = 254
+	if next, _ := a.allocate("default", "web"); next != "127.1.1.1" {
+		t.Errorf("expected the allocation to continue in the next /24 got %s", next)
+	}
+}
+
+func TestRenderHostsFile(t *testing.T) {
+	existing := "127.0.0.1\tlocalhost\n" +
+		hostsBlockStart + "\n127.1.0.9\told\n" + hostsBlockEnd + "\n" +
+		"10.0.0.1\tnas\n"
+	entries := []hostsEntry{
+		{address: "127.1.0.2", names: []string{"redis", "redis.default"}},
+		{address: "127.1.0.1", names: []string{"postgres"}},
+	}
+	expected := "127.0.0.1\tlocalhost\n10.0.0.1\tnas\n" +
+		hostsBlockStart + "\n127.1.0.1\tpostgres\n127.1.0.2\tredis redis.default\n" + hostsBlockEnd + "\n"
+	if got := renderHostsFile(existing, entries); got != expected {
+		t.Errorf("expected the block to be replaced got %q", got)
+	}
+	if got := renderHostsFile(expected, nil); got != "127.0.0.1\tlocalhost\n10.0.0.1\tnas\n" {
+		t.Errorf("expected the block to be removed got %q", got)
+	}
+	if got := renderHostsFile("127.0.0.1 localhost\r\n", entries[1:]); got != "127.0.0.1 localhost\r\n"+hostsBlockStart+"\r\n127.1.0.1\tpostgres\r\n"+hostsBlockEnd+"\r\n" {
+		t.Errorf("expected windows line endings to be kept got %q", got)
+	}
+}
+
+func TestHostsEntriesOnlyMapUniqueBareNames(t *testing.T) {
+	website := func(address string, namespace string, services ...string) *Website {
+		req := portForwardPodRequest{ServiceName: services[0], ServiceAliases: services[1:]}
+		w := &Website{LocalAddress: address}
+		for _, service := range req.serviceNames() {
+			w.Hostnames = append(w.Hostnames, serviceHostnames(service, namespace)...)
+		}
+		return w
+	}
+	entries := hostsEntries([]*Website{
+		website("127.1.0.1", "shop", "postgres"),
+		website("127.1.0.2", "billing", "postgres"),
+		website("127.1.0.3", "shop", "web", "web-canary"),
+		{LocalPort: 31234},
+	})
+	if len(entries) != 3 {
+		t.Fatalf("expected an entry per loopback address got %+v", entries)
+	}
+	if entries[0].names[0] != "postgres.shop" || entries[1].names[0] != "postgres.billing" {
+		t.Errorf("expected the ambiguous bare name to be left out got %v and %v", entries[0].names, entries[1].names)
+	}
+	names := strings.Join(entries[2].names, " ")
+	if !strings.HasPrefix(names, "web web.shop ") || !strings.Contains(names, " web-canary web-canary.shop ") {
+		t.Errorf("expected the names of both services sharing the port got %s", names)
+	}
+}
+
+func TestWriteHostsFileReplacesTheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "portfall-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostsPath := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hostsPath, []byte("127.0.0.1 localhost\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	linkPath := filepath.Join(dir, "hosts-link")
+	if err := os.Symlink(hostsPath, linkPath); err != nil {
+		t.Skip("symlinks are not supported")
+	}
+
+	if err := writeHostsFile(linkPath, []hostsEntry{{address: "127.1.0.1", names: []string{"web.shop"}}}); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := ioutil.ReadFile(hostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(hosts), "127.0.0.1 localhost\n") || !strings.Contains(string(hosts), "127.1.0.1\tweb.shop") {
+		t.Errorf("expected the block to be added to the linked hosts file got %s", hosts)
+	}
+	if info, err := os.Stat(hostsPath); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("expected the mode of the hosts file to be kept got %v", info.Mode())
+	}
+	if info, err := os.Lstat(linkPath); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Error("expected the symlink to be kept")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("expected no temporary file to be left behind got %d files", len(files))
+	}
+}
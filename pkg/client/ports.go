@@ -0,0 +1,101 @@
+package client
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"strconv"
+)
+
+// Sources of candidate ports
+const (
+	portSourceService       = "service"
+	portSourceContainerPort = "containerPort"
+	portSourceLiveness      = "livenessProbe"
+	portSourceReadiness     = "readinessProbe"
+	portSourceStartup       = "startupProbe"
+	portSourcePrometheus    = "prometheus"
+	portSourceEnv           = "env"
+)
+
+// portEnvVars are the environment variables apps commonly read the port to listen on from
+var portEnvVars = []string{"PORT", "HTTP_PORT", "SERVER_PORT", "APP_PORT", "LISTEN_PORT", "WEB_PORT"}
+
+// inferredPort is a port of a container which isn't declared but can be told from its configuration
+type inferredPort struct {
+	container string
+	port      int32
+	// source is where the port came from, e.g. readinessProbe or env PORT
+	source string
+}
+
+// probePort returns the port of an httpGet or tcpSocket probe, resolving named ports with the container's ports
+func probePort(probe *v1.Probe, container v1.Container) int32 {
+	if probe == nil {
+		return 0
+	}
+	var port intstr.IntOrString
+	switch {
+	case probe.HTTPGet != nil:
+		port = probe.HTTPGet.Port
+	case probe.TCPSocket != nil:
+		port = probe.TCPSocket.Port
+	default:
+		return 0
+	}
+	if port.Type == intstr.Int {
+		return port.IntVal
+	}
+	for _, p := range container.Ports {
+		if p.Name == port.StrVal {
+			return p.ContainerPort
+		}
+	}
+	return 0
+}
+
+// parsePort returns the port in s, 0 if it isn't a valid port
+func parsePort(s string) int32 {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0
+	}
+	return int32(port)
+}
+
+// inferPorts returns the ports the containers of the pod can be told to listen on from their probes, the
+// prometheus.io annotations of the pod and the well-known port environment variables, in that order. The prometheus
+// port is attributed to the first container as the annotation doesn't tell which container serves it.
+func inferPorts(pod v1.Pod) []inferredPort {
+	var ports []inferredPort
+	for _, container := range pod.Spec.Containers {
+		probes := []struct {
+			probe  *v1.Probe
+			source string
+		}{
+			{container.ReadinessProbe, portSourceReadiness},
+			{container.LivenessProbe, portSourceLiveness},
+			{container.StartupProbe, portSourceStartup},
+		}
+		for _, p := range probes {
+			if port := probePort(p.probe, container); port != 0 {
+				ports = append(ports, inferredPort{container: container.Name, port: port, source: p.source})
+			}
+		}
+	}
+	if port := parsePort(pod.Annotations["prometheus.io/port"]); port != 0 && pod.Annotations["prometheus.io/scrape"] != "false" && len(pod.Spec.Containers) > 0 {
+		ports = append(ports, inferredPort{container: pod.Spec.Containers[0].Name, port: port, source: portSourcePrometheus})
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, env := range container.Env {
+			for _, name := range portEnvVars {
+				if env.Name != name {
+					continue
+				}
+				if port := parsePort(env.Value); port != 0 {
+					ports = append(ports, inferredPort{container: container.Name, port: port, source: portSourceEnv + " " + name})
+				}
+			}
+		}
+	}
+	return ports
+}
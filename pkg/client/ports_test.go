@@ -0,0 +1,62 @@
+package client
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"testing"
+)
+
+func TestInferPorts(t *testing.T) {
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Annotations: map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/port":   "9102",
+		}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Name: "api",
+			ReadinessProbe: &v1.Probe{Handler: v1.Handler{
+				HTTPGet: &v1.HTTPGetAction{Path: "/healthz", Port: intstr.FromInt(8080)},
+			}},
+			LivenessProbe: &v1.Probe{Handler: v1.Handler{
+				HTTPGet: &v1.HTTPGetAction{Path: "/healthz", Port: intstr.FromString("http")},
+			}},
+			Env: []v1.EnvVar{{Name: "PORT", Value: "3000"}, {Name: "HTTP_PORT", Value: "not a port"}},
+		}, {
+			Name:          "sidecar",
+			LivenessProbe: &v1.Probe{Handler: v1.Handler{TCPSocket: &v1.TCPSocketAction{Port: intstr.FromInt(15020)}}},
+		}}},
+	}
+	ports := inferPorts(pod)
+	expected := []inferredPort{
+		{container: "api", port: 8080, source: portSourceReadiness},
+		{container: "sidecar", port: 15020, source: portSourceLiveness},
+		{container: "api", port: 9102, source: portSourcePrometheus},
+		{container: "api", port: 3000, source: "env PORT"},
+	}
+	if len(ports) != len(expected) {
+		t.Fatalf("expected %d ports got %+v", len(expected), ports)
+	}
+	for i := range expected {
+		if ports[i] != expected[i] {
+			t.Errorf("expected %+v got %+v", expected[i], ports[i])
+		}
+	}
+}
+
+func TestContainerPortsArePreferredOverInferredOnes(t *testing.T) {
+	c := &Client{}
+	pod := v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{
+		Name:           "web",
+		Ports:          []v1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+		ReadinessProbe: &v1.Probe{Handler: v1.Handler{HTTPGet: &v1.HTTPGetAction{Port: intstr.FromString("http")}}},
+		Env:            []v1.EnvVar{{Name: "PORT", Value: "8080"}, {Name: "SERVER_PORT", Value: "8081"}},
+	}}}}
+	candidates := c.handleContainerPortsInPod(pod, nil)
+	if len(candidates) != 2 {
+		t.Fatalf("expected the declared and the env port got %+v", candidates)
+	}
+	if candidates[0].portSource != portSourceContainerPort || candidates[1].port != 8081 || candidates[1].portSource != "env SERVER_PORT" {
+		t.Errorf("unexpected candidates %+v", candidates)
+	}
+}
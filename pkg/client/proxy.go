@@ -0,0 +1,525 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultProxyPort is the port the cluster proxy listens on unless configured otherwise
+const defaultProxyPort = 1080
+
+// proxyPACPath is where the cluster proxy serves its proxy auto-config file
+const proxyPACPath = "/proxy.pac"
+
+// socks5 protocol constants, see RFC 1928
+const (
+	socks5Version         = 0x05
+	socks5NoAuth          = 0x00
+	socks5NoAcceptable    = 0xff
+	socks5Connect         = 0x01
+	socks5IPv4            = 0x01
+	socks5Domain          = 0x03
+	socks5IPv6            = 0x04
+	socks5Succeeded       = 0x00
+	socks5GeneralFailure  = 0x01
+	socks5HostUnreachable = 0x04
+	socks5NotSupported    = 0x07
+)
+
+// errNotConnected is returned for proxy connections arriving before a cluster was connected to
+var errNotConnected = errors.New("not connected to a cluster")
+
+// serviceSelectsPod returns whether the selector of the service matches the labels of the pod
+func serviceSelectsPod(svc v1.Service, pod v1.Pod) bool {
+	for k, v := range svc.Spec.Selector {
+		if pod.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// clusterProxy is a local SOCKS5 and HTTP proxy which forwards connections to <svc>.<ns>[.svc[.cluster.local]]:port
+// and pod IPs on the fly. Both protocols share one port, told apart by the first byte a client sends.
+type clusterProxy struct {
+	c        *Client
+	listener net.Listener
+	server   *http.Server
+	// transport dials plain http requests through the pod tunnels
+	transport *http.Transport
+	// dialPod opens the connection of a pod's tunnel
+	dialPod func(pod v1.Pod) (podConnection, error)
+	stats   *trafficStats
+	mu      sync.Mutex
+	// tunnels are lazy tunnels to the pods connections went to, keyed by pod UID
+	tunnels map[string]*podTunnel
+}
+
+// startClusterProxy listens for proxy clients on the loopback port, connecting to pods with dialPod
+func (c *Client) startClusterProxy(port int, dialPod func(pod v1.Pod) (podConnection, error)) (*clusterProxy, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	p := &clusterProxy{
+		c:        c,
+		listener: l,
+		dialPod:  dialPod,
+		stats:    &trafficStats{},
+		tunnels:  map[string]*podTunnel{},
+	}
+	p.transport = &http.Transport{
+		Dial:            p.dial,
+		IdleConnTimeout: 90 * time.Second,
+	}
+	p.server = &http.Server{Handler: p}
+	httpConns := &chanListener{Listener: l, conns: make(chan net.Conn), done: make(chan struct{})}
+	go serveListener(l, p.dispatch(httpConns))
+	go p.server.Serve(httpConns)
+	return p, nil
+}
+
+// dispatch returns a connection handler which serves SOCKS5 clients itself and hands all other connections to the
+// http server
+func (p *clusterProxy) dispatch(httpConns *chanListener) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		first, err := r.Peek(1)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		peeked := &peekedConn{Conn: conn, r: r}
+		if first[0] == socks5Version {
+			p.serveSOCKS5(peeked)
+			return
+		}
+		select {
+		case httpConns.conns <- peeked:
+		case <-httpConns.done:
+			conn.Close()
+		}
+	}
+}
+
+// pacFile returns a proxy auto-config file which only sends cluster service names through the proxy
+func (p *clusterProxy) pacFile() string {
+	addr := p.listener.Addr().String()
+	return fmt.Sprintf(`function FindProxyForURL(url, host) {
+  if (dnsDomainIs(host, ".svc.cluster.local")) {
+    return "PROXY %s; SOCKS5 %s";
+  }
+  return "DIRECT";
+}
+`, addr, addr)
+}
+
+// ServeHTTP serves the PAC file, tunnels CONNECT requests and proxies plain http requests into the cluster
+func (p *clusterProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		p.serveConnect(w, r)
+	case r.URL.Host == "" && r.URL.Path == proxyPACPath:
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		io.WriteString(w, p.pacFile())
+	case r.URL.Host != "":
+		proxy := &httputil.ReverseProxy{
+			Director:  func(*http.Request) {},
+			Transport: p.transport,
+		}
+		proxy.ServeHTTP(w, r)
+	default:
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+	}
+}
+
+func (p *clusterProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	req, err := p.resolve(r.URL.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		return
+	}
+	handlePodConnection(&peekedConn{Conn: conn, r: buf.Reader}, req)
+}
+
+// serveSOCKS5 handles the CONNECT command of SOCKS5 clients without authentication
+func (p *clusterProxy) serveSOCKS5(conn net.Conn) {
+	// greeting: version, number of methods and the methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		conn.Close()
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		conn.Close()
+		return
+	}
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	conn.Write([]byte{socks5Version, method})
+	if method == socks5NoAcceptable {
+		conn.Close()
+		return
+	}
+
+	// request: version, command, reserved, address type, address and port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		conn.Close()
+		return
+	}
+	var host string
+	switch request[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5IPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			conn.Close()
+			return
+		}
+		host = ip.String()
+	case socks5Domain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			conn.Close()
+			return
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			conn.Close()
+			return
+		}
+		host = string(domain)
+	default:
+		p.replySOCKS5(conn, socks5NotSupported)
+		conn.Close()
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		conn.Close()
+		return
+	}
+	if request[1] != socks5Connect {
+		p.replySOCKS5(conn, socks5NotSupported)
+		conn.Close()
+		return
+	}
+
+	req, err := p.resolve(net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		status := byte(socks5HostUnreachable)
+		if err == errNotConnected {
+			status = socks5GeneralFailure
+		}
+		p.replySOCKS5(conn, status)
+		conn.Close()
+		return
+	}
+	p.replySOCKS5(conn, socks5Succeeded)
+	handlePodConnection(conn, req)
+}
+
+func (p *clusterProxy) replySOCKS5(conn net.Conn, status byte) {
+	conn.Write([]byte{socks5Version, status, 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+}
+
+// dial connects to addr in the cluster, it is used as the dial function of the plain http proxy
+func (p *clusterProxy) dial(network string, addr string) (net.Conn, error) {
+	req, err := p.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := net.Pipe()
+	go handlePodConnection(remote, req)
+	return local, nil
+}
+
+// resolve finds the pod and port behind addr and returns a request to forward a connection to it through the pod's
+// tunnel, which is opened if needed
+func (p *clusterProxy) resolve(addr string) (portForwardPodRequest, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return portForwardPodRequest{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return portForwardPodRequest{}, err
+	}
+	if p.c.s == nil {
+		return portForwardPodRequest{}, errNotConnected
+	}
+	var pod v1.Pod
+	podPort := int32(port)
+	if ip := net.ParseIP(host); ip != nil {
+		pod, err = p.c.podWithIP(ip.String())
+	} else {
+		pod, podPort, err = p.c.podForServiceName(strings.ToLower(host), int32(port))
+	}
+	if err != nil {
+		return portForwardPodRequest{}, err
+	}
+
+	req := portForwardPodRequest{
+		Pod:     pod,
+		PodPort: podPort,
+		Stats:   p.stats,
+		Tunnel:  p.tunnel(pod),
+	}
+	if _, err := req.Tunnel.connection(); err != nil {
+		return portForwardPodRequest{}, err
+	}
+	return req, nil
+}
+
+// tunnel returns the lazy tunnel to the pod, which is closed again once it was idle for the idle timeout and then
+// forgotten
+func (p *clusterProxy) tunnel(pod v1.Pod) *podTunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	uid := string(pod.UID)
+	t, ok := p.tunnels[uid]
+	if !ok {
+		idleTimeout := p.c.idleTimeout
+		if idleTimeout == 0 {
+			idleTimeout = defaultIdleTimeout
+		}
+		t = &podTunnel{
+			dial: func() (podConnection, error) {
+				return p.dialPod(pod)
+			},
+			idleTimeout: idleTimeout,
+		}
+		t.dormant = func() {
+			p.forgetTunnel(uid, t)
+		}
+		p.tunnels[uid] = t
+	}
+	return t
+}
+
+// forgetTunnel removes the tunnel to the pod unless it was already replaced
+func (p *clusterProxy) forgetTunnel(uid string, t *podTunnel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tunnels[uid] == t {
+		delete(p.tunnels, uid)
+	}
+}
+
+// closeTunnels closes the tunnels to all pods, e.g. because the context changed
+func (p *clusterProxy) closeTunnels() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for uid, t := range p.tunnels {
+		t.close()
+		delete(p.tunnels, uid)
+	}
+}
+
+// Close stops the proxy and closes all of its tunnels
+func (p *clusterProxy) Close() {
+	p.server.Close()
+	p.transport.CloseIdleConnections()
+	p.closeTunnels()
+}
+
+// podWithIP finds the running pod with the given IP in any namespace
+func (c *Client) podWithIP(ip string) (v1.Pod, error) {
+	pods, err := c.s.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("status.podIP", ip).String(),
+	})
+	if err != nil {
+		return v1.Pod{}, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning && pod.DeletionTimestamp == nil {
+			return pod, nil
+		}
+	}
+	return v1.Pod{}, fmt.Errorf("no running pod with IP %s", ip)
+}
+
+// podForServiceName finds a running pod behind the port of the service named <svc>.<ns>[.svc[.cluster.local]] and
+// returns it together with the pod port the service port targets
+func (c *Client) podForServiceName(name string, port int32) (v1.Pod, int32, error) {
+	name = strings.TrimSuffix(name, ".cluster.local")
+	name = strings.TrimSuffix(name, ".svc")
+	parts := strings.Split(name, ".")
+	if len(parts) != 2 {
+		return v1.Pod{}, 0, fmt.Errorf("%s is not a service name of the form <svc>.<ns>", name)
+	}
+	svc, err := c.s.CoreV1().Services(parts[1]).Get(parts[0], metav1.GetOptions{})
+	if err != nil {
+		return v1.Pod{}, 0, err
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return v1.Pod{}, 0, fmt.Errorf("service %s has no selector", name)
+	}
+	var svcPort *v1.ServicePort
+	for i := range svc.Spec.Ports {
+		if svc.Spec.Ports[i].Port == port {
+			svcPort = &svc.Spec.Ports[i]
+		}
+	}
+	if svcPort == nil {
+		return v1.Pod{}, 0, fmt.Errorf("service %s has no port %d", name, port)
+	}
+	pods, err := c.s.CoreV1().Pods(svc.Namespace).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(svc.Spec.Selector).String(),
+	})
+	if err != nil {
+		return v1.Pod{}, 0, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil || !serviceSelectsPod(*svc, pod) {
+			continue
+		}
+		if podPort, ok := targetPortInPod(*svcPort, pod); ok {
+			return pod, podPort, nil
+		}
+	}
+	return v1.Pod{}, 0, fmt.Errorf("no running pod serves port %d of service %s", port, name)
+}
+
+// targetPortInPod resolves the target port of a service port, which may be a named container port, for the pod
+func targetPortInPod(svcPort v1.ServicePort, pod v1.Pod) (int32, bool) {
+	if svcPort.TargetPort.Type == intstr.String {
+		for _, container := range pod.Spec.Containers {
+			for _, port := range container.Ports {
+				if port.Name == svcPort.TargetPort.StrVal {
+					return port.ContainerPort, true
+				}
+			}
+		}
+		return 0, false
+	}
+	if svcPort.TargetPort.IntVal == 0 {
+		return svcPort.Port, true
+	}
+	return svcPort.TargetPort.IntVal, true
+}
+
+// chanListener is a net.Listener which accepts the connections sent on conns until it is closed
+type chanListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("use of closed network connection")
+	}
+}
+
+// Close stops accepting and closes the underlying listener
+func (l *chanListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// peekedConn reads from r which has buffered the start of the connection
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// SetClusterProxy toggles the local SOCKS5 and HTTP proxy into the cluster on 127.0.0.1:port, 1080 if port is 0.
+// Connections to <svc>.<ns>[.svc[.cluster.local]]:port and pod IPs are forwarded to a matching pod on the fly. An
+// empty string is returned on success, otherwise the reason the proxy couldn't start.
+func (c *Client) SetClusterProxy(enabled bool, port int) string {
+	c.settings.ProxyEnabled = enabled
+	c.settings.ProxyPort = port
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	c.stopClusterProxy()
+	if !enabled {
+		return ""
+	}
+	if err := c.runClusterProxy(); err != nil {
+		c.log.Warnf("failed to start the cluster proxy: %v", err)
+		return err.Error()
+	}
+	return ""
+}
+
+// GetClusterProxyPAC returns the url of the proxy auto-config file which routes *.svc.cluster.local through the
+// cluster proxy, empty if the proxy is not running
+func (c *Client) GetClusterProxyPAC() string {
+	if c.proxy == nil {
+		return ""
+	}
+	return "http://" + c.proxy.listener.Addr().String() + proxyPACPath
+}
+
+func (c *Client) runClusterProxy() error {
+	port := c.settings.ProxyPort
+	if port == 0 {
+		port = defaultProxyPort
+	}
+	proxy, err := c.startClusterProxy(port, func(pod v1.Pod) (podConnection, error) {
+		return dialPod(c.forwardConf, pod, c.settings.forContext(c.currentContext).Transport)
+	})
+	if err != nil {
+		return err
+	}
+	c.proxy = proxy
+	c.log.Infof("proxying into the cluster on %s", proxy.listener.Addr())
+	return nil
+}
+
+func (c *Client) stopClusterProxy() {
+	if c.proxy != nil {
+		c.proxy.Close()
+		c.proxy = nil
+	}
+}
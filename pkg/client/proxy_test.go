@@ -0,0 +1,296 @@
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTargetPortInPod(t *testing.T) {
+	pod := v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{
+		Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+	}}}}
+	tests := []struct {
+		svcPort v1.ServicePort
+		port    int32
+		ok      bool
+	}{
+		{v1.ServicePort{Port: 80, TargetPort: intstr.FromInt(8080)}, 8080, true},
+		{v1.ServicePort{Port: 80, TargetPort: intstr.FromString("http")}, 8080, true},
+		{v1.ServicePort{Port: 80, TargetPort: intstr.FromString("metrics")}, 0, false},
+		// an unset target port defaults to the port
+		{v1.ServicePort{Port: 80}, 80, true},
+	}
+	for _, tt := range tests {
+		port, ok := targetPortInPod(tt.svcPort, pod)
+		if port != tt.port || ok != tt.ok {
+			t.Errorf("target port %s: expected %d, %t got %d, %t", tt.svcPort.TargetPort.String(), tt.port, tt.ok, port, ok)
+		}
+	}
+}
+
+// startTestClusterProxy runs a cluster proxy for the service web.shop on port 80 targeting port 8080 of its pod. The
+// pod is stubbed by serve, every stream to it is a connection to a local server handling it with serve.
+func startTestClusterProxy(t *testing.T, serve func(conn net.Conn)) (*clusterProxy, *[]int32) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "shop", UID: "web-0", Labels: map[string]string{"app": "web"}},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.0.0.7"},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{"app": "web"},
+			Ports:    []v1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(8080)}},
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveListener(l, serve)
+
+	var mu sync.Mutex
+	var ports []int32
+	c := &Client{s: fake.NewSimpleClientset(pod, svc)}
+	p, err := c.startClusterProxy(0, func(pod v1.Pod) (podConnection, error) {
+		return &recordingPodConnection{fakePodConnection: &fakePodConnection{echo: l, closeCh: make(chan bool)}, mu: &mu, ports: &ports}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, &ports
+}
+
+// recordingPodConnection records the pod ports streams were opened to
+type recordingPodConnection struct {
+	*fakePodConnection
+	mu    *sync.Mutex
+	ports *[]int32
+}
+
+func (r *recordingPodConnection) openStream(port int32) (io.ReadWriteCloser, <-chan error, error) {
+	r.mu.Lock()
+	*r.ports = append(*r.ports, port)
+	r.mu.Unlock()
+	return r.fakePodConnection.openStream(port)
+}
+
+func echo(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func assertEchoesThrough(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("expected an echo from the pod got %q %v", buf, err)
+	}
+}
+
+// dialSOCKS5 greets the proxy without authentication and requests a connection to the domain, returning the
+// status of the reply
+func dialSOCKS5(t *testing.T, conn net.Conn, domain string, port uint16) byte {
+	conn.Write([]byte{socks5Version, 1, socks5NoAuth})
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil || greeting[1] != socks5NoAuth {
+		t.Fatalf("expected no authentication to be accepted got %v %v", greeting, err)
+	}
+	request := append([]byte{socks5Version, socks5Connect, 0, socks5Domain, byte(len(domain))}, domain...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], port)
+	conn.Write(request)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestClusterProxySOCKS5(t *testing.T) {
+	p, ports := startTestClusterProxy(t, echo)
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if status := dialSOCKS5(t, conn, "web.shop.svc.cluster.local", 80); status != socks5Succeeded {
+		t.Fatalf("expected the connection to succeed got status %d", status)
+	}
+	assertEchoesThrough(t, conn)
+	if len(*ports) != 1 || (*ports)[0] != 8080 {
+		t.Errorf("expected the service port to be forwarded to the target port got %v", *ports)
+	}
+
+	unknown, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unknown.Close()
+	if status := dialSOCKS5(t, unknown, "admin.shop", 80); status != socks5HostUnreachable {
+		t.Errorf("expected an unknown service to be unreachable got status %d", status)
+	}
+}
+
+func TestClusterProxySOCKS5RequiresNoAuth(t *testing.T) {
+	p, _ := startTestClusterProxy(t, echo)
+	defer p.Close()
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// username and password authentication only
+	conn.Write([]byte{socks5Version, 1, 0x02})
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil || greeting[1] != socks5NoAcceptable {
+		t.Errorf("expected no acceptable method got %v %v", greeting, err)
+	}
+}
+
+func TestClusterProxyConnect(t *testing.T) {
+	p, ports := startTestClusterProxy(t, echo)
+	defer p.Close()
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT 10.0.0.7:9090 HTTP/1.1\r\nHost: 10.0.0.7:9090\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the tunnel to be established got %v %v", resp, err)
+	}
+	assertEchoesThrough(t, &peekedConn{Conn: conn, r: r})
+	if len(*ports) != 1 || (*ports)[0] != 9090 {
+		t.Errorf("expected the port of the pod IP to be forwarded got %v", *ports)
+	}
+}
+
+func TestClusterProxyHTTP(t *testing.T) {
+	p, _ := startTestClusterProxy(t, func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		resp := &http.Response{ProtoMajor: 1, ProtoMinor: 1, StatusCode: http.StatusOK, Header: http.Header{}}
+		resp.Body = ioutil.NopCloser(strings.NewReader("served " + req.Host + req.URL.Path))
+		resp.ContentLength = int64(len("served " + req.Host + req.URL.Path))
+		resp.Write(conn)
+	})
+	defer p.Close()
+	proxyURL, _ := url.Parse("http://" + p.listener.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://web.shop.svc.cluster.local/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "served web.shop.svc.cluster.local/orders" {
+		t.Errorf("expected the request to reach the pod got %q", body)
+	}
+}
+
+func TestClusterProxyPACFile(t *testing.T) {
+	p, _ := startTestClusterProxy(t, echo)
+	defer p.Close()
+	resp, err := http.Get("http://" + p.listener.Addr().String() + proxyPACPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	addr := p.listener.Addr().String()
+	if resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), `dnsDomainIs(host, ".svc.cluster.local")`) || !strings.Contains(string(body), "PROXY "+addr+"; SOCKS5 "+addr) {
+		t.Errorf("expected cluster names to be sent through the proxy got %s", body)
+	}
+}
+
+func TestClusterProxyBeforeConnecting(t *testing.T) {
+	c := &Client{}
+	p, err := c.startClusterProxy(0, func(pod v1.Pod) (podConnection, error) {
+		t.Fatal("expected no pod to be dialed before connecting to a cluster")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if status := dialSOCKS5(t, conn, "web.shop", 80); status != socks5GeneralFailure {
+		t.Errorf("expected a general failure got status %d", status)
+	}
+
+	connect, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connect.Close()
+	io.WriteString(connect, "CONNECT web.shop:80 HTTP/1.1\r\nHost: web.shop:80\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(connect), nil)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected a bad gateway got %v %v", resp, err)
+	}
+}
+
+func TestClusterProxyForgetsClosedTunnels(t *testing.T) {
+	p, _ := startTestClusterProxy(t, echo)
+	defer p.Close()
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if status := dialSOCKS5(t, conn, "web.shop", 80); status != socks5Succeeded {
+		t.Fatalf("expected the connection to succeed got status %d", status)
+	}
+	assertEchoesThrough(t, conn)
+
+	p.mu.Lock()
+	tunnel := p.tunnels["web-0"]
+	p.mu.Unlock()
+	if tunnel == nil {
+		t.Fatal("expected a tunnel to the pod")
+	}
+	tunnel.close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.mu.Lock()
+		n := len(p.tunnels)
+		p.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the closed tunnel to be forgotten got %d tunnels", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
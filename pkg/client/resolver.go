@@ -0,0 +1,80 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"portfall/pkg/dns"
+	"strings"
+)
+
+// lookupServiceAddress resolves <svc>.<ns>[.svc[.cluster.local]] to the loopback address of the forwarded service.
+// Services forwarded on a random local port aren't known, their name would lead to the wrong port on 127.0.0.1.
+func (c *Client) lookupServiceAddress(name string) (net.IP, bool) {
+	name = strings.TrimSuffix(name, ".cluster.local")
+	name = strings.TrimSuffix(name, ".svc")
+	parts := strings.Split(name, ".")
+	if len(parts) != 2 {
+		return nil, false
+	}
+	service, namespace := parts[0], parts[1]
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, w := range c.websites {
+		req := w.portForwardReq
+		if w.LocalAddress == "" || req.Pod.Namespace != namespace {
+			continue
+		}
+		for _, name := range req.serviceNames() {
+			if name == service {
+				return net.ParseIP(w.LocalAddress), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// startDNS runs the DNS responder configured in the settings, replacing any running one
+func (c *Client) startDNS() error {
+	c.stopDNS()
+	port := c.settings.DNSPort
+	if port == 0 {
+		port = dns.DefaultPort
+	}
+	server := dns.NewServer(c.lookupServiceAddress, c.settings.DNSUpstream)
+	if err := server.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", port)); err != nil {
+		return err
+	}
+	c.dns = server
+	c.log.Infof("answering dns queries for forwarded services on %s", server.Addr())
+	return nil
+}
+
+func (c *Client) stopDNS() {
+	if c.dns != nil {
+		c.dns.Close()
+		c.dns = nil
+	}
+}
+
+// SetDNS toggles the built-in DNS responder which answers A records for <svc>.<ns>[.svc[.cluster.local]] of services
+// forwarded on their own loopback address on 127.0.0.1:port, 10053 if port is 0. Other names are forwarded to upstream
+// or answered with NXDOMAIN if upstream is empty. An empty string is returned on success, otherwise the reason the
+// responder couldn't start.
+func (c *Client) SetDNS(enabled bool, port int, upstream string) string {
+	c.settings.DNSEnabled = enabled
+	c.settings.DNSPort = port
+	c.settings.DNSUpstream = upstream
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	if !enabled {
+		c.stopDNS()
+		return ""
+	}
+	if err := c.startDNS(); err != nil {
+		c.log.Warnf("failed to start the dns responder: %v", err)
+		return err.Error()
+	}
+	return ""
+}
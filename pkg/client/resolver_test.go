@@ -0,0 +1,27 @@
+package client
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestLookupServiceAddress(t *testing.T) {
+	shop := testPod
+	shop.ObjectMeta = metav1.ObjectMeta{Name: "web-0", Namespace: "shop"}
+	c := &Client{websites: []*Website{
+		{LocalPort: 31234, portForwardReq: portForwardPodRequest{Pod: shop, ServiceName: "admin"}},
+		{LocalAddress: "127.1.0.4", LocalPort: 80, portForwardReq: portForwardPodRequest{
+			Pod: shop, ServiceName: "web", ServiceAliases: []string{"web-canary"},
+		}},
+	}}
+	for _, name := range []string{"web.shop", "web.shop.svc", "web.shop.svc.cluster.local", "web-canary.shop"} {
+		if ip, ok := c.lookupServiceAddress(name); !ok || ip.String() != "127.1.0.4" {
+			t.Errorf("expected %s to resolve to the service's loopback address got %v", name, ip)
+		}
+	}
+	for _, name := range []string{"admin.shop", "web.billing", "web", "example.com"} {
+		if ip, ok := c.lookupServiceAddress(name); ok {
+			t.Errorf("expected %s to be unknown got %v", name, ip)
+		}
+	}
+}
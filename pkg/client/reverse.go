@@ -0,0 +1,311 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"net"
+	"portfall/pkg/relay"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultRelayImage runs cmd/portfall-relay, it is published by the release workflow with the tag of the release
+	// and has to match the version of project.json
+	defaultRelayImage = "ghcr.io/rekon-oss/portfall-relay:v0.4.0"
+	// relayUser is the unprivileged user the relay image runs as
+	relayUser = 65534
+	// relayPoolSize is the number of idle control connections kept open to a relay
+	relayPoolSize = 4
+	// relayReadyTimeout is how long to wait for a relay pod to become ready
+	relayReadyTimeout = 60 * time.Second
+	// reverseTunnelLabel marks the relay pods and services Portfall deployed with the name of their tunnel
+	reverseTunnelLabel = "portfall.io/reverse-tunnel"
+)
+
+// reverseTunnel makes a local port reachable as a service in the cluster through a relay pod
+type reverseTunnel struct {
+	namespace   string
+	name        string
+	localPort   int32
+	servicePort int32
+	agent       *relay.Agent
+	tunnel      *podTunnel
+}
+
+// ReverseTunnel is the json representation of a reverse tunnel
+type ReverseTunnel struct {
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	LocalPort   int32  `json:"localPort"`
+	ServicePort int32  `json:"servicePort"`
+	// Address is the in-cluster address of the service
+	Address string `json:"address"`
+}
+
+func relayLabels(name string) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/managed-by": "portfall",
+		reverseTunnelLabel:             name,
+	}
+}
+
+func relayPodName(name string) string {
+	return "portfall-relay-" + name
+}
+
+// deployedByRelay returns whether the labels mark an object Portfall deployed for the tunnel named name
+func deployedByRelay(labels map[string]string, name string) bool {
+	return labels["app.kubernetes.io/managed-by"] == "portfall" && labels[reverseTunnelLabel] == name
+}
+
+// podReady returns whether the pod is running and reports to be ready
+func podReady(pod *v1.Pod) bool {
+	if pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// deployRelay creates the relay pod and the service named name in front of it and waits for the pod to be ready.
+// Whatever this call created is deleted again if the relay doesn't become ready, existing objects of the same name
+// are left alone.
+func deployRelay(s kubernetes.Interface, image string, namespace string, name string, servicePort int32, timeout time.Duration) (*v1.Pod, error) {
+	labels := relayLabels(name)
+	nonRoot, user, readOnly, escalation := true, int64(relayUser), true, false
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: relayPodName(name), Namespace: namespace, Labels: labels},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name:  "relay",
+				Image: image,
+				Args: []string{
+					"--public-port=" + strconv.Itoa(relay.DefaultPublicPort),
+					"--control-port=" + strconv.Itoa(relay.DefaultControlPort),
+				},
+				// no probes as every connection to the relay is handed to Portfall
+				Ports: []v1.ContainerPort{
+					{Name: "public", ContainerPort: relay.DefaultPublicPort},
+					{Name: "control", ContainerPort: relay.DefaultControlPort},
+				},
+				// the relay only needs to accept and open connections
+				SecurityContext: &v1.SecurityContext{
+					RunAsNonRoot:             &nonRoot,
+					RunAsUser:                &user,
+					ReadOnlyRootFilesystem:   &readOnly,
+					AllowPrivilegeEscalation: &escalation,
+					Capabilities:             &v1.Capabilities{Drop: []v1.Capability{"ALL"}},
+				},
+			}},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+		Spec: v1.ServiceSpec{
+			Selector: labels,
+			Ports: []v1.ServicePort{{
+				Name:       "public",
+				Port:       servicePort,
+				TargetPort: intstr.FromString("public"),
+			}},
+		},
+	}
+	if _, err := s.CoreV1().Pods(namespace).Create(pod); err != nil {
+		return nil, err
+	}
+	if _, err := s.CoreV1().Services(namespace).Create(svc); err != nil {
+		// the service may belong to someone else, only the pod is ours
+		deleteRelayPod(s, namespace, name)
+		if apierrors.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("service %s/%s already exists", namespace, name)
+		}
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := s.CoreV1().Pods(namespace).Get(pod.Name, metav1.GetOptions{})
+		if err == nil && podReady(current) {
+			return current, nil
+		}
+		if time.Now().After(deadline) {
+			deleteRelay(s, namespace, name)
+			return nil, fmt.Errorf("relay pod %s did not become ready within %v", pod.Name, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// deleteRelay removes the relay pod and service of the tunnel named name, returning the first error. Objects which
+// don't carry the labels of the relay weren't deployed by Portfall and are kept.
+func deleteRelay(s kubernetes.Interface, namespace string, name string) error {
+	svcErr := deleteRelayService(s, namespace, name)
+	podErr := deleteRelayPod(s, namespace, name)
+	if svcErr != nil {
+		return svcErr
+	}
+	return podErr
+}
+
+func deleteRelayService(s kubernetes.Interface, namespace string, name string) error {
+	svc, err := s.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !deployedByRelay(svc.Labels, name) {
+		return fmt.Errorf("service %s/%s wasn't deployed by Portfall, leaving it", namespace, name)
+	}
+	return s.CoreV1().Services(namespace).Delete(name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &svc.UID},
+	})
+}
+
+func deleteRelayPod(s kubernetes.Interface, namespace string, name string) error {
+	pod, err := s.CoreV1().Pods(namespace).Get(relayPodName(name), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !deployedByRelay(pod.Labels, name) {
+		return fmt.Errorf("pod %s/%s wasn't deployed by Portfall, leaving it", namespace, pod.Name)
+	}
+	var gracePeriod int64
+	return s.CoreV1().Pods(namespace).Delete(pod.Name, &metav1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriod,
+		Preconditions:      &metav1.Preconditions{UID: &pod.UID},
+	})
+}
+
+// resettingStream fully closes a port-forward stream when closed instead of only closing its writing side
+type resettingStream struct {
+	httpstream.Stream
+}
+
+func (s *resettingStream) Close() error {
+	return s.Reset()
+}
+
+// relayDialer opens control connections to the relay pod through the tunnel
+func relayDialer(tunnel *podTunnel) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		podConn, err := tunnel.connection()
+		if err != nil {
+			return nil, err
+		}
+		stream, _, err := podConn.openStream(relay.DefaultControlPort)
+		if err != nil {
+			tunnel.close()
+			return nil, err
+		}
+		if s, ok := stream.(httpstream.Stream); ok {
+			return &resettingStream{s}, nil
+		}
+		return stream, nil
+	}
+}
+
+func (t *reverseTunnel) json() ReverseTunnel {
+	return ReverseTunnel{
+		Namespace:   t.namespace,
+		Name:        t.name,
+		LocalPort:   t.localPort,
+		ServicePort: t.servicePort,
+		Address:     fmt.Sprintf("%s.%s.svc.cluster.local:%d", t.name, t.namespace, t.servicePort),
+	}
+}
+
+// teardown stops relaying and deletes the relay from the cluster
+func (t *reverseTunnel) teardown(s kubernetes.Interface) error {
+	t.agent.Close()
+	if t.tunnel != nil {
+		t.tunnel.close()
+	}
+	return deleteRelay(s, t.namespace, t.name)
+}
+
+// ExposeLocalPort makes localhost:localPort reachable in the cluster as the service name:servicePort in the namespace
+// by deploying a relay pod and connecting to it over port-forward. An empty string is returned on success, otherwise
+// the reason the port couldn't be exposed.
+func (c *Client) ExposeLocalPort(namespace string, name string, localPort int, servicePort int) string {
+	key := namespace + "/" + name
+	if _, ok := c.reverseTunnels[key]; ok {
+		return fmt.Sprintf("%s is already exposed", key)
+	}
+	image := c.settings.RelayImage
+	if image == "" {
+		image = defaultRelayImage
+	}
+	pod, err := deployRelay(c.s, image, namespace, name, int32(servicePort), relayReadyTimeout)
+	if err != nil {
+		c.log.Warnf("failed to deploy the relay for %s: %v", key, err)
+		return err.Error()
+	}
+	tunnel := newPodTunnel(c.forwardConf, *pod, c.settings.forContext(c.currentContext).Transport, 0)
+	t := &reverseTunnel{
+		namespace:   namespace,
+		name:        name,
+		localPort:   int32(localPort),
+		servicePort: int32(servicePort),
+		tunnel:      tunnel,
+		agent:       relay.NewAgent(relayDialer(tunnel), net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)), relayPoolSize),
+	}
+	t.agent.Start()
+	if c.reverseTunnels == nil {
+		c.reverseTunnels = map[string]*reverseTunnel{}
+	}
+	c.reverseTunnels[key] = t
+	c.log.Infof("exposed local port %d as %s", localPort, t.json().Address)
+	return ""
+}
+
+// GetReverseTunnels returns a json list of the local ports exposed in the cluster
+func (c *Client) GetReverseTunnels() string {
+	tunnels := make([]ReverseTunnel, 0, len(c.reverseTunnels))
+	for _, t := range c.reverseTunnels {
+		tunnels = append(tunnels, t.json())
+	}
+	jBytes, _ := json.Marshal(tunnels)
+	return string(jBytes)
+}
+
+// RemoveReverseTunnel stops exposing the local port as the service name in the namespace and deletes its relay
+func (c *Client) RemoveReverseTunnel(namespace string, name string) {
+	key := namespace + "/" + name
+	t, ok := c.reverseTunnels[key]
+	if !ok {
+		return
+	}
+	delete(c.reverseTunnels, key)
+	if err := t.teardown(c.s); err != nil {
+		c.log.Warnf("failed to delete the relay of %s: %v", key, err)
+	}
+}
+
+// SetRelayImage sets the image of the relay pods deployed for reverse tunnels
+func (c *Client) SetRelayImage(image string) {
+	c.settings.RelayImage = image
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+}
+
+// removeAllReverseTunnels tears down every reverse tunnel, e.g. before leaving the context they were deployed in
+func (c *Client) removeAllReverseTunnels() {
+	for key, t := range c.reverseTunnels {
+		if err := t.teardown(c.s); err != nil {
+			c.log.Warnf("failed to delete the relay of %s: %v", key, err)
+		}
+		delete(c.reverseTunnels, key)
+	}
+}
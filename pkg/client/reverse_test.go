@@ -0,0 +1,145 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net"
+	"path/filepath"
+	"portfall/pkg/relay"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeClientsetWithReadyPods returns a fake clientset in which created pods are immediately running and ready
+func newFakeClientsetWithReadyPods() *fake.Clientset {
+	s := fake.NewSimpleClientset()
+	s.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*v1.Pod)
+		pod.Status.Phase = v1.PodRunning
+		pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+		return false, nil, nil
+	})
+	return s
+}
+
+func TestReverseTunnelDeployRelayAndTeardown(t *testing.T) {
+	s := newFakeClientsetWithReadyPods()
+	pod, err := deployRelay(s, "relay:test", "default", "webhook", 80, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := s.CoreV1().Services("default").Get("webhook", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !serviceSelectsPod(*svc, *pod) || svc.Spec.Ports[0].Port != 80 {
+		t.Errorf("expected the service to select the relay pod on port 80")
+	}
+	sc := pod.Spec.Containers[0].SecurityContext
+	if sc == nil || !*sc.RunAsNonRoot || !*sc.ReadOnlyRootFilesystem || *sc.AllowPrivilegeEscalation ||
+		len(sc.Capabilities.Drop) != 1 || sc.Capabilities.Drop[0] != "ALL" {
+		t.Errorf("expected the relay to run unprivileged got %+v", sc)
+	}
+
+	// relay to a local listener through an in-process relay standing in for the pod
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go serveListener(local, func(conn net.Conn) {
+		conn.Write([]byte("pong"))
+		conn.Close()
+	})
+	public, _ := net.Listen("tcp", "127.0.0.1:0")
+	control, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer public.Close()
+	defer control.Close()
+	server := relay.NewServer(2)
+	go server.ServeControl(control)
+	go server.ServePublic(public)
+
+	tunnel := &reverseTunnel{
+		namespace: "default",
+		name:      "webhook",
+		agent: relay.NewAgent(func() (io.ReadWriteCloser, error) {
+			return net.Dial("tcp", control.Addr().String())
+		}, local.Addr().String(), 2),
+	}
+	tunnel.agent.Start()
+	conn, err := net.Dial("tcp", public.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+		t.Errorf("expected the relayed connection to reach the local port got %q %v", buf, err)
+	}
+	conn.Close()
+
+	if err := tunnel.teardown(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CoreV1().Pods("default").Get(pod.Name, metav1.GetOptions{}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected the relay pod to be deleted got %v", err)
+	}
+	if _, err := s.CoreV1().Services("default").Get("webhook", metav1.GetOptions{}); err == nil {
+		t.Error("expected the relay service to be deleted")
+	}
+}
+
+func TestDeployRelayCleansUpWhenNotReady(t *testing.T) {
+	s := fake.NewSimpleClientset()
+	if _, err := deployRelay(s, "relay:test", "default", "webhook", 80, 0); err == nil {
+		t.Fatal("expected a relay which never becomes ready to fail")
+	}
+	pods, _ := s.CoreV1().Pods("default").List(metav1.ListOptions{})
+	services, _ := s.CoreV1().Services("default").List(metav1.ListOptions{})
+	if len(pods.Items) != 0 || len(services.Items) != 0 {
+		t.Errorf("expected the relay to be cleaned up got %d pods and %d services", len(pods.Items), len(services.Items))
+	}
+}
+
+func TestDeployRelayKeepsExistingService(t *testing.T) {
+	s := newFakeClientsetWithReadyPods()
+	s.CoreV1().Services("default").Create(&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"}})
+	if _, err := deployRelay(s, "relay:test", "default", "api", 80, time.Second); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected the existing service to be reported got %v", err)
+	}
+	if _, err := s.CoreV1().Services("default").Get("api", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the existing service to be kept got %v", err)
+	}
+	if pods, _ := s.CoreV1().Pods("default").List(metav1.ListOptions{}); len(pods.Items) != 0 {
+		t.Errorf("expected the relay pod to be rolled back got %d pods", len(pods.Items))
+	}
+	if err := deleteRelay(s, "default", "api"); err == nil {
+		t.Error("expected deleting a service which isn't a relay to fail")
+	}
+	if _, err := s.CoreV1().Services("default").Get("api", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected a service without the relay labels not to be deleted got %v", err)
+	}
+}
+
+func TestDefaultRelayImageMatchesVersion(t *testing.T) {
+	content, err := ioutil.ReadFile(filepath.Join("..", "..", "project.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var project struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(content, &project); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(defaultRelayImage, ":"+project.Version) {
+		t.Errorf("expected the relay image to be pinned to the released version %s got %s", project.Version, defaultRelayImage)
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rewriteRules keep apps which assume their in-cluster or external hostname inside the tunnel
+type rewriteRules struct {
+	// Hosts are upstream hosts, optionally with a port, rewritten to the local url in addition to the names of the
+	// website's service
+	Hosts []string `json:"hosts,omitempty"`
+	// HTML rewrites absolute urls of the hosts in html responses as well
+	HTML bool `json:"html,omitempty"`
+	// PathPrefix serves the app under the prefix locally, it is removed before requests are sent upstream
+	PathPrefix string `json:"pathPrefix,omitempty"`
+}
+
+// rewriter rewrites the responses of upstream hosts to the local origin and path prefix
+type rewriter struct {
+	// hosts matches absolute and protocol relative urls of the upstream hosts, the first group is what follows them
+	hosts  *regexp.Regexp
+	origin string
+	prefix string
+	html   bool
+}
+
+// rootRelativeAttr matches html attributes with root relative urls, which need the path prefix
+var rootRelativeAttr = regexp.MustCompile(`(?i)(\s(?:href|src|action)\s*=\s*["'])/([^/])`)
+
+// normalizePathPrefix returns the prefix with a leading but no trailing slash, an empty string for the root
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+func newRewriter(rules *rewriteRules, origin string, hostnames []string) (*rewriter, error) {
+	rw := &rewriter{origin: origin, prefix: normalizePathPrefix(rules.PathPrefix), html: rules.HTML}
+	var quoted []string
+	for _, host := range append(append([]string(nil), rules.Hosts...), hostnames...) {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if strings.ContainsAny(host, "/?#") {
+			return nil, fmt.Errorf("%s is not a host", host)
+		}
+		quoted = append(quoted, regexp.QuoteMeta(host))
+	}
+	if len(quoted) > 0 {
+		pattern := `(?i)(?:https?:)?//(?:` + strings.Join(quoted, "|") + `)(?::\d+)?([/?#"'\s<>]|$)`
+		rw.hosts = regexp.MustCompile(pattern)
+	}
+	return rw, nil
+}
+
+// handler serves the prefix by removing it from requests before passing them to next
+func (rw *rewriter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rw.prefix != "" {
+			if r.URL.Path == "/" {
+				http.Redirect(w, r, rw.prefix+"/", http.StatusFound)
+				return
+			}
+			if r.URL.Path != rw.prefix && !strings.HasPrefix(r.URL.Path, rw.prefix+"/") {
+				http.NotFound(w, r)
+				return
+			}
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, rw.prefix)
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+			r.URL.RawPath = ""
+			r.Header.Set("X-Forwarded-Prefix", rw.prefix)
+		}
+		if rw.html {
+			// the transport then negotiates compression itself and hands the body over decompressed
+			r.Header.Del("Accept-Encoding")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// location rewrites a redirect target to the local origin
+func (rw *rewriter) location(loc string) string {
+	if rw.hosts != nil {
+		if m := rw.hosts.FindStringSubmatchIndex(loc); m != nil && m[0] == 0 {
+			rest := loc[m[2]:]
+			if rest == "" {
+				rest = "/"
+			}
+			return rw.origin + rw.prefix + rest
+		}
+	}
+	if strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		return rw.prefix + loc
+	}
+	return loc
+}
+
+// cookie rewrites a Set-Cookie header to the local origin. The domain is dropped, which makes the cookie a host-only
+// cookie of the local host as browsers reject cookies for domains the response didn't come from.
+func (rw *rewriter) cookie(header string) string {
+	parts := strings.Split(header, ";")
+	out := parts[:1]
+	for _, part := range parts[1:] {
+		attr := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		switch strings.ToLower(attr[0]) {
+		case "domain":
+			continue
+		case "path":
+			if rw.prefix != "" && len(attr) == 2 && strings.HasPrefix(attr[1], "/") {
+				part = " Path=" + rw.prefix + strings.TrimSuffix(attr[1], "/")
+			}
+		}
+		out = append(out, part)
+	}
+	return strings.Join(out, ";")
+}
+
+// rewriteHTML rewrites absolute urls of the hosts and, under a prefix, root relative links
+func (rw *rewriter) rewriteHTML(body []byte) []byte {
+	if rw.hosts != nil {
+		replacement := strings.Replace(rw.origin+rw.prefix, "$", "$$", -1) + "${1}"
+		body = rw.hosts.ReplaceAll(body, []byte(replacement))
+	}
+	if rw.prefix != "" {
+		replacement := "${1}" + strings.Replace(rw.prefix, "$", "$$", -1) + "/${2}"
+		body = rootRelativeAttr.ReplaceAll(body, []byte(replacement))
+	}
+	return body
+}
+
+func (rw *rewriter) modifyResponse(resp *http.Response) error {
+	if loc := resp.Header.Get("Location"); loc != "" {
+		resp.Header.Set("Location", rw.location(loc))
+	}
+	for i, header := range resp.Header["Set-Cookie"] {
+		resp.Header["Set-Cookie"][i] = rw.cookie(header)
+	}
+	if !rw.html || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	body = rw.rewriteHTML(body)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// SetWebsiteRewrite serves the website on localAddress:localPort through a rewriting proxy on its own port. Redirects
+// and cookies of the hosts and of the website's service names are rewritten to the proxy's url, and with html the
+// absolute urls in html responses as well. With a pathPrefix the app is served under that prefix. Disabling removes
+// the rewriting again. An empty string is returned on success, otherwise the reason it failed.
+func (c *Client) SetWebsiteRewrite(localAddress string, localPort int, enabled bool, hosts []string, html bool, pathPrefix string) string {
+	return c.updateWebsiteRules(localAddress, localPort, func(rules *websiteRules) error {
+		if !enabled {
+			rules.Rewrite = nil
+			return nil
+		}
+		rewrite := &rewriteRules{Hosts: hosts, HTML: html, PathPrefix: normalizePathPrefix(pathPrefix)}
+		if _, err := newRewriter(rewrite, "", nil); err != nil {
+			return err
+		}
+		rules.Rewrite = rewrite
+		return nil
+	})
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRewriterLocation(t *testing.T) {
+	rw, err := newRewriter(&rewriteRules{Hosts: []string{"keycloak.example.com"}, PathPrefix: "auth/"}, "http://localhost:1234", serviceHostnames("keycloak", "iam"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for loc, expected := range map[string]string{
+		"https://keycloak.example.com/realms/master":         "http://localhost:1234/auth/realms/master",
+		"http://keycloak.iam.svc.cluster.local:8080?x=1":     "http://localhost:1234/auth?x=1",
+		"https://keycloak.example.com":                       "http://localhost:1234/auth/",
+		"https://keycloak.example.com.evil.com/":             "https://keycloak.example.com.evil.com/",
+		"https://accounts.google.com/?r=//keycloak.iam/back": "https://accounts.google.com/?r=//keycloak.iam/back",
+		"/login": "/auth/login",
+		"login":  "login",
+	} {
+		if actual := rw.location(loc); actual != expected {
+			t.Errorf("expected %s to be rewritten to %s got %s", loc, expected, actual)
+		}
+	}
+}
+
+func TestRewriterCookie(t *testing.T) {
+	rw, _ := newRewriter(&rewriteRules{PathPrefix: "/jenkins"}, "http://localhost:1234", nil)
+	actual := rw.cookie("JSESSIONID=abc; Domain=.example.com; Path=/; HttpOnly")
+	if expected := "JSESSIONID=abc; Path=/jenkins; HttpOnly"; actual != expected {
+		t.Errorf("expected %s got %s", expected, actual)
+	}
+}
+
+func TestWebsiteProxyRewritesHTML(t *testing.T) {
+	var upstreamPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<a href="https://alertmanager.example.com/#/alerts">alerts</a><script src="/static/app.js"></script>`))
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	localPort, _ := strconv.Atoi(port)
+
+	p, err := startWebsiteProxy(&Website{LocalPort: int32(localPort)}, &websiteRules{
+		Rewrite: &rewriteRules{Hosts: []string{"alertmanager.example.com"}, HTML: true, PathPrefix: "/am"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	if !strings.HasSuffix(p.url, "/am/") {
+		t.Fatalf("expected the website to be opened under its prefix got %s", p.url)
+	}
+
+	resp, err := http.Get(p.url + "index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if upstreamPath != "/index.html" {
+		t.Errorf("expected the prefix to be removed upstream got %s", upstreamPath)
+	}
+	origin := strings.TrimSuffix(p.url, "/am/")
+	expected := `<a href="` + origin + `/am/#/alerts">alerts</a><script src="/am/static/app.js"></script>`
+	if string(body) != expected {
+		t.Errorf("expected %s got %s", expected, body)
+	}
+}
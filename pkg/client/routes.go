@@ -0,0 +1,436 @@
+package client
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// gatewayAPIVersions are the versions of the Gateway API tried in order, the first one served by the cluster is used
+var gatewayAPIVersions = []string{"v1", "v1beta1", "v1alpha2"}
+
+const gatewayAPIGroup = "gateway.networking.k8s.io"
+
+// ingressesV1 are the Ingresses of Kubernetes 1.19 and later, which the typed client predates
+var ingressesV1 = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+
+// externalRoute is an external url of a service, published by an Ingress or an HTTPRoute
+type externalRoute struct {
+	// source is the kind and name of the object publishing the route, e.g. Ingress/grafana
+	source    string
+	namespace string
+	url       string
+	service   string
+	port      intstr.IntOrString
+}
+
+// routePath turns the path of a route, which may be a prefix or a regular expression, into a path a browser can open
+func routePath(path string) string {
+	if i := strings.IndexAny(path, "*([$^"); i >= 0 {
+		path = path[:i]
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+func routeURL(scheme string, host string, path string) string {
+	return scheme + "://" + host + routePath(path)
+}
+
+// ingressRoutes returns the routes of the Ingress to its backend services. Hosts with tls are linked over https, rules
+// without a host are linked to the address of the load balancer.
+func ingressRoutes(ing v1beta1.Ingress) []externalRoute {
+	tlsHosts := map[string]bool{}
+	for _, tls := range ing.Spec.TLS {
+		for _, host := range tls.Hosts {
+			tlsHosts[host] = true
+		}
+	}
+	var address string
+	for _, lb := range ing.Status.LoadBalancer.Ingress {
+		address = lb.Hostname
+		if address == "" {
+			address = lb.IP
+		}
+		if address != "" {
+			break
+		}
+	}
+	route := func(host string, path string, backend v1beta1.IngressBackend) (externalRoute, bool) {
+		scheme := "http"
+		if tlsHosts[host] {
+			scheme = "https"
+		}
+		if host == "" || strings.HasPrefix(host, "*") {
+			host = address
+		}
+		if host == "" || backend.ServiceName == "" {
+			return externalRoute{}, false
+		}
+		return externalRoute{
+			source:    "Ingress/" + ing.Name,
+			namespace: ing.Namespace,
+			url:       routeURL(scheme, host, path),
+			service:   backend.ServiceName,
+			port:      backend.ServicePort,
+		}, true
+	}
+
+	var routes []externalRoute
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			if r, ok := route(rule.Host, p.Path, p.Backend); ok {
+				routes = append(routes, r)
+			}
+		}
+	}
+	if ing.Spec.Backend != nil {
+		if r, ok := route("", "/", *ing.Spec.Backend); ok {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// gatewayListener is what a route needs to know about the Gateway it is attached to
+type gatewayListener struct {
+	scheme  string
+	address string
+}
+
+// httpRouteRoutes returns the routes of the HTTPRoute to its backend services. The gateway looks up the Gateway a
+// parent reference points to, it is nil if it couldn't be found.
+func httpRouteRoutes(route *unstructured.Unstructured, gateway func(namespace string, name string) *gatewayListener) []externalRoute {
+	hostnames, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	scheme, address := "http", ""
+	parentRefs, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	for _, ref := range parentRefs {
+		refMap, ok := ref.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(refMap, "name")
+		namespace, _, _ := unstructured.NestedString(refMap, "namespace")
+		if namespace == "" {
+			namespace = route.GetNamespace()
+		}
+		if gw := gateway(namespace, name); gw != nil {
+			scheme, address = gw.scheme, gw.address
+			break
+		}
+	}
+	host := address
+	for _, hostname := range hostnames {
+		if !strings.HasPrefix(hostname, "*") {
+			host = hostname
+			break
+		}
+	}
+	if host == "" {
+		return nil
+	}
+
+	var routes []externalRoute
+	rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	for _, rule := range rules {
+		ruleMap, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		path := "/"
+		matches, _, _ := unstructured.NestedSlice(ruleMap, "matches")
+		if len(matches) > 0 {
+			if match, ok := matches[0].(map[string]interface{}); ok {
+				if value, ok, _ := unstructured.NestedString(match, "path", "value"); ok {
+					path = value
+				}
+			}
+		}
+		backendRefs, _, _ := unstructured.NestedSlice(ruleMap, "backendRefs")
+		for _, backendRef := range backendRefs {
+			refMap, ok := backendRef.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			kind, _, _ := unstructured.NestedString(refMap, "kind")
+			namespace, _, _ := unstructured.NestedString(refMap, "namespace")
+			if (kind != "" && kind != "Service") || (namespace != "" && namespace != route.GetNamespace()) {
+				continue
+			}
+			name, _, _ := unstructured.NestedString(refMap, "name")
+			port, _, _ := unstructured.NestedInt64(refMap, "port")
+			routes = append(routes, externalRoute{
+				source:    "HTTPRoute/" + route.GetName(),
+				namespace: route.GetNamespace(),
+				url:       routeURL(scheme, host, path),
+				service:   name,
+				port:      intstr.FromInt(int(port)),
+			})
+		}
+	}
+	return routes
+}
+
+// gatewayListenerOf returns the scheme and address of the Gateway, https if any of its listeners terminates tls
+func gatewayListenerOf(gw *unstructured.Unstructured) *gatewayListener {
+	l := &gatewayListener{scheme: "http"}
+	listeners, _, _ := unstructured.NestedSlice(gw.Object, "spec", "listeners")
+	for _, listener := range listeners {
+		if listenerMap, ok := listener.(map[string]interface{}); ok {
+			if protocol, _, _ := unstructured.NestedString(listenerMap, "protocol"); protocol == "HTTPS" {
+				l.scheme = "https"
+			}
+		}
+	}
+	addresses, _, _ := unstructured.NestedSlice(gw.Object, "status", "addresses")
+	if len(addresses) > 0 {
+		if addr, ok := addresses[0].(map[string]interface{}); ok {
+			l.address, _, _ = unstructured.NestedString(addr, "value")
+		}
+	}
+	return l
+}
+
+// dynamicClient returns the client for resources without a typed client such as the Gateway API
+func (c *Client) dynamicClient() (dynamic.Interface, error) {
+	if c.dyn != nil {
+		return c.dyn, nil
+	}
+	return dynamic.NewForConfig(c.conf)
+}
+
+// discoverRoutes lists the Ingresses and HTTPRoutes of the namespace, all namespaces if it is empty, and returns their
+// routes by the namespace/name of their service. Resources the cluster doesn't serve are skipped.
+func (c *Client) discoverRoutes(namespace string) map[string][]externalRoute {
+	dyn, err := c.dynamicClient()
+	if err != nil {
+		c.log.Infof("not listing http routes: %v", err)
+	}
+	routes := c.discoverIngresses(dyn, namespace)
+	if dyn != nil {
+		routes = append(routes, c.discoverHTTPRoutes(dyn, namespace)...)
+	}
+
+	byService := map[string][]externalRoute{}
+	for _, r := range routes {
+		key := r.namespace + "/" + r.service
+		byService[key] = append(byService[key], r)
+	}
+	for _, rs := range byService {
+		sort.Slice(rs, func(i, j int) bool {
+			return rs[i].source < rs[j].source
+		})
+	}
+	return byService
+}
+
+// discoverIngresses lists the networking.k8s.io/v1 Ingresses through the dynamic client. The v1beta1 Ingresses, which
+// were removed in Kubernetes 1.22, are only listed if the cluster doesn't serve v1 or there is no dynamic client.
+func (c *Client) discoverIngresses(dyn dynamic.Interface, namespace string) []externalRoute {
+	if dyn != nil {
+		list, err := dyn.Resource(ingressesV1).Namespace(namespace).List(metav1.ListOptions{})
+		if err == nil {
+			var routes []externalRoute
+			for i := range list.Items {
+				ing, err := ingressFromV1(&list.Items[i])
+				if err != nil {
+					c.log.Infof("not reading ingress %s/%s: %v", list.Items[i].GetNamespace(), list.Items[i].GetName(), err)
+					continue
+				}
+				routes = append(routes, ingressRoutes(ing)...)
+			}
+			return routes
+		}
+		if !apierrors.IsNotFound(err) {
+			c.log.Infof("not listing ingresses: %v", err)
+			return nil
+		}
+	}
+	ingresses, err := c.s.NetworkingV1beta1().Ingresses(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		c.log.Infof("not listing ingresses: %v", err)
+		return nil
+	}
+	var routes []externalRoute
+	for _, ing := range ingresses.Items {
+		routes = append(routes, ingressRoutes(ing)...)
+	}
+	return routes
+}
+
+// ingressFromV1 reads a networking.k8s.io/v1 Ingress into the v1beta1 type. Only the backends differ, v1 nests the
+// service and its port in a service object and renames the default backend.
+func ingressFromV1(obj *unstructured.Unstructured) (v1beta1.Ingress, error) {
+	var ing v1beta1.Ingress
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &ing); err != nil {
+		return ing, err
+	}
+	if backend, ok, _ := unstructured.NestedMap(obj.Object, "spec", "defaultBackend"); ok {
+		b := ingressBackendFromV1(backend)
+		ing.Spec.Backend = &b
+	}
+	rules, _, _ := unstructured.NestedSlice(obj.Object, "spec", "rules")
+	for i, rule := range rules {
+		ruleMap, ok := rule.(map[string]interface{})
+		if !ok || i >= len(ing.Spec.Rules) || ing.Spec.Rules[i].HTTP == nil {
+			continue
+		}
+		paths, _, _ := unstructured.NestedSlice(ruleMap, "http", "paths")
+		for j, path := range paths {
+			pathMap, ok := path.(map[string]interface{})
+			if !ok || j >= len(ing.Spec.Rules[i].HTTP.Paths) {
+				continue
+			}
+			if backend, ok, _ := unstructured.NestedMap(pathMap, "backend"); ok {
+				ing.Spec.Rules[i].HTTP.Paths[j].Backend = ingressBackendFromV1(backend)
+			}
+		}
+	}
+	return ing, nil
+}
+
+// ingressBackendFromV1 reads the service of a v1 backend, which has no service name if it is a resource backend
+func ingressBackendFromV1(backend map[string]interface{}) v1beta1.IngressBackend {
+	var b v1beta1.IngressBackend
+	b.ServiceName, _, _ = unstructured.NestedString(backend, "service", "name")
+	if number, ok, _ := unstructured.NestedInt64(backend, "service", "port", "number"); ok {
+		b.ServicePort = intstr.FromInt(int(number))
+	} else {
+		name, _, _ := unstructured.NestedString(backend, "service", "port", "name")
+		b.ServicePort = intstr.FromString(name)
+	}
+	return b
+}
+
+func (c *Client) discoverHTTPRoutes(dyn dynamic.Interface, namespace string) []externalRoute {
+	for _, version := range gatewayAPIVersions {
+		httpRoutes := schema.GroupVersionResource{Group: gatewayAPIGroup, Version: version, Resource: "httproutes"}
+		list, err := dyn.Resource(httpRoutes).Namespace(namespace).List(metav1.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			c.log.Infof("not listing http routes: %v", err)
+			return nil
+		}
+		gateways := schema.GroupVersionResource{Group: gatewayAPIGroup, Version: version, Resource: "gateways"}
+		cache := map[string]*gatewayListener{}
+		gateway := func(ns string, name string) *gatewayListener {
+			key := ns + "/" + name
+			if l, ok := cache[key]; ok {
+				return l
+			}
+			var l *gatewayListener
+			if gw, err := dyn.Resource(gateways).Namespace(ns).Get(name, metav1.GetOptions{}); err == nil {
+				l = gatewayListenerOf(gw)
+			}
+			cache[key] = l
+			return l
+		}
+		var routes []externalRoute
+		for i := range list.Items {
+			routes = append(routes, httpRouteRoutes(&list.Items[i], gateway)...)
+		}
+		return routes
+	}
+	return nil
+}
+
+// targets returns whether the route points at the service port, which it may name or give by number
+func (r externalRoute) targets(port int32, portName string) bool {
+	if r.port.Type == intstr.String {
+		return r.port.StrVal == portName || r.port.StrVal == strconv.Itoa(int(port))
+	}
+	return r.port.IntVal == port
+}
+
+// attachRoutes links the candidates of services to the first route published for their service port
+func attachRoutes(candidates []websiteCandidate, namespace string, services *v1.ServiceList, routes map[string][]externalRoute) []websiteCandidate {
+	for i, cand := range candidates {
+		if cand.resourceType != "service" {
+			continue
+		}
+		var portName string
+		for _, svc := range services.Items {
+			if svc.Namespace != namespace || svc.Name != cand.resourceName {
+				continue
+			}
+			for _, p := range svc.Spec.Ports {
+				if p.Port == cand.servicePort {
+					portName = p.Name
+				}
+			}
+		}
+		for _, r := range routes[namespace+"/"+cand.resourceName] {
+			if r.targets(cand.servicePort, portName) {
+				candidates[i].route = r.source
+				candidates[i].externalURL = r.url
+				break
+			}
+		}
+	}
+	return candidates
+}
+
+// unclaimedRoutes returns the routes no forwarded website serves, e.g. because their service has no running pod or
+// forwarding is forbidden, once per url. Routes of namespaces which are already active are left out.
+func (s *discoveryScope) unclaimedRoutes(websites []*Website) []externalRoute {
+	claimed := map[string]bool{}
+	for _, w := range websites {
+		if w.Kind == kindDirect {
+			continue
+		}
+		req := w.portForwardReq
+		for _, name := range req.serviceNames() {
+			for _, svc := range s.services.Items {
+				if svc.Namespace != req.Pod.Namespace || svc.Name != name {
+					continue
+				}
+				for _, p := range svc.Spec.Ports {
+					// aliases are services targeting the forwarded pod port
+					served := (name == req.ServiceName && p.Port == req.ServicePort) ||
+						(p.TargetPort.Type == intstr.Int && p.TargetPort.IntVal == req.PodPort)
+					if !served {
+						continue
+					}
+					for _, r := range s.routes[svc.Namespace+"/"+svc.Name] {
+						if r.targets(p.Port, p.Name) {
+							claimed[r.url] = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(s.routes))
+	for key := range s.routes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var unclaimed []externalRoute
+	for _, key := range keys {
+		for _, r := range s.routes[key] {
+			if claimed[r.url] || s.skipped(r.namespace) {
+				continue
+			}
+			claimed[r.url] = true
+			unclaimed = append(unclaimed, r)
+		}
+	}
+	return unclaimed
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+func TestIngressRoutes(t *testing.T) {
+	ing := v1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "grafana", Namespace: "monitoring"},
+		Spec: v1beta1.IngressSpec{
+			TLS: []v1beta1.IngressTLS{{Hosts: []string{"grafana.example.com"}}},
+			Rules: []v1beta1.IngressRule{{
+				Host: "grafana.example.com",
+				IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{Paths: []v1beta1.HTTPIngressPath{
+					{Path: "/grafana(/|$)(.*)", Backend: v1beta1.IngressBackend{ServiceName: "grafana", ServicePort: intstr.FromString("http")}},
+				}}},
+			}, {
+				IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{Paths: []v1beta1.HTTPIngressPath{
+					{Path: "/prometheus", Backend: v1beta1.IngressBackend{ServiceName: "prometheus", ServicePort: intstr.FromInt(9090)}},
+				}}},
+			}},
+		},
+		Status: v1beta1.IngressStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "203.0.113.7"}}}},
+	}
+	routes := ingressRoutes(ing)
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes got %d", len(routes))
+	}
+	if routes[0].url != "https://grafana.example.com/grafana" || routes[0].service != "grafana" || routes[0].source != "Ingress/grafana" {
+		t.Errorf("unexpected route %+v", routes[0])
+	}
+	if routes[1].url != "http://203.0.113.7/prometheus" || routes[1].port.IntVal != 9090 {
+		t.Errorf("expected rules without a host to use the load balancer got %+v", routes[1])
+	}
+}
+
+func TestHTTPRouteRoutes(t *testing.T) {
+	route := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "argocd", "namespace": "argocd"},
+		"spec": map[string]interface{}{
+			"hostnames":  []interface{}{"*.example.com", "argocd.example.com"},
+			"parentRefs": []interface{}{map[string]interface{}{"name": "public", "namespace": "gateways"}},
+			"rules": []interface{}{map[string]interface{}{
+				"matches":     []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/ui"}}},
+				"backendRefs": []interface{}{map[string]interface{}{"name": "argocd-server", "port": int64(80)}},
+			}},
+		},
+	}}
+	gateway := func(namespace string, name string) *gatewayListener {
+		if namespace != "gateways" || name != "public" {
+			t.Errorf("expected the parent gateway to be looked up got %s/%s", namespace, name)
+		}
+		return gatewayListenerOf(&unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"listeners": []interface{}{map[string]interface{}{"protocol": "HTTPS"}}},
+		}})
+	}
+	routes := httpRouteRoutes(route, gateway)
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 route got %d", len(routes))
+	}
+	if r := routes[0]; r.url != "https://argocd.example.com/ui" || r.service != "argocd-server" || r.port.IntVal != 80 {
+		t.Errorf("unexpected route %+v", r)
+	}
+}
+
+func TestAttachRoutes(t *testing.T) {
+	services := &v1.ServiceList{Items: []v1.Service{{
+		ObjectMeta: metav1.ObjectMeta{Name: "grafana", Namespace: "monitoring"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}, {Name: "metrics", Port: 9100}}},
+	}}}
+	routes := map[string][]externalRoute{"monitoring/grafana": {{
+		source: "Ingress/grafana", url: "https://grafana.example.com/", service: "grafana", port: intstr.FromString("http"),
+	}}}
+	candidates := attachRoutes([]websiteCandidate{
+		{port: 3000, resourceName: "grafana", resourceType: "service", servicePort: 80},
+		{port: 9100, resourceName: "grafana", resourceType: "service", servicePort: 9100},
+	}, "monitoring", services, routes)
+	if candidates[0].externalURL != "https://grafana.example.com/" || candidates[0].route != "Ingress/grafana" {
+		t.Errorf("expected the http port to be linked to the ingress got %+v", candidates[0])
+	}
+	if candidates[1].externalURL != "" {
+		t.Errorf("expected the metrics port not to be linked got %+v", candidates[1])
+	}
+}
+
+// ingressV1 is a networking.k8s.io/v1 Ingress with a named port, a port number and a default backend
+func ingressV1() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.k8s.io/v1",
+		"kind":       "Ingress",
+		"metadata":   map[string]interface{}{"name": "shop", "namespace": "shop"},
+		"spec": map[string]interface{}{
+			"defaultBackend": map[string]interface{}{
+				"service": map[string]interface{}{"name": "frontend", "port": map[string]interface{}{"number": int64(80)}},
+			},
+			"rules": []interface{}{map[string]interface{}{
+				"host": "shop.example.com",
+				"http": map[string]interface{}{"paths": []interface{}{map[string]interface{}{
+					"path":     "/api",
+					"pathType": "Prefix",
+					"backend": map[string]interface{}{
+						"service": map[string]interface{}{"name": "api", "port": map[string]interface{}{"name": "http"}},
+					},
+				}}},
+			}},
+		},
+		"status": map[string]interface{}{
+			"loadBalancer": map[string]interface{}{"ingress": []interface{}{map[string]interface{}{"ip": "203.0.113.9"}}},
+		},
+	}}
+}
+
+// legacyIngress is a v1beta1 Ingress which is only served by clusters before Kubernetes 1.22
+func legacyIngress() *v1beta1.Ingress {
+	return &v1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "shop"},
+		Spec: v1beta1.IngressSpec{Rules: []v1beta1.IngressRule{{
+			Host: "legacy.example.com",
+			IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{Paths: []v1beta1.HTTPIngressPath{
+				{Backend: v1beta1.IngressBackend{ServiceName: "legacy", ServicePort: intstr.FromInt(8080)}},
+			}}},
+		}}},
+	}
+}
+
+func TestDiscoverIngressesPrefersV1(t *testing.T) {
+	c := &Client{s: fake.NewSimpleClientset(legacyIngress())}
+	routes := c.discoverIngresses(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), ingressV1()), "shop")
+	if len(routes) != 2 {
+		t.Fatalf("expected the 2 routes of the v1 ingress got %+v", routes)
+	}
+	if r := routes[0]; r.url != "http://shop.example.com/api" || r.service != "api" || r.port != intstr.FromString("http") || r.source != "Ingress/shop" {
+		t.Errorf("unexpected path route %+v", r)
+	}
+	if r := routes[1]; r.url != "http://203.0.113.9/" || r.service != "frontend" || r.port != intstr.FromInt(80) {
+		t.Errorf("expected the default backend to use the load balancer got %+v", r)
+	}
+}
+
+func TestDiscoverIngressesFallsBackToV1beta1(t *testing.T) {
+	c := &Client{s: fake.NewSimpleClientset(legacyIngress())}
+	dyn := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), ingressV1())
+	dyn.PrependReactor("list", "ingresses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(ingressesV1.GroupResource(), "")
+	})
+	routes := c.discoverIngresses(dyn, "shop")
+	if len(routes) != 1 || routes[0].url != "http://legacy.example.com/" || routes[0].service != "legacy" {
+		t.Errorf("expected the v1beta1 ingress on clusters without v1 got %+v", routes)
+	}
+	if routes := c.discoverIngresses(nil, "shop"); len(routes) != 1 {
+		t.Errorf("expected the v1beta1 ingress without a dynamic client got %+v", routes)
+	}
+}
+
+func TestUnclaimedRoutes(t *testing.T) {
+	services := &v1.ServiceList{Items: []v1.Service{{
+		ObjectMeta: metav1.ObjectMeta{Name: "grafana", Namespace: "monitoring"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt(3000)}}},
+	}, {
+		ObjectMeta: metav1.ObjectMeta{Name: "grafana-public", Namespace: "monitoring"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 443, TargetPort: intstr.FromInt(3000)}}},
+	}}}
+	routes := map[string][]externalRoute{
+		"monitoring/grafana":        {{namespace: "monitoring", url: "https://grafana.example.com/", service: "grafana", port: intstr.FromString("http")}},
+		"monitoring/grafana-public": {{namespace: "monitoring", url: "https://grafana.example.org/", service: "grafana-public", port: intstr.FromInt(443)}},
+		"monitoring/docs": {
+			{source: "Ingress/docs", namespace: "monitoring", url: "https://docs.example.com/", service: "docs", port: intstr.FromInt(80)},
+			{source: "HTTPRoute/docs", namespace: "monitoring", url: "https://docs.example.com/", service: "docs", port: intstr.FromInt(80)},
+		},
+		"kube-system/dashboard": {{namespace: "kube-system", url: "https://dashboard.example.com/", service: "dashboard", port: intstr.FromInt(80)}},
+	}
+	scope := &discoveryScope{
+		c:         &Client{activeNamespaces: []string{"kube-system"}},
+		namespace: "All Namespaces",
+		services:  services,
+		routes:    routes,
+	}
+	grafana := &Website{Kind: kindForward, portForwardReq: portForwardPodRequest{
+		Pod:            v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "grafana-0", Namespace: "monitoring"}},
+		PodPort:        3000,
+		ServiceName:    "grafana",
+		ServicePort:    80,
+		ServiceAliases: []string{"grafana-public"},
+	}}
+
+	unclaimed := scope.unclaimedRoutes([]*Website{grafana})
+	if len(unclaimed) != 1 || unclaimed[0].url != "https://docs.example.com/" || unclaimed[0].source != "Ingress/docs" {
+		t.Errorf("expected only the route of the service without a forward once got %+v", unclaimed)
+	}
+}
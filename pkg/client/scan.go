@@ -0,0 +1,260 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// portSourceScan is the source of ports found listening by scanning a pod
+const portSourceScan = "scan"
+
+// tcpListen is the state of listening sockets in /proc/net/tcp
+const tcpListen = "0A"
+
+// ListeningPort is a tcp port a pod listens on, found by scanning it
+type ListeningPort struct {
+	Port int32 `json:"port"`
+	// Addresses are the addresses the port is bound on, 0.0.0.0 and :: for all of them
+	Addresses []string `json:"addresses"`
+	// Forwarded is whether the port is served by a website already
+	Forwarded bool `json:"forwarded"`
+}
+
+// listeningSocket is a single listening socket of a scan
+type listeningSocket struct {
+	address string
+	port    int32
+}
+
+// scanCommand runs a command in the container, returning its output
+type scanCommand func(command []string) (string, error)
+
+// scanners are the commands listing the listening sockets of a pod in the order they are tried, with the parser of
+// their output. /proc is read first as it needs nothing but cat in the image.
+var scanners = []struct {
+	command []string
+	parse   func(string) []listeningSocket
+}{
+	{[]string{"cat", "/proc/net/tcp", "/proc/net/tcp6"}, parseProcNetTCP},
+	{[]string{"ss", "-ltn"}, parseSocketTable},
+	{[]string{"netstat", "-ltn"}, parseSocketTable},
+}
+
+// decodeProcAddress decodes an address of /proc/net/tcp such as 0100007F:1F90, which holds the ip as 32 bit words in
+// host byte order, little endian on all platforms Kubernetes runs on
+func decodeProcAddress(s string) (listeningSocket, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return listeningSocket{}, false
+	}
+	ip, err := hex.DecodeString(parts[0])
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return listeningSocket{}, false
+	}
+	for i := 0; i < len(ip); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = ip[i+3], ip[i+2], ip[i+1], ip[i]
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return listeningSocket{}, false
+	}
+	return listeningSocket{address: net.IP(ip).String(), port: int32(port)}, true
+}
+
+// parseProcNetTCP returns the listening sockets of the content of /proc/net/tcp and /proc/net/tcp6
+func parseProcNetTCP(content string) []listeningSocket {
+	var sockets []listeningSocket
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// sl local_address rem_address st ...
+		if len(fields) < 4 || !strings.HasSuffix(fields[0], ":") || fields[3] != tcpListen {
+			continue
+		}
+		if socket, ok := decodeProcAddress(fields[1]); ok {
+			sockets = append(sockets, socket)
+		}
+	}
+	return sockets
+}
+
+// parseSocketTable returns the listening sockets of the output of ss -ltn or netstat -ltn, which both have the local
+// address:port in the fourth column of the listening sockets
+func parseSocketTable(output string) []listeningSocket {
+	var sockets []listeningSocket
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.Contains(strings.ToUpper(scanner.Text()), "LISTEN") {
+			continue
+		}
+		local := fields[3]
+		i := strings.LastIndex(local, ":")
+		if i < 0 {
+			continue
+		}
+		port := parsePort(local[i+1:])
+		if port == 0 {
+			continue
+		}
+		address := strings.Trim(local[:i], "[]")
+		if address == "*" {
+			address = "0.0.0.0"
+		}
+		// ss appends the interface to addresses bound on one, e.g. 127.0.0.53%lo
+		if j := strings.Index(address, "%"); j >= 0 {
+			address = address[:j]
+		}
+		sockets = append(sockets, listeningSocket{address: address, port: port})
+	}
+	return sockets
+}
+
+// listeningPorts groups the sockets by port, ordered by port
+func listeningPorts(sockets []listeningSocket) []ListeningPort {
+	byPort := map[int32]*ListeningPort{}
+	for _, s := range sockets {
+		p, ok := byPort[s.port]
+		if !ok {
+			p = &ListeningPort{Port: s.port}
+			byPort[s.port] = p
+		}
+		known := false
+		for _, a := range p.Addresses {
+			known = known || a == s.address
+		}
+		if !known {
+			p.Addresses = append(p.Addresses, s.address)
+		}
+	}
+	ports := make([]ListeningPort, 0, len(byPort))
+	for _, p := range byPort {
+		ports = append(ports, *p)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Port < ports[j].Port
+	})
+	return ports
+}
+
+// scanListeningPorts runs the scanners until one of them finds listening sockets
+func scanListeningPorts(run scanCommand) ([]ListeningPort, error) {
+	var errs []string
+	for _, s := range scanners {
+		output, err := run(s.command)
+		// cat fails if there is no /proc/net/tcp6 but still prints /proc/net/tcp
+		if sockets := s.parse(output); len(sockets) > 0 {
+			return listeningPorts(sockets), nil
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", s.command[0], err))
+		}
+	}
+	if len(errs) == len(scanners) {
+		return nil, fmt.Errorf("couldn't list the listening ports: %s", strings.Join(errs, ", "))
+	}
+	return nil, nil
+}
+
+// execInPod runs the command in the container of the pod through the API server, returning its standard output
+func (c *Client) execInPod(pod v1.Pod, container string, command []string) (string, error) {
+	req := c.s.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	exec, err := remotecommand.NewSPDYExecutor(c.forwardConf, "POST", req.URL())
+	if err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	err = exec.Stream(remotecommand.StreamOptions{Stdout: &stdout, Stderr: &stderr})
+	if err != nil && stderr.Len() > 0 {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), err
+}
+
+// scannedPod returns the pod and the container to scan, the first one if container is empty
+func (c *Client) scannedPod(namespace string, podName string, container string) (v1.Pod, string, error) {
+	pod, err := c.s.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return v1.Pod{}, "", err
+	}
+	if container == "" && len(pod.Spec.Containers) > 0 {
+		container = pod.Spec.Containers[0].Name
+	}
+	return *pod, container, nil
+}
+
+// ScanPod lists the tcp ports the pod listens on by running cat on /proc/net/tcp, ss or netstat in the container,
+// the first one of the pod if container is empty. All containers of a pod share its network so any container with
+// one of these tools will do. Ports served by a website already are marked as forwarded. The json list of ports is
+// returned, or an empty string if the pod couldn't be scanned, e.g. because exec is forbidden.
+func (c *Client) ScanPod(namespace string, podName string, container string) string {
+	pod, container, err := c.scannedPod(namespace, podName, container)
+	if err != nil {
+		c.log.Warnf("failed to scan pod %s: %v", podName, err)
+		return ""
+	}
+	ports, err := scanListeningPorts(func(command []string) (string, error) {
+		return c.execInPod(pod, container, command)
+	})
+	if err != nil {
+		c.log.Warnf("failed to scan pod %s: %v", podName, err)
+		return ""
+	}
+	c.mu.RLock()
+	for i, p := range ports {
+		for _, w := range c.websites {
+			if w.portForwardReq.Pod.Namespace == namespace && w.portForwardReq.Pod.Name == podName && w.PodPort == p.Port {
+				ports[i].Forwarded = true
+			}
+		}
+	}
+	c.mu.RUnlock()
+	c.log.Infof("found %d listening ports in pod %s", len(ports), podName)
+	if ports == nil {
+		ports = []ListeningPort{}
+	}
+	jBytes, _ := json.Marshal(ports)
+	return string(jBytes)
+}
+
+// ForwardScannedPort forwards a port found by ScanPod as a website of the container. The json website is returned,
+// or an empty string if it couldn't be forwarded.
+func (c *Client) ForwardScannedPort(namespace string, podName string, container string, port int) string {
+	pod, container, err := c.scannedPod(namespace, podName, container)
+	if err != nil {
+		c.log.Warnf("failed to forward port %d of pod %s: %v", port, podName, err)
+		return ""
+	}
+	cand := websiteCandidate{port: int32(port), resourceName: container, resourceType: "container", portSource: portSourceScan}
+	queue := make(chan *Website, 1)
+	go c.handleWebsitesAddingForPod(pod, []websiteCandidate{cand}, c.portForwardAllowed(namespace), queue)
+	w := <-queue
+	if !w.isForwarded {
+		return ""
+	}
+	c.addWebsites([]*Website{w})
+	w.State = w.state()
+	jBytes, _ := json.Marshal(w)
+	return string(jBytes)
+}
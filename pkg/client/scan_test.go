@@ -0,0 +1,80 @@
+package client
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// captured from a pod running nginx on 80, a metrics endpoint on 127.0.0.1:9113 and a client connection
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2345678 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:2399 00000000:0000 0A 00000000:00000000 00:00000000 00000000   101        0 2345690 1 0000000000000000 100 0 0 10 0
+   2: 0B01F40A:0050 0A01F40A:C5A2 01 00000000:00000000 00:00000000 00000000   101        0 2345712 1 0000000000000000 20 4 30 10 -1
+`
+
+const procNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:0050 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2345679 1 0000000000000000 100 0 0 10 0
+   1: 00000000000000000000000001000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2345680 1 0000000000000000 100 0 0 10 0
+`
+
+func TestParseProcNetTCP(t *testing.T) {
+	sockets := parseProcNetTCP(procNetTCP + procNetTCP6)
+	expected := []listeningSocket{
+		{address: "0.0.0.0", port: 80},
+		{address: "127.0.0.1", port: 9113},
+		{address: "::", port: 80},
+		{address: "::1", port: 8080},
+	}
+	if !reflect.DeepEqual(sockets, expected) {
+		t.Errorf("expected %+v got %+v", expected, sockets)
+	}
+	ports := listeningPorts(sockets)
+	if len(ports) != 3 || ports[0].Port != 80 || !reflect.DeepEqual(ports[0].Addresses, []string{"0.0.0.0", "::"}) {
+		t.Errorf("expected the sockets to be grouped by port got %+v", ports)
+	}
+}
+
+func TestParseSocketTable(t *testing.T) {
+	ss := `State      Recv-Q Send-Q Local Address:Port  Peer Address:Port Process
+LISTEN     0      511          0.0.0.0:80         0.0.0.0:*
+LISTEN     0      4096   127.0.0.53%lo:53         0.0.0.0:*
+LISTEN     0      511             [::]:8443          [::]:*
+`
+	netstat := `Active Internet connections (only servers)
+Proto Recv-Q Send-Q Local Address           Foreign Address         State
+tcp        0      0 0.0.0.0:6379            0.0.0.0:*               LISTEN
+tcp6       0      0 :::6379                 :::*                    LISTEN
+`
+	expected := []listeningSocket{{address: "0.0.0.0", port: 80}, {address: "127.0.0.53", port: 53}, {address: "::", port: 8443}}
+	if sockets := parseSocketTable(ss); !reflect.DeepEqual(sockets, expected) {
+		t.Errorf("expected %+v got %+v", expected, sockets)
+	}
+	expected = []listeningSocket{{address: "0.0.0.0", port: 6379}, {address: "::", port: 6379}}
+	if sockets := parseSocketTable(netstat); !reflect.DeepEqual(sockets, expected) {
+		t.Errorf("expected %+v got %+v", expected, sockets)
+	}
+}
+
+func TestScanFallsBackToSocketTools(t *testing.T) {
+	var ran []string
+	ports, err := scanListeningPorts(func(command []string) (string, error) {
+		ran = append(ran, command[0])
+		if command[0] == "netstat" {
+			return "tcp        0      0 0.0.0.0:5432            0.0.0.0:*               LISTEN\n", nil
+		}
+		return "", errors.New("executable file not found in $PATH")
+	})
+	if err != nil || len(ports) != 1 || ports[0].Port != 5432 {
+		t.Errorf("expected netstat to find the port got %+v %v", ports, err)
+	}
+	if !reflect.DeepEqual(ran, []string{"cat", "ss", "netstat"}) {
+		t.Errorf("unexpected commands %v", ran)
+	}
+
+	if _, err := scanListeningPorts(func(command []string) (string, error) {
+		return "", errors.New("pods \"web\" is forbidden")
+	}); err == nil {
+		t.Error("expected an error if no command could be run")
+	}
+}
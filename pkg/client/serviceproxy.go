@@ -0,0 +1,153 @@
+package client
+
+import (
+	"fmt"
+	authv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/rest"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// Backends a Website can be served by
+const (
+	backendPortForward  = "portforward"
+	backendServiceProxy = "serviceproxy"
+)
+
+// countingListener wraps a listener so that the traffic of every accepted connection is counted in stats
+type countingListener struct {
+	net.Listener
+	stats *trafficStats
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.stats.connectionOpened()
+	return &countingConn{Conn: conn, stats: l.stats}, nil
+}
+
+// countingConn counts reads as bytes sent to the pod and writes as bytes received from it
+type countingConn struct {
+	net.Conn
+	stats  *trafficStats
+	closed int32
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.stats.bytesOut, int64(n))
+	c.stats.touch()
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.stats.bytesIn, int64(n))
+	c.stats.touch()
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.stats.connectionClosed()
+	}
+	return c.Conn.Close()
+}
+
+// portForwardAllowed asks the API server whether the current user may port-forward to pods in the namespace
+func (c *Client) portForwardAllowed(namespace string) bool {
+	review, err := c.s.AuthorizationV1().SelfSubjectAccessReviews().Create(&authv1.SelfSubjectAccessReview{
+		Spec: authv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        "create",
+				Resource:    "pods",
+				Subresource: "portforward",
+			},
+		},
+	})
+	if err != nil {
+		// we can't tell so let the port-forward itself fail if it is not allowed
+		c.log.Debugf("failed to review port-forward access in namespace %s: %v", namespace, err)
+		return true
+	}
+	return review.Status.Allowed
+}
+
+// serviceProxyPath is the path on the API server which proxies to the given port of a service
+func serviceProxyPath(namespace string, service string, port int32) string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/services/%s:%d/proxy", namespace, service, port)
+}
+
+// newServiceProxy creates a reverse proxy which serves the service's port through the API server's service proxy.
+// Paths and redirects which the API server already prefixed with the proxy path are mapped back to the local root.
+func newServiceProxy(conf *rest.Config, namespace string, service string, port int32) (*httputil.ReverseProxy, error) {
+	transport, err := rest.TransportFor(conf)
+	if err != nil {
+		return nil, err
+	}
+	host := conf.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	base, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	proxyPath := path.Join(base.Path, serviceProxyPath(namespace, service, port))
+
+	director := func(req *http.Request) {
+		req.URL.Scheme = base.Scheme
+		req.URL.Host = base.Host
+		if !strings.HasPrefix(req.URL.Path, proxyPath+"/") {
+			req.URL.Path = proxyPath + req.URL.Path
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = proxyPath + req.URL.RawPath
+			}
+		}
+		req.Host = base.Host
+	}
+	modifyResponse := func(resp *http.Response) error {
+		if location := resp.Header.Get("Location"); location != "" {
+			if u, err := url.Parse(location); err == nil && strings.HasPrefix(u.Path, proxyPath+"/") {
+				u.Scheme, u.Host = "", ""
+				u.Path = strings.TrimPrefix(u.Path, proxyPath)
+				resp.Header.Set("Location", u.String())
+			}
+		}
+		return nil
+	}
+	return &httputil.ReverseProxy{
+		Director:       director,
+		Transport:      transport,
+		ModifyResponse: modifyResponse,
+	}, nil
+}
+
+// proxyAService takes a portForwardPodRequest for a service port and serves it locally through the API server's
+// service proxy, for clusters which forbid pods/portforward
+func proxyAService(req portForwardPodRequest) error {
+	proxy, err := newServiceProxy(req.RestConfig, req.Pod.Namespace, req.ServiceName, req.ServicePort)
+	if err != nil {
+		return err
+	}
+	listeners, err := req.listen()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: proxy}
+	for _, l := range listeners {
+		go server.Serve(&countingListener{Listener: l, stats: req.Stats})
+	}
+	close(req.ReadyCh)
+	<-req.StopCh
+	return server.Close()
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"io/ioutil"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServiceProxyMapsPathsAndRedirects(t *testing.T) {
+	proxyPath := "/api/v1/namespaces/monitoring/services/grafana:3000/proxy"
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case proxyPath + "/":
+			// the API server rewrites redirects of the proxied service to include the proxy path
+			http.Redirect(w, r, proxyPath+"/login", http.StatusFound)
+		case proxyPath + "/login":
+			w.Write([]byte("login page"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer apiServer.Close()
+
+	proxy, err := newServiceProxy(&rest.Config{Host: apiServer.URL}, "monitoring", "grafana", 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := httptest.NewServer(proxy)
+	defer local.Close()
+
+	noRedirects := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirects.Get(local.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); location != "/login" {
+		t.Errorf("expected redirect to /login got %s", location)
+	}
+
+	// paths which were already prefixed by the API server must not be prefixed twice
+	for _, p := range []string{"/login", proxyPath + "/login"} {
+		resp, err := http.Get(local.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "login page" {
+			t.Errorf("expected %s to be proxied to the login page got %d %s", p, resp.StatusCode, body)
+		}
+	}
+}
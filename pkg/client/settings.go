@@ -0,0 +1,118 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// contextSettings holds the user's settings for a single kube context
+type contextSettings struct {
+	// Transport is the port-forward transport used for the context - one of spdy, websocket or auto
+	Transport string `json:"transport,omitempty"`
+	// Backend is set to kubectl to forward by running kubectl port-forward instead of forwarding in-process
+	Backend string `json:"backend,omitempty"`
+	// Bastion is an SSH jump host the API server is reached through
+	Bastion *bastionSettings `json:"bastion,omitempty"`
+}
+
+// settings is the persisted configuration of Portfall
+type settings struct {
+	Contexts map[string]*contextSettings `json:"contexts"`
+	// KubectlPath is the kubectl binary used by the kubectl backend, defaulting to kubectl on the PATH
+	KubectlPath string `json:"kubectlPath,omitempty"`
+	// LoopbackPerService forwards every service on its own loopback address and its real port
+	LoopbackPerService bool `json:"loopbackPerService,omitempty"`
+	// HostsPath is the hosts file the names of services are mapped in, defaulting to the system's hosts file
+	HostsPath string `json:"hostsPath,omitempty"`
+	// DNSEnabled runs the built-in dns responder for service names on DNSPort, forwarding other names to DNSUpstream
+	DNSEnabled  bool   `json:"dnsEnabled,omitempty"`
+	DNSPort     int    `json:"dnsPort,omitempty"`
+	DNSUpstream string `json:"dnsUpstream,omitempty"`
+	// ProxyEnabled runs the SOCKS5 and HTTP proxy into the cluster on ProxyPort
+	ProxyEnabled bool `json:"proxyEnabled,omitempty"`
+	ProxyPort    int  `json:"proxyPort,omitempty"`
+	// ServiceMode balances the websites of services across all endpoints with the given policy when set
+	ServiceMode string `json:"serviceMode,omitempty"`
+	// StickySessions pins browsers to an endpoint with a cookie in service mode
+	StickySessions bool `json:"stickySessions,omitempty"`
+	// BindAddress shares new websites beyond loopback on the address behind the ShareGate when set
+	BindAddress    string   `json:"bindAddress,omitempty"`
+	ShareGate      string   `json:"shareGate,omitempty"`
+	ShareAllowlist []string `json:"shareAllowlist,omitempty"`
+	// RelayImage is the image of the relay pods of reverse tunnels
+	RelayImage string `json:"relayImage,omitempty"`
+	// HTTPSEnabled serves new websites over https with a certificate of the local CA as well
+	HTTPSEnabled bool `json:"httpsEnabled,omitempty"`
+	// DiscoveryPath is the discovery file configuring additional sources of websites, defaulting to discovery.json
+	// in the config directory
+	DiscoveryPath string `json:"discoveryPath,omitempty"`
+	// Websites are the rules of single websites by their rules key
+	Websites map[string]*websiteRules `json:"websites,omitempty"`
+}
+
+// configDir returns the directory Portfall keeps its own files in
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "portfall"), nil
+}
+
+func settingsPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "settings.json"), nil
+}
+
+// loadSettings reads the persisted settings, returning empty settings if there are none yet
+func loadSettings() (*settings, error) {
+	s := &settings{Contexts: map[string]*contextSettings{}}
+	p, err := settingsPath()
+	if err != nil {
+		return s, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return s, err
+	}
+	if s.Contexts == nil {
+		s.Contexts = map[string]*contextSettings{}
+	}
+	return s, nil
+}
+
+func (s *settings) save() error {
+	p, err := settingsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, b, 0600)
+}
+
+// forContext returns the settings of the given context, creating them if needed
+func (s *settings) forContext(context string) *contextSettings {
+	cs, ok := s.Contexts[context]
+	if !ok {
+		cs = &contextSettings{}
+		s.Contexts[context] = cs
+	}
+	return cs
+}
@@ -0,0 +1,415 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"portfall/pkg/sniff"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Gates guarding a website shared beyond loopback
+const (
+	// gateHTTP requires the share's token as query parameter, cookie or bearer token on every http request
+	gateHTTP = "http"
+	// gateTCP only accepts connections from the share's allowlist
+	gateTCP = "tcp"
+)
+
+const (
+	shareTokenParam = "portfall_token"
+	// shareTokenCookie is suffixed with the share's port, browsers scope cookies by host and not by port so shares
+	// on the same host would overwrite each other's token otherwise
+	shareTokenCookie = "portfall-token"
+)
+
+// websiteShare exposes a website beyond loopback on its own port of the bind address
+type websiteShare struct {
+	listener  net.Listener
+	server    *http.Server
+	gate      string
+	token     string
+	cookie    string
+	allowlist []*net.IPNet
+	url       string
+	closeOnce sync.Once
+}
+
+// WebsiteShare is the json representation of a shared website
+type WebsiteShare struct {
+	LocalAddress string `json:"localAddress"`
+	LocalPort    int32  `json:"localPort"`
+	Title        string `json:"title"`
+	Url          string `json:"url"`
+	Gate         string `json:"gate"`
+	Token        string `json:"token"`
+}
+
+// resolveBindAddress turns a bind address given as IP or interface name into an IP. An interface is bound on its
+// first IPv4 address, or its first address if it has none.
+func resolveBindAddress(bind string) (net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(bind, "[]")); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither an IP nor a network interface", bind)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var first net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if first == nil {
+			first = ipNet.IP
+		}
+	}
+	if first == nil {
+		return nil, fmt.Errorf("interface %s has no addresses", bind)
+	}
+	return first, nil
+}
+
+// shareHost returns the address teammates reach the bind address by, an address of a non-loopback interface if the
+// bind address is unspecified
+func shareHost(ip net.IP) string {
+	if !ip.IsUnspecified() {
+		return ip.String()
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				return ipNet.IP.String()
+			}
+		}
+	}
+	return ip.String()
+}
+
+// parseAllowlist parses IPs and CIDRs
+func parseAllowlist(entries []string) ([]*net.IPNet, error) {
+	var allowlist []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%s is not an IP", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			allowlist = append(allowlist, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		allowlist = append(allowlist, ipNet)
+	}
+	return allowlist, nil
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// startShare exposes the local target address on a free port of the bind address behind the gate
+func startShare(target string, bind string, gate string, allowlist []string) (*websiteShare, error) {
+	ip, err := resolveBindAddress(bind)
+	if err != nil {
+		return nil, err
+	}
+	if ip.IsLoopback() {
+		return nil, errors.New("websites are already reachable on loopback")
+	}
+	s := &websiteShare{gate: gate}
+	switch gate {
+	case gateHTTP:
+		if s.token, err = newShareToken(); err != nil {
+			return nil, err
+		}
+	case gateTCP:
+		if s.allowlist, err = parseAllowlist(allowlist); err != nil {
+			return nil, err
+		}
+		if len(s.allowlist) == 0 {
+			return nil, errors.New("sharing with the tcp gate needs an allowlist")
+		}
+	default:
+		return nil, fmt.Errorf("unknown gate %s", gate)
+	}
+	s.listener, err = net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	port := strconv.Itoa(s.listener.Addr().(*net.TCPAddr).Port)
+	if gate == gateHTTP {
+		targetURL := &url.URL{Scheme: "http", Host: target}
+		proxy := httputil.NewSingleHostReverseProxy(targetURL)
+		s.cookie = shareTokenCookie + "-" + port
+		s.server = &http.Server{Handler: s.httpGate(proxy)}
+		go s.server.Serve(s.listener)
+		s.url = fmt.Sprintf("http://%s/?%s=%s", net.JoinHostPort(shareHost(ip), port), shareTokenParam, s.token)
+	} else {
+		go serveListener(s.listener, func(conn net.Conn) {
+			s.relay(conn, target)
+		})
+		s.url = net.JoinHostPort(shareHost(ip), port)
+	}
+	return s, nil
+}
+
+// httpGate only lets requests carrying the token through to next. A token in the query is exchanged for a cookie so
+// that it doesn't need to be repeated on every link.
+func (s *websiteShare) httpGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get(shareTokenParam); token != "" {
+			if !s.validToken(token) {
+				http.Error(w, "invalid access token", http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: s.cookie, Value: token, Path: "/", HttpOnly: true})
+			q := r.URL.Query()
+			q.Del(shareTokenParam)
+			redirect := *r.URL
+			redirect.RawQuery = q.Encode()
+			http.Redirect(w, r, redirect.String(), http.StatusFound)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if cookie, err := r.Cookie(s.cookie); err == nil {
+			token = cookie.Value
+		}
+		if !s.validToken(token) {
+			http.Error(w, "this website requires an access token", http.StatusUnauthorized)
+			return
+		}
+		// the token is only meant for Portfall
+		stripTokenCookie(r)
+		if r.Header.Get("Authorization") == "Bearer "+token {
+			r.Header.Del("Authorization")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *websiteShare) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// stripTokenCookie removes the token cookies of all shares on the host from the request
+func stripTokenCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if !strings.HasPrefix(cookie.Name, shareTokenCookie) {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+// relay forwards a connection from an allowlisted address to the target
+func (s *websiteShare) relay(conn net.Conn, target string) {
+	defer conn.Close()
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	ip := net.ParseIP(host)
+	allowed := false
+	for _, ipNet := range s.allowlist {
+		if ip != nil && ipNet.Contains(ip) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		fmt.Fprintf(os.Stderr, "rejected shared connection from %s\n", conn.RemoteAddr())
+		return
+	}
+	remote, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+	go io.Copy(remote, conn)
+	io.Copy(conn, remote)
+}
+
+func (s *websiteShare) close() {
+	s.closeOnce.Do(func() {
+		if s.server != nil {
+			s.server.Close()
+		}
+		s.listener.Close()
+	})
+}
+
+// localTarget is the loopback address the website is served on locally
+func (w *Website) localTarget() string {
+	host := "127.0.0.1"
+	if w.LocalAddress != "" {
+		host = w.LocalAddress
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(w.LocalPort)))
+}
+
+// share exposes the website on the bind address, replacing any previous share. The share ends with the website.
+func (c *Client) share(w *Website, bind string, gate string, allowlist []string) error {
+	if gate == gateHTTP && w.Protocol != sniff.HTTP {
+		return errNotHTTP(w)
+	}
+	s, err := startShare(w.localTarget(), bind, gate, allowlist)
+	if err != nil {
+		return err
+	}
+	c.unshare(w)
+	w.share = s
+	w.SharedUrl = s.url
+	stopCh := w.portForwardReq.StopCh
+	go func() {
+		<-stopCh
+		s.close()
+	}()
+	c.log.Warnf("website %s on port %d is shared on %s", w.Title, w.LocalPort, s.listener.Addr())
+	return nil
+}
+
+func (c *Client) unshare(w *Website) {
+	if w.share != nil {
+		w.share.close()
+		w.share = nil
+		w.SharedUrl = ""
+	}
+}
+
+// shareNewWebsites shares the given websites on the global bind address if one is set
+func (c *Client) shareNewWebsites(websites []*Website) {
+	if c.settings.BindAddress == "" {
+		return
+	}
+	for _, w := range websites {
+		// other protocols are only shared behind the tcp gate
+		if c.settings.ShareGate == gateHTTP && w.Protocol != sniff.HTTP {
+			continue
+		}
+		if err := c.share(w, c.settings.BindAddress, c.settings.ShareGate, c.settings.ShareAllowlist); err != nil {
+			c.log.Warnf("failed to share website on port %d: %v", w.LocalPort, err)
+		}
+	}
+}
+
+func (w *Website) shareJSON() WebsiteShare {
+	return WebsiteShare{
+		LocalAddress: w.LocalAddress,
+		LocalPort:    w.LocalPort,
+		Title:        w.Title,
+		Url:          w.share.url,
+		Gate:         w.share.gate,
+		Token:        w.share.token,
+	}
+}
+
+// ShareWebsite exposes the website served on localAddress:localPort on a free port of bindAddress, an IP such as
+// 0.0.0.0 or :: or an interface name. The gate is http to require a generated token or tcp to only accept connections
+// from the IPs and CIDRs of the allowlist, ports speaking another protocol than http can only use the tcp gate. The
+// json share is returned, or an empty string if sharing failed.
+func (c *Client) ShareWebsite(localAddress string, localPort int, bindAddress string, gate string, allowlist []string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.websites {
+		if w.LocalAddress != localAddress || int(w.LocalPort) != localPort {
+			continue
+		}
+		if err := c.share(w, bindAddress, gate, allowlist); err != nil {
+			c.log.Warnf("failed to share website on port %d: %v", localPort, err)
+			return ""
+		}
+		jBytes, _ := json.Marshal(w.shareJSON())
+		return string(jBytes)
+	}
+	c.log.Warnf("no website on port %d to share", localPort)
+	return ""
+}
+
+// GetShares returns a json list of all websites shared beyond loopback
+func (c *Client) GetShares() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	shares := make([]WebsiteShare, 0)
+	for _, w := range c.websites {
+		if w.share != nil {
+			shares = append(shares, w.shareJSON())
+		}
+	}
+	jBytes, _ := json.Marshal(shares)
+	return string(jBytes)
+}
+
+// RevokeAllShares stops sharing every website and clears the global bind address so that new websites stay on
+// loopback
+func (c *Client) RevokeAllShares() {
+	c.settings.BindAddress = ""
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.websites {
+		c.unshare(w)
+	}
+	c.log.Infof("revoked all shared websites")
+}
+
+// SetBindAddress shares websites forwarded from now on on bindAddress behind the gate, see ShareWebsite. An empty
+// bindAddress keeps new websites on loopback. An empty string is returned on success, otherwise the reason the
+// settings can't be used.
+func (c *Client) SetBindAddress(bindAddress string, gate string, allowlist []string) string {
+	if bindAddress != "" {
+		ip, err := resolveBindAddress(bindAddress)
+		if err != nil {
+			return err.Error()
+		}
+		if _, err := parseAllowlist(allowlist); err != nil {
+			return err.Error()
+		}
+		if ip.IsLoopback() {
+			bindAddress = ""
+		} else if gate != gateHTTP && (gate != gateTCP || len(allowlist) == 0) {
+			return "the gate must be http or tcp with an allowlist"
+		}
+	}
+	c.settings.BindAddress = bindAddress
+	c.settings.ShareGate = gate
+	c.settings.ShareAllowlist = allowlist
+	if err := c.settings.save(); err != nil {
+		c.log.Warnf("failed to save settings: %v", err)
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"portfall/pkg/sniff"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestShareHTTPGate(t *testing.T) {
+	s := &websiteShare{gate: gateHTTP, token: "secret", cookie: "portfall-token-8080"}
+	handler := s.httpGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie(s.cookie); err == nil {
+			t.Error("expected the token cookie to be stripped before proxying")
+		}
+		w.Write([]byte("ok"))
+	}))
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a request without token to be rejected got %d", w.Code)
+	}
+	if w := serve(httptest.NewRequest("GET", "/?portfall_token=wrong", nil)); w.Code != http.StatusForbidden {
+		t.Errorf("expected a wrong token to be rejected got %d", w.Code)
+	}
+	w := serve(httptest.NewRequest("GET", "/dashboard?portfall_token=secret&tab=1", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/dashboard?tab=1" {
+		t.Errorf("expected a redirect without the token got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "portfall-token-8080" || cookies[0].Value != "secret" {
+		t.Fatalf("expected the token to be set as cookie got %v", cookies)
+	}
+
+	r := httptest.NewRequest("GET", "/dashboard", nil)
+	r.AddCookie(cookies[0])
+	r.AddCookie(&http.Cookie{Name: "session", Value: "app"})
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("expected a request with the token cookie to pass got %d", w.Code)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("expected a request with the bearer token to pass got %d", w.Code)
+	}
+}
+
+func TestShareHTTPGatesOnOneHost(t *testing.T) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	var urls []string
+	for _, token := range []string{"first", "second"} {
+		s := &websiteShare{gate: gateHTTP, token: token}
+		server := httptest.NewUnstartedServer(s.httpGate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, cookie := range r.Cookies() {
+				if strings.HasPrefix(cookie.Name, shareTokenCookie) {
+					t.Errorf("expected the token cookies to be stripped before proxying got %s", cookie.Name)
+				}
+			}
+			w.Write([]byte("ok"))
+		})))
+		s.cookie = shareTokenCookie + "-" + strconv.Itoa(server.Listener.Addr().(*net.TCPAddr).Port)
+		server.Start()
+		defer server.Close()
+		urls = append(urls, server.URL)
+
+		resp, err := client.Get(server.URL + "/?" + shareTokenParam + "=" + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the token to be exchanged for a cookie got %d", resp.StatusCode)
+		}
+	}
+	// both shares are on 127.0.0.1, so the jar sends both cookies to each of them
+	for _, u := range urls {
+		resp, err := client.Get(u + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected %s to still accept its cookie got %d", u, resp.StatusCode)
+		}
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	allowlist, err := parseAllowlist([]string{"192.168.1.10", "10.0.0.0/8", " ", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{"192.168.1.10": true, "192.168.1.11": false, "10.1.2.3": true, "fd00::1": true} {
+		contained := false
+		for _, ipNet := range allowlist {
+			contained = contained || ipNet.Contains(net.ParseIP(ip))
+		}
+		if contained != allowed {
+			t.Errorf("expected %s to be allowed %t", ip, allowed)
+		}
+	}
+	if _, err := parseAllowlist([]string{"teammate"}); err == nil {
+		t.Error("expected an invalid entry to be rejected")
+	}
+}
+
+func TestHTTPFrontsOnlyServeHTTP(t *testing.T) {
+	c := &Client{settings: &settings{BindAddress: "0.0.0.0", ShareGate: gateHTTP}}
+	postgres := &Website{LocalPort: 5432, Protocol: sniff.Postgres}
+	web := &Website{LocalPort: 8080, Protocol: sniff.HTTP}
+	if websites := httpWebsites([]*Website{postgres, web}); len(websites) != 1 || websites[0] != web {
+		t.Errorf("expected only the http website got %v", websites)
+	}
+
+	c.shareNewWebsites([]*Website{postgres})
+	if postgres.share != nil {
+		t.Error("expected a database not to be shared behind the http gate")
+	}
+	if err := c.share(postgres, "0.0.0.0", gateHTTP, nil); err == nil || err.Error() != "website on port 5432 speaks postgres, not http" {
+		t.Errorf("expected the http gate to be refused got %v", err)
+	}
+	if err := c.serveHTTPS(postgres); err == nil || postgres.https != nil {
+		t.Errorf("expected the https front to be refused got %v", err)
+	}
+	postgres.inspector = newHTTPInspector()
+	if err := c.applyWebsiteRules(postgres); err == nil || postgres.proxy != nil {
+		t.Errorf("expected the rules proxy to be refused got %v", err)
+	}
+}
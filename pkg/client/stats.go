@@ -0,0 +1,118 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// trafficStats counts the traffic flowing through a single forwarded website. All fields are accessed atomically.
+type trafficStats struct {
+	activeConnections int64
+	totalConnections  int64
+	// bytesIn is the number of bytes received from the pod
+	bytesIn int64
+	// bytesOut is the number of bytes sent to the pod
+	bytesOut int64
+	// lastActivity is the unix time in nanoseconds of the last connection or transfer, 0 if there was none
+	lastActivity int64
+}
+
+// WebsiteStats is the json representation of the traffic of a Website
+type WebsiteStats struct {
+	LocalPort         int32      `json:"localPort"`
+	LocalAddress      string     `json:"localAddress"`
+	Namespace         string     `json:"namespace"`
+	PodName           string     `json:"podName"`
+	State             string     `json:"state"`
+	ActiveConnections int64      `json:"activeConnections"`
+	TotalConnections  int64      `json:"totalConnections"`
+	BytesIn           int64      `json:"bytesIn"`
+	BytesOut          int64      `json:"bytesOut"`
+	LastActivity      *time.Time `json:"lastActivity"`
+}
+
+func (s *trafficStats) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+func (s *trafficStats) connectionOpened() {
+	atomic.AddInt64(&s.activeConnections, 1)
+	atomic.AddInt64(&s.totalConnections, 1)
+	s.touch()
+}
+
+func (s *trafficStats) connectionClosed() {
+	atomic.AddInt64(&s.activeConnections, -1)
+	s.touch()
+}
+
+// waitForIdle waits up to timeout for the open connections to close, returning whether they did
+func (s *trafficStats) waitForIdle(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&s.activeConnections) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// resetTotals clears the cumulative counters but leaves connections which are still open untouched
+func (s *trafficStats) resetTotals() {
+	atomic.StoreInt64(&s.totalConnections, 0)
+	atomic.StoreInt64(&s.bytesIn, 0)
+	atomic.StoreInt64(&s.bytesOut, 0)
+	atomic.StoreInt64(&s.lastActivity, 0)
+}
+
+func (s *trafficStats) snapshot() WebsiteStats {
+	ws := WebsiteStats{
+		ActiveConnections: atomic.LoadInt64(&s.activeConnections),
+		TotalConnections:  atomic.LoadInt64(&s.totalConnections),
+		BytesIn:           atomic.LoadInt64(&s.bytesIn),
+		BytesOut:          atomic.LoadInt64(&s.bytesOut),
+	}
+	if last := atomic.LoadInt64(&s.lastActivity); last != 0 {
+		t := time.Unix(0, last)
+		ws.LastActivity = &t
+	}
+	return ws
+}
+
+// countingWriter adds the number of bytes written through it to counter and marks the stats as active
+type countingWriter struct {
+	w       io.Writer
+	counter *int64
+	stats   *trafficStats
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.counter, int64(n))
+	cw.stats.touch()
+	return n, err
+}
+
+// GetWebsiteStats returns a json list of the traffic stats of all forwarded websites
+func (c *Client) GetWebsiteStats() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := make([]WebsiteStats, 0, len(c.websites))
+	for _, w := range c.websites {
+		if w.portForwardReq.Stats == nil {
+			continue
+		}
+		ws := w.portForwardReq.Stats.snapshot()
+		ws.LocalPort = w.LocalPort
+		ws.LocalAddress = w.LocalAddress
+		ws.Namespace = w.portForwardReq.Pod.Namespace
+		ws.PodName = w.portForwardReq.Pod.Name
+		ws.State = w.state()
+		stats = append(stats, ws)
+	}
+	jBytes, _ := json.Marshal(stats)
+	return string(jBytes)
+}
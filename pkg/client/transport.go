@@ -0,0 +1,406 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Port-forward transports which can be configured per context
+const (
+	transportSPDY      = "spdy"
+	transportWebSocket = "websocket"
+	// transportAuto tries SPDY first and falls back to WebSockets if the upgrade fails for any reason but RBAC
+	transportAuto = "auto"
+)
+
+// websocketPortForwardProtocol is the channel protocol the kubelet speaks for port-forwards over WebSockets
+const websocketPortForwardProtocol = "v4.channel.k8s.io"
+
+// podConnection carries the streams for any number of ports of a single pod
+type podConnection interface {
+	// openStream opens a new bidirectional stream to port on the pod. The returned channel receives any error reported
+	// by the pod for the stream and is then closed.
+	openStream(port int32) (io.ReadWriteCloser, <-chan error, error)
+	// CloseChan is closed once the connection is closed
+	CloseChan() <-chan bool
+	Close() error
+}
+
+// podURL builds the url of a pod's subresource on the API server, keeping any path prefix of the configured host
+func podURL(conf *rest.Config, pod v1.Pod, subresource string) (*url.URL, error) {
+	host := conf.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/%s", pod.Namespace, pod.Name, subresource))
+	return u, nil
+}
+
+// dialPod opens a new connection to the pod using the given transport
+func dialPod(conf *rest.Config, pod v1.Pod, transport string) (podConnection, error) {
+	switch transport {
+	case transportSPDY:
+		return dialPodSPDY(conf, pod)
+	case transportWebSocket:
+		return dialPodWebSocket(conf, pod)
+	case transportAuto, "":
+		conn, spdyErr := dialPodSPDY(conf, pod)
+		if spdyErr == nil || apierrors.IsForbidden(spdyErr) {
+			// a forbidden port-forward is forbidden regardless of the transport
+			return conn, spdyErr
+		}
+		conn, wsErr := dialPodWebSocket(conf, pod)
+		if apierrors.IsForbidden(wsErr) {
+			return nil, wsErr
+		}
+		if wsErr != nil {
+			return nil, fmt.Errorf("spdy: %v, websocket: %v", spdyErr, wsErr)
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("unknown port-forward transport %s", transport)
+}
+
+// spdyPodConnection multiplexes the streams of a pod's ports over a single SPDY connection
+type spdyPodConnection struct {
+	conn      httpstream.Connection
+	requestID int64
+}
+
+// dialPodSPDY opens a new SPDY connection to the pod
+// usage based on https://github.com/gianarb/kube-port-forward
+func dialPodSPDY(conf *rest.Config, pod v1.Pod) (podConnection, error) {
+	u, err := podURL(conf, pod, "portforward")
+	if err != nil {
+		return nil, err
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := spdy.NewDialer(
+		upgrader,
+		&http.Client{Transport: transport},
+		http.MethodPost,
+		u)
+
+	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return nil, err
+	}
+	return &spdyPodConnection{conn: streamConn}, nil
+}
+
+func (s *spdyPodConnection) openStream(port int32) (io.ReadWriteCloser, <-chan error, error) {
+	return openPodStream(s.conn, port, atomic.AddInt64(&s.requestID, 1))
+}
+
+func (s *spdyPodConnection) CloseChan() <-chan bool {
+	return s.conn.CloseChan()
+}
+
+func (s *spdyPodConnection) Close() error {
+	return s.conn.Close()
+}
+
+// websocketPodConnection opens a WebSocket per stream as the WebSocket port-forward protocol only carries a single
+// connection per port
+type websocketPodConnection struct {
+	dialer  *websocket.Dialer
+	url     *url.URL
+	header  http.Header
+	mu      sync.Mutex
+	streams map[*websocketStream]struct{}
+	closed  chan bool
+}
+
+// headerCapture is a round tripper which records the headers it was asked to send
+type headerCapture struct {
+	header http.Header
+}
+
+func (h *headerCapture) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.header = req.Header.Clone()
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+// websocketHeadersFor returns the headers the rest config would add to a request such as its credentials
+func websocketHeadersFor(conf *rest.Config, u *url.URL) (http.Header, error) {
+	capture := &headerCapture{}
+	rt, err := rest.HTTPWrappersForConfig(conf, capture)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return capture.header, nil
+}
+
+// upgradePort is the port the upgrade of a WebSocket connection is tried with, the first port the pod declares. The
+// kubelet only connects to the port once data is sent.
+func upgradePort(pod v1.Pod) int32 {
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			return port.ContainerPort
+		}
+	}
+	return 80
+}
+
+// upgradeError turns the response to a rejected upgrade into the API server's status, so that a forbidden
+// port-forward is recognised as such
+func upgradeError(port int32, resp *http.Response, err error) error {
+	if resp == nil {
+		return fmt.Errorf("error dialing websocket for port %d: %v", port, err)
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var status metav1.Status
+	if json.Unmarshal(body, &status) == nil && status.Kind == "Status" {
+		return &apierrors.StatusError{ErrStatus: status}
+	}
+	message := fmt.Sprintf("error upgrading websocket for port %d: %v (%s)", port, err, strings.TrimSpace(string(body)))
+	return apierrors.NewGenericServerResponse(resp.StatusCode, http.MethodGet, schema.GroupResource{Resource: "pods"}, "", message, 0, false)
+}
+
+// dialPodWebSocket prepares a WebSocket connection to the pod. As every stream is a WebSocket of its own, a single
+// upgrade is tried to report a rejected connection here rather than when the first stream is opened.
+func dialPodWebSocket(conf *rest.Config, pod v1.Pod) (podConnection, error) {
+	u, err := podURL(conf, pod, "portforward")
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "http" {
+		u.Scheme = "ws"
+	} else {
+		u.Scheme = "wss"
+	}
+	tlsConfig, err := rest.TLSConfigFor(conf)
+	if err != nil {
+		return nil, err
+	}
+	header, err := websocketHeadersFor(conf, u)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		Subprotocols:    []string{websocketPortForwardProtocol},
+	}
+	if conf.Dial != nil {
+		dialer.NetDialContext = conf.Dial
+	}
+	w := &websocketPodConnection{
+		dialer:  dialer,
+		url:     u,
+		header:  header,
+		streams: map[*websocketStream]struct{}{},
+		closed:  make(chan bool),
+	}
+	probe, err := w.dial(upgradePort(pod))
+	if err != nil {
+		return nil, err
+	}
+	probe.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	probe.Close()
+	return w, nil
+}
+
+// dial upgrades a new WebSocket to the port of the pod
+func (w *websocketPodConnection) dial(port int32) (*websocket.Conn, error) {
+	u := *w.url
+	q := u.Query()
+	q.Set(v1.PortHeader, strconv.Itoa(int(port)))
+	u.RawQuery = q.Encode()
+	conn, resp, err := w.dialer.DialContext(context.Background(), u.String(), w.header)
+	if err != nil {
+		return nil, upgradeError(port, resp, err)
+	}
+	return conn, nil
+}
+
+func (w *websocketPodConnection) openStream(port int32) (io.ReadWriteCloser, <-chan error, error) {
+	select {
+	case <-w.closed:
+		return nil, nil, errors.New("websocket connection to pod is closed")
+	default:
+	}
+	conn, err := w.dial(port)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream := newWebsocketStream(conn)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.closed:
+		stream.Close()
+		return nil, nil, errors.New("websocket connection to pod is closed")
+	default:
+	}
+	w.streams[stream] = struct{}{}
+	go func() {
+		<-stream.done
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.streams, stream)
+	}()
+	return stream, stream.errorChan, nil
+}
+
+func (w *websocketPodConnection) CloseChan() <-chan bool {
+	return w.closed
+}
+
+func (w *websocketPodConnection) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.closed:
+		return nil
+	default:
+	}
+	close(w.closed)
+	for stream := range w.streams {
+		stream.Close()
+	}
+	return nil
+}
+
+// Channels of a single port in the WebSocket port-forward protocol
+const (
+	websocketDataChannel  = 0
+	websocketErrorChannel = 1
+)
+
+// websocketStream is a single forwarded connection over the WebSocket port-forward protocol. Every message is
+// prefixed with its channel and the first message on each channel carries the port number.
+type websocketStream struct {
+	conn      *websocket.Conn
+	writeMu   sync.Mutex
+	reader    *io.PipeReader
+	writer    *io.PipeWriter
+	errorChan chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWebsocketStream(conn *websocket.Conn) *websocketStream {
+	r, w := io.Pipe()
+	s := &websocketStream{
+		conn:      conn,
+		reader:    r,
+		writer:    w,
+		errorChan: make(chan error, 1),
+		done:      make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+func (s *websocketStream) readLoop() {
+	defer close(s.done)
+	defer close(s.errorChan)
+	seenPort := map[byte]bool{}
+	var remoteErr []byte
+	for {
+		_, msg, err := s.conn.ReadMessage()
+		if err != nil {
+			if len(remoteErr) > 0 {
+				s.errorChan <- fmt.Errorf("an error occurred forwarding: %s", string(remoteErr))
+			}
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				err = io.EOF
+			}
+			s.writer.CloseWithError(err)
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		channel, payload := msg[0], msg[1:]
+		if !seenPort[channel] {
+			// the first message on a channel holds the port number
+			seenPort[channel] = true
+			if len(payload) < 2 {
+				continue
+			}
+			payload = payload[2:]
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		switch channel {
+		case websocketDataChannel:
+			if _, err := s.writer.Write(payload); err != nil {
+				s.conn.Close()
+			}
+		case websocketErrorChannel:
+			remoteErr = append(remoteErr, payload...)
+		}
+	}
+}
+
+func (s *websocketStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+func (s *websocketStream) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	msg := make([]byte, len(p)+1)
+	msg[0] = websocketDataChannel
+	copy(msg[1:], p)
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the stream. The protocol has no half-close so this also stops reading from the pod.
+func (s *websocketStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.writeMu.Lock()
+		s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		s.writeMu.Unlock()
+		s.conn.Close()
+	})
+	return nil
+}
+
+var _ podConnection = &spdyPodConnection{}
+var _ podConnection = &websocketPodConnection{}
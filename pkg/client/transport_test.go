@@ -0,0 +1,204 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testPod = v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+
+// fakePortForwardServer speaks the WebSocket port-forward protocol and echoes all data back. SPDY upgrades are
+// rejected the way a proxy which only passes WebSockets would.
+func fakePortForwardServer(t *testing.T, podError string) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{websocketPortForwardProtocol}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/pods/web/portforward" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Upgrade"), "SPDY") {
+			http.Error(w, "spdy is not supported", http.StatusBadRequest)
+			return
+		}
+		port, err := strconv.Atoi(r.URL.Query().Get("port"))
+		if err != nil {
+			http.Error(w, "missing port", http.StatusBadRequest)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		if conn.Subprotocol() != websocketPortForwardProtocol {
+			t.Errorf("expected subprotocol %s got %s", websocketPortForwardProtocol, conn.Subprotocol())
+		}
+		for _, channel := range []byte{websocketDataChannel, websocketErrorChannel} {
+			msg := []byte{channel, 0, 0}
+			binary.LittleEndian.PutUint16(msg[1:], uint16(port))
+			conn.WriteMessage(websocket.BinaryMessage, msg)
+		}
+		if podError != "" {
+			conn.WriteMessage(websocket.BinaryMessage, append([]byte{websocketErrorChannel}, podError...))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msg[0] != websocketDataChannel {
+				t.Errorf("expected data on channel %d got %d", websocketDataChannel, msg[0])
+			}
+			conn.WriteMessage(websocket.BinaryMessage, msg)
+		}
+	}))
+}
+
+func assertEchoes(t *testing.T, conn podConnection) {
+	stream, _, err := conn.openStream(8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("expected hello got %s", buf)
+	}
+}
+
+func TestWebsocketTransport(t *testing.T) {
+	server := fakePortForwardServer(t, "")
+	defer server.Close()
+	conf := &rest.Config{Host: server.URL, BearerToken: "secret"}
+
+	conn, err := dialPod(conf, testPod, transportWebSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEchoes(t, conn)
+}
+
+func TestAutoTransportFallsBackToWebsocket(t *testing.T) {
+	server := fakePortForwardServer(t, "")
+	defer server.Close()
+	conf := &rest.Config{Host: server.URL, BearerToken: "secret"}
+
+	if _, err := dialPod(conf, testPod, transportSPDY); err == nil {
+		t.Fatal("expected the spdy upgrade to be rejected")
+	}
+	conn, err := dialPod(conf, testPod, transportAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*websocketPodConnection); !ok {
+		t.Fatalf("expected a websocket connection got %T", conn)
+	}
+	assertEchoes(t, conn)
+}
+
+func TestWebsocketTransportReportsPodErrors(t *testing.T) {
+	server := fakePortForwardServer(t, "connection refused")
+	defer server.Close()
+	conf := &rest.Config{Host: server.URL, BearerToken: "secret"}
+
+	conn, err := dialPod(conf, testPod, transportWebSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, errorChan, err := conn.openStream(8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, stream); err != nil {
+		t.Errorf("expected a clean end of stream got %v", err)
+	}
+	err = <-errorChan
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("expected the pod's error to be reported got %v", err)
+	}
+}
+
+func TestWebsocketTransportClosesStreams(t *testing.T) {
+	server := fakePortForwardServer(t, "")
+	defer server.Close()
+	conf := &rest.Config{Host: server.URL, BearerToken: "secret"}
+
+	conn, err := dialPod(conf, testPod, transportWebSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _, err := conn.openStream(8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-conn.CloseChan()
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Error("expected reading from a closed connection to fail")
+	}
+	if _, _, err := conn.openStream(8080); err == nil {
+		t.Error("expected opening a stream on a closed connection to fail")
+	}
+}
+
+func TestWebsocketTransportReportsRejectedUpgrades(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Upgrade"), "SPDY") {
+			http.Error(w, "spdy is not supported", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("port") != "8080" {
+			t.Errorf("expected the upgrade to be tried with the pod's port got %s", r.URL.RawQuery)
+		}
+		status := apierrors.NewForbidden(schema.GroupResource{Resource: "pods/portforward"}, "web", errors.New("rbac")).ErrStatus
+		status.Kind = "Status"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(status)
+	}))
+	defer server.Close()
+	conf := &rest.Config{Host: server.URL, BearerToken: "secret"}
+	pod := testPod
+	pod.Spec.Containers = []v1.Container{{Ports: []v1.ContainerPort{{ContainerPort: 8080}}}}
+
+	for _, transport := range []string{transportWebSocket, transportAuto} {
+		if _, err := dialPod(conf, pod, transport); !apierrors.IsForbidden(err) {
+			t.Errorf("expected %s to report the forbidden port-forward got %v", transport, err)
+		}
+	}
+
+	server.Config.Handler = http.NotFoundHandler()
+	if _, err := dialPod(conf, pod, transportWebSocket); err == nil || !apierrors.IsNotFound(err) {
+		t.Errorf("expected the rejected upgrade to be reported got %v", err)
+	}
+}
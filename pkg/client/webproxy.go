@@ -0,0 +1,200 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/phayes/freeport"
+	"k8s.io/client-go/kubernetes"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"portfall/pkg/sniff"
+	"strconv"
+	"sync"
+)
+
+// websiteRules are the persisted rules of a website which are applied by serving it through a websiteProxy
+type websiteRules struct {
+	// Rewrite rewrites redirects, cookies and links of upstream hosts to the local url of the website
+	Rewrite *rewriteRules `json:"rewrite,omitempty"`
+	// Headers are set on every request
+	Headers []headerRule `json:"headers,omitempty"`
+}
+
+func (r *websiteRules) empty() bool {
+	return r == nil || (r.Rewrite == nil && len(r.Headers) == 0)
+}
+
+// websiteProxy serves a website through an http reverse proxy on its own local port, applying the website's rules
+type websiteProxy struct {
+	server    *http.Server
+	url       string
+	closeOnce sync.Once
+}
+
+// rulesKey identifies the website across restarts, by its service port if it was discovered through a service and
+// otherwise by the port of its workload, which outlives the pod
+func (w *Website) rulesKey() string {
+	req := w.portForwardReq
+	if req.ServiceName != "" {
+		return fmt.Sprintf("%s/service/%s:%d", req.Pod.Namespace, req.ServiceName, req.ServicePort)
+	}
+	return fmt.Sprintf("%s/%s:%d", req.Pod.Namespace, workloadOf(req.Pod), req.PodPort)
+}
+
+// upstreamHostnames are the names the website is known by in the cluster
+func (w *Website) upstreamHostnames() []string {
+	var hostnames []string
+	for _, service := range w.portForwardReq.serviceNames() {
+		hostnames = append(hostnames, serviceHostnames(service, w.portForwardReq.Pod.Namespace)...)
+	}
+	return hostnames
+}
+
+// startWebsiteProxy serves the website with its rules on a free port of its local address, recording its exchanges if
+// it is inspected. The values of headers are read from the cluster with s.
+func startWebsiteProxy(w *Website, rules *websiteRules, s kubernetes.Interface) (*websiteProxy, error) {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		return nil, err
+	}
+	host := "localhost"
+	if w.LocalAddress != "" {
+		host = w.LocalAddress
+	}
+	p := &websiteProxy{url: "http://" + net.JoinHostPort(host, strconv.Itoa(port))}
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: w.localTarget()})
+	var handler http.Handler = proxy
+	if len(rules.Headers) > 0 {
+		handler = newHeaderInjector(rules.Headers, s).handler(handler)
+	}
+	if rules.Rewrite != nil {
+		rw, err := newRewriter(rules.Rewrite, p.url, w.upstreamHostnames())
+		if err != nil {
+			return nil, err
+		}
+		proxy.ModifyResponse = rw.modifyResponse
+		handler = rw.handler(handler)
+		p.url += rw.prefix + "/"
+	}
+	if w.inspector != nil {
+		handler = w.inspector.handler(handler)
+	}
+
+	listeners, err := listenLocal(w.LocalAddress, int32(port))
+	if err != nil {
+		return nil, err
+	}
+	p.server = &http.Server{Handler: handler}
+	for _, l := range listeners {
+		go p.server.Serve(l)
+	}
+	return p, nil
+}
+
+func (p *websiteProxy) close() {
+	p.closeOnce.Do(func() {
+		p.server.Close()
+	})
+}
+
+// applyWebsiteRules serves the website through a proxy with its persisted rules and its inspector, replacing any
+// previous proxy. The proxy ends with the website.
+func (c *Client) applyWebsiteRules(w *Website) error {
+	if w.proxy != nil {
+		w.proxy.close()
+		w.proxy = nil
+		w.ProxyUrl = ""
+	}
+	rules := c.settings.Websites[w.rulesKey()]
+	if w.Protocol != sniff.HTTP && (!rules.empty() || w.inspector != nil) {
+		return errNotHTTP(w)
+	}
+	if rules.empty() && w.inspector == nil {
+		return nil
+	}
+	if rules == nil {
+		rules = &websiteRules{}
+	}
+	p, err := startWebsiteProxy(w, rules, c.s)
+	if err != nil {
+		return err
+	}
+	w.proxy = p
+	w.ProxyUrl = p.url
+	stopCh := w.portForwardReq.StopCh
+	go func() {
+		<-stopCh
+		p.close()
+	}()
+	return nil
+}
+
+// proxyNewWebsites serves the given websites which have persisted rules through a proxy
+func (c *Client) proxyNewWebsites(websites []*Website) {
+	for _, w := range websites {
+		if err := c.applyWebsiteRules(w); err != nil {
+			c.log.Warnf("failed to apply the rules of website on port %d: %v", w.LocalPort, err)
+		}
+	}
+}
+
+// updateWebsiteRules changes the persisted rules of the website on localAddress:localPort with update and serves it
+// with the new rules. An empty string is returned on success, otherwise the reason the rules couldn't be applied.
+func (c *Client) updateWebsiteRules(localAddress string, localPort int, update func(rules *websiteRules) error) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.websites {
+		if w.LocalAddress != localAddress || int(w.LocalPort) != localPort {
+			continue
+		}
+		if w.Protocol != sniff.HTTP {
+			return errNotHTTP(w).Error()
+		}
+		key := w.rulesKey()
+		rules := c.settings.Websites[key]
+		if rules == nil {
+			rules = &websiteRules{}
+		}
+		if err := update(rules); err != nil {
+			return err.Error()
+		}
+		if c.settings.Websites == nil {
+			c.settings.Websites = map[string]*websiteRules{}
+		}
+		if rules.empty() {
+			delete(c.settings.Websites, key)
+		} else {
+			c.settings.Websites[key] = rules
+		}
+		if err := c.settings.save(); err != nil {
+			c.log.Warnf("failed to save settings: %v", err)
+		}
+		if err := c.applyWebsiteRules(w); err != nil {
+			c.log.Warnf("failed to apply the rules of website on port %d: %v", localPort, err)
+			return err.Error()
+		}
+		return ""
+	}
+	return fmt.Sprintf("no website on port %d", localPort)
+}
+
+// GetWebsiteRules returns the json rules of the website on localAddress:localPort, which only reference the values of
+// headers
+func (c *Client) GetWebsiteRules(localAddress string, localPort int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, w := range c.websites {
+		if w.LocalAddress == localAddress && int(w.LocalPort) == localPort {
+			rules := c.settings.Websites[w.rulesKey()]
+			if rules == nil {
+				rules = &websiteRules{}
+			}
+			jBytes, _ := json.Marshal(rules)
+			return string(jBytes)
+		}
+	}
+	return ""
+}
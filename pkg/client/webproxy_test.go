@@ -0,0 +1,36 @@
+package client
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestRulesKeySurvivesRollouts(t *testing.T) {
+	controller := true
+	podOf := func(name string, owner string, hash string) v1.Pod {
+		pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop", Labels: map[string]string{}}}
+		if owner != "" {
+			pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: owner, Controller: &controller}}
+			pod.Labels["pod-template-hash"] = hash
+		}
+		return pod
+	}
+	website := func(pod v1.Pod) *Website {
+		return &Website{portForwardReq: portForwardPodRequest{Pod: pod, PodPort: 8080}}
+	}
+	before := website(podOf("web-5d8f7c-x2x9z", "web-5d8f7c", "5d8f7c"))
+	after := website(podOf("web-69b4d-qq7rt", "web-69b4d", "69b4d"))
+	if before.rulesKey() != "shop/Deployment/web:8080" || after.rulesKey() != before.rulesKey() {
+		t.Errorf("expected the rules of a deployment's pods to share a key got %s and %s", before.rulesKey(), after.rulesKey())
+	}
+	if key := website(podOf("debug", "", "")).rulesKey(); key != "shop/Pod/debug:8080" {
+		t.Errorf("expected a pod without controller to be keyed by its name got %s", key)
+	}
+	svc := website(podOf("web-5d8f7c-x2x9z", "web-5d8f7c", "5d8f7c"))
+	svc.portForwardReq.ServiceName = "web"
+	svc.portForwardReq.ServicePort = 80
+	if key := svc.rulesKey(); key != "shop/service/web:80" {
+		t.Errorf("expected a service website to be keyed by its service port got %s", key)
+	}
+}
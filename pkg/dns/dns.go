@@ -0,0 +1,162 @@
+package dns
+
+// a minimal DNS responder which answers A records for the cluster names Portfall forwards and forwards or refuses
+// everything else
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultPort is a high port so the server can run without root. Point the resolver of the cluster domain at it, e.g.
+// with /etc/resolver/cluster.local on macOS or a systemd-resolved drop-in on Linux.
+const DefaultPort = 10053
+
+// ttl is kept short as forwards come and go
+const ttl = 5
+
+// LookupFunc returns the address of the given lowercase name without the trailing dot, or false if it is unknown
+type LookupFunc func(name string) (net.IP, bool)
+
+// Server answers DNS queries over UDP from a LookupFunc
+type Server struct {
+	lookup LookupFunc
+	// upstream is the DNS server unknown names are forwarded to, unknown names get NXDOMAIN if it is empty
+	upstream string
+	conn     net.PacketConn
+}
+
+// NewServer creates a Server answering from lookup. Names lookup doesn't know are forwarded to upstream, a host:port
+// address, or answered with NXDOMAIN if upstream is empty.
+func NewServer(lookup LookupFunc, upstream string) *Server {
+	if upstream != "" {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+	}
+	return &Server{lookup: lookup, upstream: upstream}
+}
+
+// ListenAndServe binds addr and answers queries in the background until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	go s.serve()
+	return nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				fmt.Fprintf(os.Stderr, "error reading dns query: %v\n", err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp, err := s.answer(query)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error answering dns query from %s: %v\n", addr, err)
+				return
+			}
+			s.conn.WriteTo(resp, addr)
+		}()
+	}
+}
+
+// answer builds the response to a raw query
+func (s *Server) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+	ip, known := s.lookup(name)
+	if !known && s.upstream != "" {
+		return s.forward(query)
+	}
+
+	respHeader := dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: s.upstream != "",
+	}
+	if !known {
+		respHeader.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), respHeader)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	// known names only have an A record, any other type gets an empty answer
+	if ip4 := ip.To4(); known && ip4 != nil && q.Type == dnsmessage.TypeA && q.Class == dnsmessage.ClassINET {
+		var a dnsmessage.AResource
+		copy(a.A[:], ip4)
+		err := b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}, a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// forward relays the raw query to the upstream server and returns its raw response
+func (s *Server) forward(query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", s.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n < 2 || buf[0] != query[0] || buf[1] != query[1] {
+		return nil, errors.New("upstream dns response does not match the query")
+	}
+	return buf[:n], nil
+}
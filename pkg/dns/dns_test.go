@@ -0,0 +1,99 @@
+package dns
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T, upstream string) *Server {
+	s := NewServer(func(name string) (net.IP, bool) {
+		if name == "grafana.monitoring.svc.cluster.local" {
+			return net.IPv4(127, 1, 0, 1), true
+		}
+		return nil, false
+	}, upstream)
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func query(t *testing.T, addr net.Addr, name string, qType dnsmessage.Type) dnsmessage.Message {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qType,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(packed); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 42 {
+		t.Errorf("expected the response to the query got id %d", resp.ID)
+	}
+	return resp
+}
+
+func TestServerAnswersKnownNames(t *testing.T) {
+	s := startTestServer(t, "")
+	defer s.Close()
+
+	resp := query(t, s.Addr(), "Grafana.Monitoring.svc.cluster.local.", dnsmessage.TypeA)
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 1 {
+		t.Fatalf("expected a single answer got %v with %d answers", resp.RCode, len(resp.Answers))
+	}
+	a, ok := resp.Answers[0].Body.(*dnsmessage.AResource)
+	if !ok || net.IP(a.A[:]).String() != "127.1.0.1" {
+		t.Errorf("expected an A record for 127.1.0.1 got %v", resp.Answers[0].Body)
+	}
+
+	resp = query(t, s.Addr(), "grafana.monitoring.svc.cluster.local.", dnsmessage.TypeAAAA)
+	if resp.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) != 0 {
+		t.Errorf("expected an empty answer for AAAA got %v with %d answers", resp.RCode, len(resp.Answers))
+	}
+
+	resp = query(t, s.Addr(), "unknown.monitoring.svc.cluster.local.", dnsmessage.TypeA)
+	if resp.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("expected NXDOMAIN for an unknown name got %v", resp.RCode)
+	}
+}
+
+func TestServerForwardsUnknownNames(t *testing.T) {
+	upstream := startTestServer(t, "")
+	defer upstream.Close()
+	s := NewServer(func(name string) (net.IP, bool) {
+		return nil, false
+	}, upstream.Addr().String())
+	if err := s.ListenAndServe("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	resp := query(t, s.Addr(), "grafana.monitoring.svc.cluster.local.", dnsmessage.TypeA)
+	if len(resp.Answers) != 1 {
+		t.Errorf("expected the upstream's answer got %v with %d answers", resp.RCode, len(resp.Answers))
+	}
+}
@@ -32,6 +32,9 @@ type Icon struct {
 	PageTitle string
 }
 
+// transport is shared by all fetches so that their idle connections can be closed
+var transport = http.DefaultTransport.(*http.Transport).Clone()
+
 var linkRels = [4]string{"icon", "shortcut icon", "apple-touch-icon", "apple-touch-icon-precomposed"}
 var metaNames = [3]string{"msapplication-TileImage", "og:image", "image"}
 
@@ -47,7 +50,8 @@ func GetBest(getUrl string) (*Icon, error) {
 		Proto:  "HTTP",
 	}
 	c := http.Client{
-		Timeout: 4 * time.Second,
+		Timeout:   4 * time.Second,
+		Transport: transport,
 	}
 	resp, err := c.Do(&req)
 	if err != nil {
@@ -256,7 +260,8 @@ func getIconFromUrl(iconUrl *url.URL) (*Icon, error) {
 	// download icon and get extension and size
 	log.Printf("Getting icon from RemoteUrl %s", iconUrl.String())
 	c := http.Client{
-		Timeout: 3 * time.Second,
+		Timeout:   3 * time.Second,
+		Transport: transport,
 	}
 	resp, err := c.Get(iconUrl.String())
 	if err != nil {
@@ -292,6 +297,11 @@ func getIconFromUrl(iconUrl *url.URL) (*Icon, error) {
 	}, nil
 }
 
+// CloseIdleConnections closes the keep-alive connections left open by previous fetches
+func CloseIdleConnections() {
+	transport.CloseIdleConnections()
+}
+
 func unpack(s []string, vars ...*string) {
 	for i, str := range s {
 		*vars[i] = str
@@ -0,0 +1,235 @@
+package relay
+
+// the relay exposes a port on the laptop inside the cluster. The relay pod accepts inbound connections on its public
+// port and hands each of them to one of a pool of idle control connections Portfall opened to its control port over
+// port-forward. Portfall then connects to the local port and splices the two.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPublicPort is the port the relay pod accepts inbound connections on
+	DefaultPublicPort = 8080
+	// DefaultControlPort is the port Portfall opens control connections to
+	DefaultControlPort = 9000
+	// signalConnect is sent on an idle control connection to hand it an inbound connection
+	signalConnect byte = 1
+)
+
+// Server is the in-cluster side of the relay
+type Server struct {
+	// pool holds idle control connections
+	pool chan net.Conn
+	// WaitTimeout is how long an inbound connection waits for an idle control connection
+	WaitTimeout time.Duration
+}
+
+// NewServer creates a relay server which keeps up to poolSize idle control connections
+func NewServer(poolSize int) *Server {
+	return &Server{
+		pool:        make(chan net.Conn, poolSize),
+		WaitTimeout: 10 * time.Second,
+	}
+}
+
+// ListenControl listens for control connections on the pod's loopback interface, which port-forward reaches but
+// other pods in the cluster don't
+func ListenControl(port int) (net.Listener, error) {
+	return net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+}
+
+// ServeControl accepts control connections from Portfall until l is closed
+func (s *Server) ServeControl(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		select {
+		case s.pool <- conn:
+		default:
+			// the pool is full, Portfall will retry
+			conn.Close()
+		}
+	}
+}
+
+// ServePublic accepts inbound connections until l is closed and hands each of them to an idle control connection
+func (s *Server) ServePublic(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleInbound(conn)
+	}
+}
+
+func (s *Server) handleInbound(conn net.Conn) {
+	defer conn.Close()
+	timeout := time.After(s.WaitTimeout)
+	for {
+		var control net.Conn
+		select {
+		case control = <-s.pool:
+		case <-timeout:
+			fmt.Fprintf(os.Stderr, "no control connection for inbound connection from %s\n", conn.RemoteAddr())
+			return
+		}
+		// control connections may have been dropped while idle, try the next one then
+		if _, err := control.Write([]byte{signalConnect}); err != nil {
+			control.Close()
+			continue
+		}
+		Splice(conn, control)
+		return
+	}
+}
+
+// Agent is the laptop side of the relay. It keeps a pool of idle control connections open to the relay and connects
+// every connection the relay hands it to the local target.
+type Agent struct {
+	dial     func() (io.ReadWriteCloser, error)
+	target   string
+	poolSize int
+	mu       sync.Mutex
+	// idle are the control connections currently waiting for the relay
+	idle   map[io.ReadWriteCloser]bool
+	done   chan struct{}
+	closed sync.Once
+	wg     sync.WaitGroup
+}
+
+// NewAgent creates an agent opening control connections with dial and connecting them to the target host:port
+func NewAgent(dial func() (io.ReadWriteCloser, error), target string, poolSize int) *Agent {
+	return &Agent{
+		dial:     dial,
+		target:   target,
+		poolSize: poolSize,
+		idle:     map[io.ReadWriteCloser]bool{},
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the workers of the pool in the background until Close is called
+func (a *Agent) Start() {
+	for i := 0; i < a.poolSize; i++ {
+		a.wg.Add(1)
+		go a.worker()
+	}
+}
+
+// worker keeps one control connection open at a time, backing off while the relay can't be reached
+func (a *Agent) worker() {
+	defer a.wg.Done()
+	backoff := 100 * time.Millisecond
+	for {
+		select {
+		case <-a.done:
+			return
+		default:
+		}
+		control, err := a.dial()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error opening relay control connection: %v\n", err)
+		} else if a.serve(control) {
+			backoff = 100 * time.Millisecond
+			continue
+		}
+		// the relay isn't reachable or dropped the control connection without using it
+		select {
+		case <-a.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// serve waits for the relay to signal an inbound connection on the control connection and connects it to the target.
+// It returns whether the relay handed over a connection.
+func (a *Agent) serve(control io.ReadWriteCloser) bool {
+	if !a.track(control) {
+		control.Close()
+		return false
+	}
+	signal := make([]byte, 1)
+	_, err := io.ReadFull(control, signal)
+	a.untrack(control)
+	if err != nil || signal[0] != signalConnect {
+		control.Close()
+		return false
+	}
+	// serve the connection in the background so the pool is refilled right away
+	go func() {
+		local, err := net.Dial("tcp", a.target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error connecting relayed connection to %s: %v\n", a.target, err)
+			control.Close()
+			return
+		}
+		Splice(local, control)
+	}()
+	return true
+}
+
+func (a *Agent) track(control io.ReadWriteCloser) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.done:
+		return false
+	default:
+	}
+	a.idle[control] = true
+	return true
+}
+
+func (a *Agent) untrack(control io.ReadWriteCloser) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.idle, control)
+}
+
+// Close stops the agent, closing its idle control connections, and waits for its workers
+func (a *Agent) Close() {
+	a.closed.Do(func() {
+		a.mu.Lock()
+		close(a.done)
+		for control := range a.idle {
+			control.Close()
+		}
+		a.mu.Unlock()
+	})
+	a.wg.Wait()
+}
+
+// Splice copies data both ways until either side is done and then closes both
+func Splice(a io.ReadWriteCloser, b io.ReadWriteCloser) {
+	var once sync.Once
+	done := make(chan struct{})
+	copyTo := func(dst io.Writer, src io.Reader) {
+		_, err := io.Copy(dst, src)
+		if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+			fmt.Fprintf(os.Stderr, "error relaying: %v\n", err)
+		}
+		once.Do(func() {
+			close(done)
+		})
+	}
+	go copyTo(a, b)
+	go copyTo(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
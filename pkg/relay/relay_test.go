@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestRelayToLocalTarget(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from " + r.URL.Path))
+	}))
+	defer target.Close()
+
+	public, control := listen(t), listen(t)
+	defer public.Close()
+	defer control.Close()
+	s := NewServer(4)
+	go s.ServeControl(control)
+	go s.ServePublic(public)
+
+	agent := NewAgent(func() (io.ReadWriteCloser, error) {
+		return net.Dial("tcp", control.Addr().String())
+	}, strings.TrimPrefix(target.URL, "http://"), 2)
+	agent.Start()
+	defer agent.Close()
+
+	// more requests than control connections in the pool so that the pool has to be refilled
+	for i := 0; i < 5; i++ {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+		resp, err := client.Get("http://" + public.Addr().String() + "/webhook")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello from /webhook" {
+			t.Errorf("expected the local target's response got %q", body)
+		}
+	}
+}
+
+func TestRelayWithoutAgentTimesOut(t *testing.T) {
+	public, control := listen(t), listen(t)
+	defer public.Close()
+	defer control.Close()
+	s := NewServer(1)
+	s.WaitTimeout = 100 * time.Millisecond
+	go s.ServeControl(control)
+	go s.ServePublic(public)
+
+	conn, err := net.Dial("tcp", public.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the inbound connection to be closed got %v", err)
+	}
+}
+
+func TestControlPortOnlyAcceptsLoopback(t *testing.T) {
+	control, err := ListenControl(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	port := control.Addr().(*net.TCPAddr).Port
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("expected the control port to accept loopback connections got %v", err)
+	}
+	conn.Close()
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var external net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			external = ipNet.IP
+		}
+	}
+	if external == nil {
+		t.Skip("no non-loopback interface to connect from")
+	}
+	conn, err = net.DialTimeout("tcp", net.JoinHostPort(external.String(), strconv.Itoa(port)), time.Second)
+	if err == nil {
+		conn.Close()
+		t.Errorf("expected the control port to refuse connections to %s", external)
+	}
+}
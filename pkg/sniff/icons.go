@@ -0,0 +1,40 @@
+package sniff
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// badge is the built-in icon of a protocol, a coloured tile with a short label
+type badge struct {
+	label string
+	color string
+}
+
+var badges = map[string]badge{
+	HTTP:     {"www", "#607d8b"},
+	GRPC:     {"gRPC", "#244c5a"},
+	Postgres: {"PG", "#336791"},
+	MySQL:    {"My", "#00758f"},
+	Redis:    {"R", "#d82c20"},
+	MongoDB:  {"M", "#47a248"},
+	AMQP:     {"MQ", "#ff6600"},
+	Kafka:    {"K", "#231f20"},
+}
+
+// Icon returns the built-in icon of the protocol as a data url, a generic one for unknown protocols
+func Icon(protocol string) string {
+	b, ok := badges[protocol]
+	if !ok {
+		b = badge{"tcp", "#9e9e9e"}
+	}
+	fontSize := 28
+	if len(b.label) > 2 {
+		fontSize = 20
+	}
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="64" height="64" viewBox="0 0 64 64">`+
+		`<rect width="64" height="64" rx="12" fill="%s"/>`+
+		`<text x="32" y="33" fill="#fff" font-family="Helvetica,Arial,sans-serif" font-size="%d" font-weight="bold" text-anchor="middle" dominant-baseline="middle">%s</text>`+
+		`</svg>`, b.color, fontSize, b.label)
+	return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(svg))
+}
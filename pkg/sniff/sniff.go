@@ -0,0 +1,183 @@
+package sniff
+
+// fingerprints the protocol a tcp port speaks from its banner or its answer to the handshake of a known protocol, so
+// that ports which aren't websites can be told apart
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// Protocols which can be told apart
+const (
+	HTTP     = "http"
+	GRPC     = "grpc"
+	Postgres = "postgres"
+	MySQL    = "mysql"
+	Redis    = "redis"
+	MongoDB  = "mongodb"
+	AMQP     = "amqp"
+	Kafka    = "kafka"
+)
+
+// ErrUnknown is returned when the port doesn't answer like any of the known protocols
+var ErrUnknown = errors.New("unknown protocol")
+
+// bannerWait is how long a server is given to greet first, which only MySQL of the known protocols does
+const bannerWait = 300 * time.Millisecond
+
+// probe sends the opening of a protocol and tells whether the answer is from a server speaking it
+type probe struct {
+	protocol string
+	request  []byte
+	matches  func(answer []byte) bool
+}
+
+// http2Preface is the connection preface of an http/2 client followed by an empty SETTINGS frame
+var http2Preface = append([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), 0, 0, 0, 4, 0, 0, 0, 0, 0)
+
+// probes are tried in order on a connection of their own. http comes first as it is the most common, servers of the
+// other protocols close the connection or answer with an error on it.
+var probes = []probe{
+	{HTTP, []byte("HEAD / HTTP/1.0\r\nHost: localhost\r\n\r\n"), func(a []byte) bool {
+		return bytes.HasPrefix(a, []byte("HTTP/"))
+	}},
+	// a server which speaks http/2 without tls answers with a SETTINGS frame, which in a cluster is a gRPC server
+	{GRPC, http2Preface, func(a []byte) bool {
+		return len(a) >= 9 && a[3] == 4
+	}},
+	// SSLRequest, answered with S or N
+	{Postgres, []byte{0, 0, 0, 8, 4, 210, 22, 47}, func(a []byte) bool {
+		return len(a) == 1 && (a[0] == 'S' || a[0] == 'N')
+	}},
+	{Redis, []byte("PING\r\n"), func(a []byte) bool {
+		for _, prefix := range []string{"+PONG", "-NOAUTH", "-WRONGPASS", "-DENIED"} {
+			if bytes.HasPrefix(a, []byte(prefix)) {
+				return true
+			}
+		}
+		return false
+	}},
+	{MongoDB, mongoIsMaster(), func(a []byte) bool {
+		if len(a) < 16 {
+			return false
+		}
+		opCode := binary.LittleEndian.Uint32(a[12:16])
+		// OP_REPLY or OP_MSG in response to the request
+		return (opCode == 1 || opCode == 2013) && binary.LittleEndian.Uint32(a[8:12]) == mongoRequestID
+	}},
+	// protocol header of AMQP 0-9-1, answered with a Connection.Start method frame or the header the server speaks
+	{AMQP, []byte("AMQP\x00\x00\x09\x01"), func(a []byte) bool {
+		if bytes.HasPrefix(a, []byte("AMQP")) {
+			return true
+		}
+		return len(a) >= 11 && a[0] == 1 && bytes.Equal(a[7:11], []byte{0, 10, 0, 10})
+	}},
+	{Kafka, kafkaAPIVersions(), func(a []byte) bool {
+		return len(a) >= 8 && binary.BigEndian.Uint32(a[4:8]) == kafkaCorrelationID
+	}},
+}
+
+const mongoRequestID = 0x504f5254
+
+// mongoIsMaster is an OP_QUERY of isMaster on admin.$cmd, which servers answer before authentication
+func mongoIsMaster() []byte {
+	doc := []byte{0x10}
+	doc = append(doc, "isMaster\x00"...)
+	doc = append(doc, 1, 0, 0, 0, 0)
+	doc = append(le32(uint32(len(doc)+4)), doc...)
+
+	body := le32(0) // flags
+	body = append(body, "admin.$cmd\x00"...)
+	body = append(body, le32(0)...)          // skip
+	body = append(body, le32(0xffffffff)...) // return -1
+	body = append(body, doc...)
+
+	msg := le32(uint32(16 + len(body)))
+	msg = append(msg, le32(mongoRequestID)...)
+	msg = append(msg, le32(0)...)    // responseTo
+	msg = append(msg, le32(2004)...) // OP_QUERY
+	return append(msg, body...)
+}
+
+const kafkaCorrelationID = 0x504f5254
+
+// kafkaAPIVersions is an ApiVersions v0 request, which brokers answer before authentication
+func kafkaAPIVersions() []byte {
+	clientID := "portfall"
+	req := []byte{0, 18, 0, 0} // api key 18, version 0
+	req = append(req, be32(kafkaCorrelationID)...)
+	req = append(req, 0, byte(len(clientID)))
+	req = append(req, clientID...)
+	return append(be32(uint32(len(req))), req...)
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// isMySQLGreeting tells whether the banner is the initial handshake packet of MySQL or MariaDB, a packet with sequence
+// id 0 holding protocol version 10 and a null terminated server version
+func isMySQLGreeting(banner []byte) bool {
+	if len(banner) < 6 || banner[3] != 0 || banner[4] != 10 {
+		return false
+	}
+	length := int(banner[0]) | int(banner[1])<<8 | int(banner[2])<<16
+	return length > 0 && bytes.IndexByte(banner[5:], 0) > 0
+}
+
+// Sniff returns the protocol the server at addr speaks, ErrUnknown if it doesn't answer like a known one. Every
+// attempt waits for timeout at most.
+func Sniff(addr string, timeout time.Duration) (string, error) {
+	banner, err := exchange(addr, nil, bannerWait)
+	if err != nil {
+		return "", err
+	}
+	if len(banner) > 0 {
+		if isMySQLGreeting(banner) {
+			return MySQL, nil
+		}
+		return "", ErrUnknown
+	}
+	for _, p := range probes {
+		answer, err := exchange(addr, p.request, timeout)
+		if err != nil {
+			return "", err
+		}
+		// an echo server would otherwise pass for AMQP
+		if !bytes.Equal(answer, p.request) && p.matches(answer) {
+			return p.protocol, nil
+		}
+	}
+	return "", ErrUnknown
+}
+
+// exchange sends the request on a new connection and returns the first answer, which is empty if the server closed
+// the connection or didn't answer in time. Only a failing connect is an error.
+func exchange(addr string, request []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if len(request) > 0 {
+		if _, err := conn.Write(request); err != nil {
+			return nil, nil
+		}
+	}
+	buf := make([]byte, 512)
+	n, _ := conn.Read(buf)
+	return buf[:n], nil
+}
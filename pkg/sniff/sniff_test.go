@@ -0,0 +1,145 @@
+package sniff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves every connection with the greeting and the answer to the first request of the client. answer
+// returns nil to close the connection without answering.
+func startServer(t *testing.T, greeting []byte, answer func(request []byte) []byte) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if greeting != nil {
+					conn.Write(greeting)
+					return
+				}
+				buf := make([]byte, 512)
+				n, _ := conn.Read(buf)
+				if a := answer(buf[:n]); a != nil {
+					conn.Write(a)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func sniffed(t *testing.T, l net.Listener) (string, error) {
+	defer l.Close()
+	return Sniff(l.Addr().String(), time.Second)
+}
+
+func TestSniff(t *testing.T) {
+	mongoReply := make([]byte, 36)
+	binary.LittleEndian.PutUint32(mongoReply[0:4], 36)
+	binary.LittleEndian.PutUint32(mongoReply[8:12], mongoRequestID)
+	binary.LittleEndian.PutUint32(mongoReply[12:16], 1)
+
+	kafkaReply := append(be32(6), be32(kafkaCorrelationID)...)
+	kafkaReply = append(kafkaReply, 0, 35)
+
+	servers := map[string]func(request []byte) []byte{
+		HTTP: func(r []byte) []byte {
+			if bytes.HasPrefix(r, []byte("HEAD ")) {
+				return []byte("HTTP/1.1 404 Not Found\r\n\r\n")
+			}
+			return nil
+		},
+		GRPC: func(r []byte) []byte {
+			if bytes.HasPrefix(r, []byte("PRI * HTTP/2.0")) {
+				return []byte{0, 0, 6, 4, 0, 0, 0, 0, 0, 0, 5, 0, 0, 64, 0}
+			}
+			return nil
+		},
+		Postgres: func(r []byte) []byte {
+			if len(r) == 8 && r[3] == 8 {
+				return []byte("N")
+			}
+			return []byte("E")
+		},
+		Redis: func(r []byte) []byte {
+			return []byte("-NOAUTH Authentication required.\r\n")
+		},
+		MongoDB: func(r []byte) []byte {
+			if len(r) > 16 && binary.LittleEndian.Uint32(r[12:16]) == 2004 {
+				return mongoReply
+			}
+			return nil
+		},
+		AMQP: func(r []byte) []byte {
+			if bytes.HasPrefix(r, []byte("AMQP")) {
+				return []byte{1, 0, 0, 0, 0, 1, 0, 0, 10, 0, 10, 0, 9}
+			}
+			return nil
+		},
+		Kafka: func(r []byte) []byte {
+			if len(r) > 8 && r[5] == 18 {
+				return kafkaReply
+			}
+			return nil
+		},
+	}
+	for protocol, answer := range servers {
+		if p, err := sniffed(t, startServer(t, nil, answer)); err != nil || p != protocol {
+			t.Errorf("expected %s got %s %v", protocol, p, err)
+		}
+	}
+}
+
+func TestSniffMySQLGreeting(t *testing.T) {
+	version := "8.0.33\x00"
+	payload := append([]byte{10}, version...)
+	payload = append(payload, make([]byte, 40)...)
+	greeting := append([]byte{byte(len(payload)), 0, 0, 0}, payload...)
+	if p, err := sniffed(t, startServer(t, greeting, nil)); err != nil || p != MySQL {
+		t.Errorf("expected mysql got %s %v", p, err)
+	}
+}
+
+func TestSniffUnknown(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(time.Second))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	if p, err := sniffed(t, echo); err != ErrUnknown {
+		t.Errorf("expected an echo server to be unknown got %s %v", p, err)
+	}
+	if p, err := sniffed(t, startServer(t, []byte("SSH-2.0-OpenSSH_9.3\r\n"), nil)); err != ErrUnknown {
+		t.Errorf("expected an unknown banner to be unknown got %s %v", p, err)
+	}
+}
+
+func TestIcon(t *testing.T) {
+	if Icon(Postgres) == Icon("ftp") || !strings.HasPrefix(Icon(Postgres), "data:image/svg+xml;base64,") {
+		t.Error("expected a built-in data url icon per protocol")
+	}
+}